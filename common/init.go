@@ -138,6 +138,10 @@ func initConstantEnv() {
 	constant.StreamingTimeout = GetEnvOrDefault("STREAMING_TIMEOUT", 300)
 	constant.DifyDebug = GetEnvOrDefaultBool("DIFY_DEBUG", true)
 	constant.MaxFileDownloadMB = GetEnvOrDefault("MAX_FILE_DOWNLOAD_MB", 64)
+	// FileUrlCache 进程级远程文件缓存，重试或多轮对话中重复引用同一 URL 时避免重复下载，条目数为 0 表示关闭。
+	// 缓存不遵循上游的 HTTP 缓存头，同一 URL 内容会变化时不要开启，默认关闭
+	constant.FileUrlCacheMaxEntries = GetEnvOrDefault("FILE_URL_CACHE_MAX_ENTRIES", 0)
+	constant.FileUrlCacheTTLSeconds = GetEnvOrDefault("FILE_URL_CACHE_TTL_SECONDS", 600)
 	constant.StreamScannerMaxBufferMB = GetEnvOrDefault("STREAM_SCANNER_MAX_BUFFER_MB", 128)
 	// MaxRequestBodyMB 请求体最大大小（解压后），用于防止超大请求/zip bomb导致内存暴涨
 	constant.MaxRequestBodyMB = GetEnvOrDefault("MAX_REQUEST_BODY_MB", 128)
@@ -72,4 +72,12 @@ const (
 	// fallback in authHelper (finishAdminAudit) skips its record to avoid
 	// duplicate entries.
 	ContextKeyAuditLogged ContextKey = "audit_logged"
+
+	// ContextKeyResolvedUpstreamModel stores the model name actually sent upstream after
+	// adaptor-level rewrites such as stripping the -thinking suffix.
+	ContextKeyResolvedUpstreamModel ContextKey = "resolved_upstream_model"
+
+	// ContextKeyResponseModelAlias stores the client-facing model alias that replaces the
+	// upstream model name in converted responses.
+	ContextKeyResponseModelAlias ContextKey = "response_model_alias"
 )
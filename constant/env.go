@@ -3,6 +3,8 @@ package constant
 var StreamingTimeout int
 var DifyDebug bool
 var MaxFileDownloadMB int
+var FileUrlCacheMaxEntries int
+var FileUrlCacheTTLSeconds int
 var StreamScannerMaxBufferMB int
 var ForceStreamOption bool
 var CountToken bool
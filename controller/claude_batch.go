@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/relay/channel/claude"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RetrieveClaudeMessageBatch 查询经 X-Claude-Batch 提交的 batch 状态
+func RetrieveClaudeMessageBatch(c *gin.Context) {
+	relayClaudeMessageBatch(c, "")
+}
+
+// GetClaudeMessageBatchResults 获取 batch 的 JSONL 结果，按上游响应流式返回
+func GetClaudeMessageBatchResults(c *gin.Context) {
+	relayClaudeMessageBatch(c, "/results")
+}
+
+// relayClaudeMessageBatch 按提交时记录的渠道和 key 转发 batch 查询请求，只允许提交者本人查询；
+// 查询不产生上游费用，提交时已按预估计费，这里不再扣费
+func relayClaudeMessageBatch(c *gin.Context, suffix string) {
+	batchId := c.Param("batch_id")
+	owner, ok := claude.LoadMessageBatchOwner(batchId)
+	if !ok || owner.UserId != c.GetInt("id") {
+		videoProxyError(c, http.StatusNotFound, "invalid_request_error", "Message batch not found")
+		return
+	}
+
+	channel, err := model.CacheGetChannel(owner.ChannelId)
+	if err != nil || channel.Type != constant.ChannelTypeAnthropic {
+		videoProxyError(c, http.StatusNotFound, "invalid_request_error", "Message batch not found")
+		return
+	}
+	apiKey := channel.Key
+	if channel.ChannelInfo.IsMultiKey {
+		keys := channel.GetKeys()
+		if owner.KeyIndex < 0 || owner.KeyIndex >= len(keys) {
+			videoProxyError(c, http.StatusNotFound, "invalid_request_error", "Message batch not found")
+			return
+		}
+		apiKey = keys[owner.KeyIndex]
+	}
+	baseURL := channel.GetBaseURL()
+	if baseURL == "" {
+		baseURL = constant.ChannelBaseURLs[channel.Type]
+	}
+
+	client, err := service.GetHttpClientWithProxy(channel.GetSetting().Proxy)
+	if err != nil {
+		logger.LogError(c.Request.Context(), fmt.Sprintf("Failed to create proxy client for message batch %s: %s", batchId, err.Error()))
+		videoProxyError(c, http.StatusInternalServerError, "server_error", "Failed to create proxy client")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Minute)
+	defer cancel()
+	requestURL := fmt.Sprintf("%s/v1/messages/batches/%s%s", baseURL, url.PathEscape(batchId), suffix)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		logger.LogError(c.Request.Context(), fmt.Sprintf("Failed to create request: %s", err.Error()))
+		videoProxyError(c, http.StatusInternalServerError, "server_error", "Failed to create proxy request")
+		return
+	}
+	req.Header.Set("x-api-key", apiKey)
+	anthropicVersion := c.Request.Header.Get("anthropic-version")
+	if anthropicVersion == "" {
+		anthropicVersion = model_setting.DefaultAnthropicVersion
+	}
+	req.Header.Set("anthropic-version", anthropicVersion)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.LogError(c.Request.Context(), fmt.Sprintf("Failed to fetch message batch %s: %s", batchId, err.Error()))
+		videoProxyError(c, http.StatusBadGateway, "server_error", "Failed to fetch message batch")
+		return
+	}
+	defer resp.Body.Close()
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		c.Writer.Header().Set("Content-Type", contentType)
+	}
+	c.Writer.WriteHeader(resp.StatusCode)
+	if _, err = io.Copy(c.Writer, resp.Body); err != nil {
+		logger.LogError(c.Request.Context(), fmt.Sprintf("Failed to stream message batch %s: %s", batchId, err.Error()))
+	}
+}
@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/relay/channel/claude"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetClaudeMessageBatchResultsRelaysToSubmittingChannel(t *testing.T) {
+	db := setupModelListControllerTestDB(t)
+	originalMemoryCacheEnabled := common.MemoryCacheEnabled
+	common.MemoryCacheEnabled = false
+	t.Cleanup(func() { common.MemoryCacheEnabled = originalMemoryCacheEnabled })
+	service.InitHttpClient()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/messages/batches/msgbatch_results_test/results", r.URL.Path)
+		assert.Equal(t, "sk-second", r.Header.Get("x-api-key"))
+		assert.NotEmpty(t, r.Header.Get("anthropic-version"))
+		w.Header().Set("Content-Type", "application/x-jsonl")
+		_, _ = io.WriteString(w, `{"custom_id":"request-0","result":{"type":"succeeded"}}`+"\n")
+	}))
+	t.Cleanup(upstream.Close)
+
+	baseURL := upstream.URL
+	channel := &model.Channel{
+		Type:    constant.ChannelTypeAnthropic,
+		Key:     "sk-first\nsk-second",
+		BaseURL: &baseURL,
+		Status:  common.ChannelStatusEnabled,
+	}
+	channel.ChannelInfo.IsMultiKey = true
+	require.NoError(t, db.Create(channel).Error)
+
+	// 通过 batch 创建响应记录归属
+	submitContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+	submitContext.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	_, apiErr := claude.ClaudeMessageBatchHandler(submitContext, &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(`{"id":"msgbatch_results_test","type":"message_batch"}`)),
+	}, &relaycommon.RelayInfo{
+		UserId:      11,
+		ChannelMeta: &relaycommon.ChannelMeta{ChannelId: channel.Id, ChannelMultiKeyIndex: 1},
+	}, 0)
+	require.Nil(t, apiErr)
+
+	fetch := func(userId int) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodGet, "/v1/messages/batches/msgbatch_results_test/results", nil)
+		c.Params = gin.Params{{Key: "batch_id", Value: "msgbatch_results_test"}}
+		c.Set("id", userId)
+		GetClaudeMessageBatchResults(c)
+		return recorder
+	}
+
+	recorder := fetch(11)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/x-jsonl", recorder.Header().Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), `"custom_id":"request-0"`)
+
+	// 其他用户不能读取该 batch
+	recorder = fetch(12)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
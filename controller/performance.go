@@ -13,6 +13,7 @@ import (
 
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/service"
 	"github.com/gin-gonic/gin"
 )
 
@@ -20,6 +21,8 @@ import (
 type PerformanceStats struct {
 	// 缓存统计
 	CacheStats common.DiskCacheStats `json:"cache_stats"`
+	// 远程文件 URL 缓存统计
+	FileUrlCacheStats service.FileUrlCacheStats `json:"file_url_cache_stats"`
 	// 系统内存统计
 	MemoryStats MemoryStats `json:"memory_stats"`
 	// 磁盘缓存目录信息
@@ -120,7 +123,8 @@ func GetPerformanceStats(c *gin.Context) {
 	diskSpaceInfo = common.GetDiskSpaceInfo()
 
 	stats := PerformanceStats{
-		CacheStats: cacheStats,
+		CacheStats:        cacheStats,
+		FileUrlCacheStats: service.GetFileUrlCacheStats(),
 		MemoryStats: MemoryStats{
 			Alloc:        memStats.Alloc,
 			TotalAlloc:   memStats.TotalAlloc,
@@ -158,6 +162,7 @@ func ClearDiskCache(c *gin.Context) {
 // ResetPerformanceStats 重置性能统计
 func ResetPerformanceStats(c *gin.Context) {
 	common.ResetDiskCacheStats()
+	service.ResetFileUrlCacheStats()
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
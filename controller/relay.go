@@ -190,6 +190,9 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 
 	for ; retryParam.GetRetry() <= common.RetryTimes; retryParam.IncreaseRetry() {
 		relayInfo.RetryIndex = retryParam.GetRetry()
+		// 上一次尝试按渠道设置的上游超时与空闲 Ping 间隔不能带到本次选中的渠道
+		relayInfo.UpstreamTimeout = 0
+		relayInfo.StreamIdlePingInterval = 0
 		channel, channelErr := getChannel(c, relayInfo, retryParam)
 		if channelErr != nil {
 			logger.LogError(c, channelErr.Error())
@@ -389,6 +392,10 @@ func processChannelError(c *gin.Context, channelError types.ChannelError, err *t
 			adminInfo["is_multi_key"] = true
 			adminInfo["multi_key_index"] = common.GetContextKeyInt(c, constant.ContextKeyChannelMultiKeyIndex)
 		}
+		if len(err.Metadata) > 0 {
+			// 如上游 request id，便于向渠道方反馈
+			adminInfo["error_metadata"] = err.Metadata
+		}
 		service.AppendChannelAffinityAdminInfo(c, adminInfo)
 		other["admin_info"] = adminInfo
 		startTime := common.GetContextKeyTime(c, constant.ContextKeyRequestStartTime)
@@ -22,10 +22,14 @@ type ClaudeMediaMessage struct {
 	Source       *ClaudeMessageSource `json:"source,omitempty"`
 	Usage        *ClaudeUsage         `json:"usage,omitempty"`
 	StopReason   *string              `json:"stop_reason,omitempty"`
+	StopSequence *string              `json:"stop_sequence,omitempty"`
 	PartialJson  *string              `json:"partial_json,omitempty"`
 	Role         string               `json:"role,omitempty"`
 	Thinking     *string              `json:"thinking,omitempty"`
 	Signature    string               `json:"signature,omitempty"`
+	Data         string               `json:"data,omitempty"` // redacted_thinking 的加密内容
+	Citations    json.RawMessage      `json:"citations,omitempty"`
+	Citation     *ClaudeCitation      `json:"citation,omitempty"` // citations_delta
 	Delta        string               `json:"delta,omitempty"`
 	CacheControl json.RawMessage      `json:"cache_control,omitempty"`
 	// tool_calls
@@ -34,6 +38,7 @@ type ClaudeMediaMessage struct {
 	Input     any    `json:"input,omitempty"`
 	Content   any    `json:"content,omitempty"`
 	ToolUseId string `json:"tool_use_id,omitempty"`
+	IsError   *bool  `json:"is_error,omitempty"`
 }
 
 func (c *ClaudeMediaMessage) SetText(s string) {
@@ -112,6 +117,14 @@ func (m *ClaudeMediaMessage) ToFileSource() types.FileSource {
 	return types.NewFileSourceFromData(data, m.Source.MediaType)
 }
 
+// ClaudeCitation 是 text block 上的引用，这里只解析 web_search_result_location 用到的字段
+type ClaudeCitation struct {
+	Type      string `json:"type"`
+	Url       string `json:"url,omitempty"`
+	Title     string `json:"title,omitempty"`
+	CitedText string `json:"cited_text,omitempty"`
+}
+
 type ClaudeMessageSource struct {
 	Type      string `json:"type"`
 	MediaType string `json:"media_type,omitempty"`
@@ -171,9 +184,10 @@ func (c *ClaudeMessage) ParseContent() ([]ClaudeMediaMessage, error) {
 }
 
 type Tool struct {
-	Name        string                 `json:"name"`
-	Description string                 `json:"description,omitempty"`
-	InputSchema map[string]interface{} `json:"input_schema"`
+	Name         string                 `json:"name"`
+	Description  string                 `json:"description,omitempty"`
+	InputSchema  map[string]interface{} `json:"input_schema"`
+	CacheControl json.RawMessage        `json:"cache_control,omitempty"`
 }
 
 type InputSchema struct {
@@ -496,6 +510,7 @@ type ClaudeResponse struct {
 	Content      []ClaudeMediaMessage `json:"content,omitempty"`
 	Completion   string               `json:"completion,omitempty"`
 	StopReason   string               `json:"stop_reason,omitempty"`
+	StopSequence *string              `json:"stop_sequence,omitempty"`
 	Model        string               `json:"model,omitempty"`
 	Error        any                  `json:"error,omitempty"`
 	Usage        *ClaudeUsage         `json:"usage,omitempty"`
@@ -599,3 +614,49 @@ func (u *ClaudeUsage) GetCacheCreationTotalTokens() int {
 type ClaudeServerToolUse struct {
 	WebSearchRequests int `json:"web_search_requests"`
 }
+
+// ClaudeMessageBatchRequest 是 /v1/messages/batches 的请求体
+type ClaudeMessageBatchRequest struct {
+	Requests []ClaudeMessageBatchRequestItem `json:"requests"`
+}
+
+type ClaudeMessageBatchRequestItem struct {
+	CustomId string         `json:"custom_id"`
+	Params   *ClaudeRequest `json:"params"`
+}
+
+// ClaudeCountTokensRequest 是 /v1/messages/count_tokens 的请求体，只包含参与计数的字段
+type ClaudeCountTokensRequest struct {
+	Model      string          `json:"model"`
+	System     any             `json:"system,omitempty"`
+	Messages   []ClaudeMessage `json:"messages"`
+	Tools      any             `json:"tools,omitempty"`
+	ToolChoice any             `json:"tool_choice,omitempty"`
+	Thinking   *Thinking       `json:"thinking,omitempty"`
+}
+
+// ClaudeCountTokensResponse 是 count_tokens 接口返回的输入 token 数
+type ClaudeCountTokensResponse struct {
+	InputTokens int `json:"input_tokens"`
+}
+
+// ClaudeMessageBatch 是创建 batch 后上游返回的 batch 对象
+type ClaudeMessageBatch struct {
+	Id                string                           `json:"id"`
+	Type              string                           `json:"type"`
+	ProcessingStatus  string                           `json:"processing_status"`
+	RequestCounts     *ClaudeMessageBatchRequestCounts `json:"request_counts,omitempty"`
+	EndedAt           *string                          `json:"ended_at,omitempty"`
+	CreatedAt         string                           `json:"created_at,omitempty"`
+	ExpiresAt         string                           `json:"expires_at,omitempty"`
+	CancelInitiatedAt *string                          `json:"cancel_initiated_at,omitempty"`
+	ResultsUrl        *string                          `json:"results_url,omitempty"`
+}
+
+type ClaudeMessageBatchRequestCounts struct {
+	Processing int `json:"processing"`
+	Succeeded  int `json:"succeeded"`
+	Errored    int `json:"errored"`
+	Canceled   int `json:"canceled"`
+	Expired    int `json:"expired"`
+}
@@ -241,6 +241,8 @@ type ToolCallRequest struct {
 	Type     string          `json:"type"`
 	Function FunctionRequest `json:"function,omitempty"`
 	Custom   json.RawMessage `json:"custom,omitempty"`
+	// CacheControl 是 Claude 扩展参数，转换为 Claude 请求时作为工具的 cache_control 断点
+	CacheControl json.RawMessage `json:"cache_control,omitempty"`
 }
 
 type FunctionRequest struct {
@@ -257,6 +259,15 @@ type StreamOptions struct {
 	IncludeObfuscation bool `json:"include_obfuscation,omitempty"`
 }
 
+// StripNonUpstreamMessageFields 清除消息中不应转发给 OpenAI 格式上游的字段：只供转换为 Claude 使用的 is_error，
+// 以及客户端回传的只出现在响应中的 annotations
+func (r *GeneralOpenAIRequest) StripNonUpstreamMessageFields() {
+	for i := range r.Messages {
+		r.Messages[i].IsError = nil
+		r.Messages[i].Annotations = nil
+	}
+}
+
 func (r *GeneralOpenAIRequest) GetMaxTokens() uint {
 	maxCompletionTokens := lo.FromPtrOr(r.MaxCompletionTokens, uint(0))
 	if maxCompletionTokens != 0 {
@@ -293,7 +304,11 @@ type Message struct {
 	Reasoning        *string         `json:"reasoning,omitempty"`
 	ToolCalls        json.RawMessage `json:"tool_calls,omitempty"`
 	ToolCallId       string          `json:"tool_call_id,omitempty"`
-	parsedContent    []MediaContent
+	// IsError 标记 tool 消息是失败的工具调用结果，转换为 Claude 时映射为 tool_result.is_error
+	IsError *bool `json:"is_error,omitempty"`
+	// Annotations 只出现在响应中，例如联网搜索的 url_citation
+	Annotations   []ChatCompletionAnnotation `json:"annotations,omitempty"`
+	parsedContent []MediaContent
 	//parsedStringContent *string
 }
 
@@ -306,6 +321,8 @@ type MediaContent struct {
 	VideoUrl   any    `json:"video_url,omitempty"`
 	// OpenRouter Params
 	CacheControl json.RawMessage `json:"cache_control,omitempty"`
+	// Citations 是 Claude 扩展参数，file 内容上传入 {"enabled": true} 时为转换出的 document block 开启引用
+	Citations json.RawMessage `json:"citations,omitempty"`
 }
 
 func (m *MediaContent) GetImageMedia() *MessageImageUrl {
@@ -571,10 +588,16 @@ func (m *Message) ParseContent() []MediaContent {
 		switch contentType {
 		case ContentTypeText:
 			if text, ok := contentItem["text"].(string); ok {
-				contentList = append(contentList, MediaContent{
+				mediaContent := MediaContent{
 					Type: ContentTypeText,
 					Text: text,
-				})
+				}
+				if cacheControl, ok := contentItem["cache_control"]; ok && cacheControl != nil {
+					if rawCacheControl, err := common.Marshal(cacheControl); err == nil {
+						mediaContent.CacheControl = rawCacheControl
+					}
+				}
+				contentList = append(contentList, mediaContent)
 			}
 
 		case ContentTypeImageURL:
@@ -617,6 +640,12 @@ func (m *Message) ParseContent() []MediaContent {
 			}
 		case ContentTypeFile:
 			if fileData, ok := contentItem["file"].(map[string]interface{}); ok {
+				var citations json.RawMessage
+				if rawCitations, ok := contentItem["citations"]; ok && rawCitations != nil {
+					if marshaled, err := common.Marshal(rawCitations); err == nil {
+						citations = marshaled
+					}
+				}
 				fileId, ok3 := fileData["file_id"].(string)
 				if ok3 {
 					contentList = append(contentList, MediaContent{
@@ -624,6 +653,7 @@ func (m *Message) ParseContent() []MediaContent {
 						File: &MessageFile{
 							FileId: fileId,
 						},
+						Citations: citations,
 					})
 				} else {
 					fileName, ok1 := fileData["filename"].(string)
@@ -635,6 +665,7 @@ func (m *Message) ParseContent() []MediaContent {
 								FileName: fileName,
 								FileData: fileDataStr,
 							},
+							Citations: citations,
 						})
 					}
 				}
@@ -95,3 +95,26 @@ func TestGeneralOpenAIRequestGetSystemRoleName(t *testing.T) {
 		})
 	}
 }
+
+func TestGeneralOpenAIRequestStripNonUpstreamMessageFields(t *testing.T) {
+	raw := []byte(`{
+		"model":"gpt-4.1",
+		"messages":[
+			{"role":"user","content":"hi"},
+			{"role":"assistant","content":"see [1]","annotations":[{"type":"url_citation","url_citation":{"url":"https://example.com","title":"Example"}}]},
+			{"role":"tool","tool_call_id":"call_1","content":"boom","is_error":true}
+		]
+	}`)
+
+	var req GeneralOpenAIRequest
+	require.NoError(t, common.Unmarshal(raw, &req))
+	req.StripNonUpstreamMessageFields()
+
+	encoded, err := common.Marshal(req)
+	require.NoError(t, err)
+
+	require.False(t, gjson.GetBytes(encoded, "messages.1.annotations").Exists())
+	require.Equal(t, "see [1]", gjson.GetBytes(encoded, "messages.1.content").String())
+	require.False(t, gjson.GetBytes(encoded, "messages.2.is_error").Exists())
+	require.Equal(t, "call_1", gjson.GetBytes(encoded, "messages.2.tool_call_id").String())
+}
@@ -35,16 +35,19 @@ type OpenAITextResponseChoice struct {
 	Index        int `json:"index"`
 	Message      `json:"message"`
 	FinishReason string `json:"finish_reason"`
+	// StopSequence 是上游命中的停止序列（Claude 扩展字段），finish_reason 仍为 stop
+	StopSequence *string `json:"stop_sequence,omitempty"`
 }
 
 type OpenAITextResponse struct {
-	Id      string                     `json:"id"`
-	Model   string                     `json:"model"`
-	Object  string                     `json:"object"`
-	Created any                        `json:"created"`
-	Choices []OpenAITextResponseChoice `json:"choices"`
-	Error   any                        `json:"error,omitempty"`
-	Usage   `json:"usage"`
+	Id                string                     `json:"id"`
+	Model             string                     `json:"model"`
+	Object            string                     `json:"object"`
+	Created           any                        `json:"created"`
+	SystemFingerprint string                     `json:"system_fingerprint,omitempty"`
+	Choices           []OpenAITextResponseChoice `json:"choices"`
+	Error             any                        `json:"error,omitempty"`
+	Usage             `json:"usage"`
 }
 
 // GetOpenAIError 从动态错误类型中提取OpenAIError结构
@@ -83,14 +86,33 @@ type ChatCompletionsStreamResponseChoice struct {
 	Logprobs     *any                                     `json:"logprobs"`
 	FinishReason *string                                  `json:"finish_reason"`
 	Index        int                                      `json:"index"`
+	// StopSequence 是上游命中的停止序列（Claude 扩展字段），只出现在最后一个 chunk
+	StopSequence *string `json:"stop_sequence,omitempty"`
 }
 
 type ChatCompletionsStreamResponseChoiceDelta struct {
-	Content          *string            `json:"content,omitempty"`
-	ReasoningContent *string            `json:"reasoning_content,omitempty"`
-	Reasoning        *string            `json:"reasoning,omitempty"`
-	Role             string             `json:"role,omitempty"`
-	ToolCalls        []ToolCallResponse `json:"tool_calls,omitempty"`
+	Content          *string                    `json:"content,omitempty"`
+	ReasoningContent *string                    `json:"reasoning_content,omitempty"`
+	Reasoning        *string                    `json:"reasoning,omitempty"`
+	Role             string                     `json:"role,omitempty"`
+	ToolCalls        []ToolCallResponse         `json:"tool_calls,omitempty"`
+	Annotations      []ChatCompletionAnnotation `json:"annotations,omitempty"`
+	// ReasoningContentSignature 是 Claude thinking 块的签名，回传 extended thinking 时需要
+	ReasoningContentSignature *string `json:"reasoning_content_signature,omitempty"`
+}
+
+// ChatCompletionAnnotation 是 chat completions 消息上的注解，目前只有 url_citation
+type ChatCompletionAnnotation struct {
+	Type        string                     `json:"type"`
+	UrlCitation *ChatCompletionUrlCitation `json:"url_citation,omitempty"`
+}
+
+// ChatCompletionUrlCitation 中的 StartIndex/EndIndex 是被引用文本在消息 content 中的字符区间
+type ChatCompletionUrlCitation struct {
+	EndIndex   int    `json:"end_index"`
+	StartIndex int    `json:"start_index"`
+	Title      string `json:"title"`
+	Url        string `json:"url"`
 }
 
 func (c *ChatCompletionsStreamResponseChoiceDelta) SetContentString(s string) {
@@ -238,9 +260,14 @@ type Usage struct {
 	// claude cache 1h
 	ClaudeCacheCreation5mTokens int `json:"claude_cache_creation_5_m_tokens"`
 	ClaudeCacheCreation1hTokens int `json:"claude_cache_creation_1_h_tokens"`
+	// CacheCreation 是 Claude 转换为 OpenAI 格式时按 Anthropic 原始结构给出的 5m/1h 缓存写入拆分
+	CacheCreation *ClaudeCacheCreationUsage `json:"cache_creation,omitempty"`
 
 	// OpenRouter Params
 	Cost any `json:"cost,omitempty"`
+
+	// WebSearchRequests 是 Claude server_tool_use.web_search_requests，只用于计费，不返回给客户端
+	WebSearchRequests int `json:"-"`
 }
 
 type OpenAIVideoResponse struct {
@@ -485,6 +485,12 @@ func doRequest(c *gin.Context, req *http.Request, info *common.RelayInfo) (*http
 	} else {
 		client = service.GetHttpClient()
 	}
+	if info.UpstreamTimeout > 0 && client.Timeout > 0 && info.UpstreamTimeout != client.Timeout {
+		// 复制一份客户端只修改超时，底层连接池仍然共享
+		timeoutClient := *client
+		timeoutClient.Timeout = info.UpstreamTimeout
+		client = &timeoutClient
+	}
 
 	var stopPinger context.CancelFunc
 	var pingerDone <-chan struct{}
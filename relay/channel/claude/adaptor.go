@@ -1,31 +1,116 @@
 package claude
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/dto"
 	"github.com/QuantumNous/new-api/relay/channel"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
 	"github.com/QuantumNous/new-api/service/relayconvert"
 	"github.com/QuantumNous/new-api/setting/model_setting"
 	"github.com/QuantumNous/new-api/types"
 
 	"github.com/gin-gonic/gin"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	RequestModeMessage     = 1
+	RequestModeBatch       = 2
+	RequestModeCountTokens = 3
+)
+
+// claudeBatchHeader 为 true 时，请求以 Message Batches API 提交到上游，需要管理员开启 claude.message_batch_enabled
+const claudeBatchHeader = "X-Claude-Batch"
+
+// claudeCountTokensHeader 为 true 时，请求提交到 count_tokens 接口，只返回输入 token 数
+const claudeCountTokensHeader = "X-Claude-Count-Tokens"
+
+// 开启 DEBUG 时在响应头中回显的转换结果，便于直接用 curl 确认 thinking 与缓存断点是否生效
+const (
+	claudeDebugModeHeader             = "X-Claude-Mode"
+	claudeDebugThinkingBudgetHeader   = "X-Claude-Thinking-Budget"
+	claudeDebugCacheBreakpointsHeader = "X-Claude-Cache-Breakpoints"
 )
 
 type Adaptor struct {
+	RequestMode int
+	// 转换请求时记录的调试信息，仅在 common.DebugEnabled 时填充，DoResponse 时写入响应头
+	debugHeaders map[string]string
+	// metadata 是否由本站生成，429 重试时据此重新生成
+	generatedMetadata bool
+	// batch 模式下请求的 max_tokens，提交时拿不到实际用量，按此预估输出 token 计费
+	batchMaxTokens int
 }
 
-func (a *Adaptor) ConvertGeminiRequest(*gin.Context, *relaycommon.RelayInfo, *dto.GeminiChatRequest) (any, error) {
-	//TODO implement me
-	return nil, errors.New("not implemented")
+func (a *Adaptor) ConvertGeminiRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.GeminiChatRequest) (any, error) {
+	if request == nil {
+		return nil, errors.New("request is nil")
+	}
+	// Gemini 请求体不含模型名，模型别名已在 Init 中按 info.UpstreamModelName 解析
+	if err := validateUpstreamModel(info); err != nil {
+		return nil, err
+	}
+	result, err := relayconvert.ConvertRequest(c, info, types.RelayFormatClaude, request)
+	if err != nil {
+		return nil, err
+	}
+	claudeRequest, ok := result.Value.(*dto.ClaudeRequest)
+	if !ok {
+		return nil, fmt.Errorf("expected Claude request, got %T", result.Value)
+	}
+	return a.finishClaudeRequest(c, info, claudeRequest)
 }
 
 func (a *Adaptor) ConvertClaudeRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.ClaudeRequest) (any, error) {
+	applyModelAlias(c, info, &request.Model)
+	if err := validateUpstreamModel(info); err != nil {
+		return nil, err
+	}
+	if err := validateClaudeRequestSize(request); err != nil {
+		return nil, err
+	}
+	if err := validateClaudeToolInputSchemas(request); err != nil {
+		return nil, err
+	}
+	if err := normalizeClaudeToolChoice(request); err != nil {
+		return nil, err
+	}
+	return a.finishClaudeRequest(c, info, request)
+}
+
+// finishClaudeRequest 是所有请求转换入口共用的后处理流程，按渠道设置调整请求并记录调试信息，
+// 最后按请求模式包装为 batch 或 count_tokens 请求
+func (a *Adaptor) finishClaudeRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.ClaudeRequest) (any, error) {
+	stripToolsForNoneToolChoice(request)
+	forceDisableParallelToolUse(request)
+	applyDefaultServiceTier(request)
+	a.generatedMetadata = addMetadataIfMissing(c, request)
+	setResolvedUpstreamModel(c, request)
+	a.recordDebugHeaders(request)
+	setThinkingUpstreamTimeout(info, request)
+	if a.RequestMode == RequestModeBatch {
+		if request.MaxTokens != nil {
+			a.batchMaxTokens = int(*request.MaxTokens)
+		}
+		return buildClaudeMessageBatchRequest(info, request)
+	}
+	if a.RequestMode == RequestModeCountTokens {
+		return buildClaudeCountTokensRequest(info, request)
+	}
 	return request, nil
 }
 
@@ -35,15 +120,41 @@ func (a *Adaptor) ConvertAudioRequest(c *gin.Context, info *relaycommon.RelayInf
 }
 
 func (a *Adaptor) ConvertImageRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.ImageRequest) (any, error) {
-	//TODO implement me
-	return nil, errors.New("not implemented")
+	// Claude 不能生成图片，返回可重试的错误以便切换到其他渠道
+	return nil, types.NewErrorWithStatusCode(errors.New("claude channel does not support image generation, supported formats: openai chat completions, claude messages, gemini generateContent"), types.ErrorCodeModelNotSupported, http.StatusNotImplemented)
 }
 
 func (a *Adaptor) Init(info *relaycommon.RelayInfo) {
+	if useMessageBatch(info) {
+		a.RequestMode = RequestModeBatch
+	} else if strings.EqualFold(info.RequestHeaders[claudeCountTokensHeader], "true") {
+		a.RequestMode = RequestModeCountTokens
+	} else {
+		a.RequestMode = RequestModeMessage
+	}
+	if info.ChannelMeta != nil {
+		if upstreamModel, ok := model_setting.GetClaudeSettings().ResolveModelAlias(info.UpstreamModelName); ok {
+			info.UpstreamModelName = upstreamModel
+		}
+	}
+}
+
+// useMessageBatch 判断是否以 Message Batches API 提交。batch 会占用渠道额度且结果异步产生，
+// 只有管理员开启 message_batch_enabled 的 Anthropic 渠道才允许客户端通过请求头选择该模式
+func useMessageBatch(info *relaycommon.RelayInfo) bool {
+	if !model_setting.GetClaudeSettings().MessageBatchEnabled || !strings.EqualFold(info.RequestHeaders[claudeBatchHeader], "true") {
+		return false
+	}
+	return info.ChannelMeta != nil && info.ChannelType == constant.ChannelTypeAnthropic
 }
 
 func (a *Adaptor) GetRequestURL(info *relaycommon.RelayInfo) (string, error) {
 	requestURL := fmt.Sprintf("%s/v1/messages", info.ChannelBaseUrl)
+	if a.RequestMode == RequestModeBatch {
+		requestURL = fmt.Sprintf("%s/v1/messages/batches", info.ChannelBaseUrl)
+	} else if a.RequestMode == RequestModeCountTokens {
+		requestURL = fmt.Sprintf("%s/v1/messages/count_tokens", info.ChannelBaseUrl)
+	}
 	if !shouldAppendClaudeBetaQuery(info) {
 		return requestURL, nil
 	}
@@ -73,21 +184,37 @@ func shouldAppendClaudeBetaQuery(info *relaycommon.RelayInfo) bool {
 
 func CommonClaudeHeadersOperation(c *gin.Context, req *http.Header, info *relaycommon.RelayInfo) {
 	// common headers operation
-	anthropicBeta := c.Request.Header.Get("anthropic-beta")
-	if anthropicBeta != "" {
+	// 客户端可能分多行发送 anthropic-beta，全部合并去重后再与模型配置中的默认值合并，不丢弃客户端开启的 beta
+	if anthropicBeta := mergeAnthropicBetaValues(c.Request.Header.Values("anthropic-beta")); anthropicBeta != "" {
 		req.Set("anthropic-beta", anthropicBeta)
 	}
 	model_setting.GetClaudeSettings().WriteHeaders(info.OriginModelName, req)
 }
 
+func mergeAnthropicBetaValues(values []string) string {
+	betas := make([]string, 0, len(values))
+	seen := make(map[string]struct{}, len(values))
+	for _, value := range values {
+		for _, beta := range strings.Split(value, ",") {
+			beta = strings.TrimSpace(beta)
+			if beta == "" {
+				continue
+			}
+			if _, ok := seen[beta]; ok {
+				continue
+			}
+			seen[beta] = struct{}{}
+			betas = append(betas, beta)
+		}
+	}
+	return strings.Join(betas, ",")
+}
+
 func (a *Adaptor) SetupRequestHeader(c *gin.Context, req *http.Header, info *relaycommon.RelayInfo) error {
 	channel.SetupApiRequestHeader(info, c, req)
 	req.Set("x-api-key", info.ApiKey)
-	anthropicVersion := c.Request.Header.Get("anthropic-version")
-	if anthropicVersion == "" {
-		anthropicVersion = "2023-06-01"
-	}
-	req.Set("anthropic-version", anthropicVersion)
+	// 优先级：客户端请求头 > 模型配置 > 默认版本
+	req.Set("anthropic-version", resolveAnthropicVersion(c, info))
 	CommonClaudeHeadersOperation(c, req, info)
 	return nil
 }
@@ -96,33 +223,529 @@ func (a *Adaptor) ConvertOpenAIRequest(c *gin.Context, info *relaycommon.RelayIn
 	if request == nil {
 		return nil, errors.New("request is nil")
 	}
+	applyModelAlias(c, info, &request.Model)
+	if err := validateUpstreamModel(info); err != nil {
+		return nil, err
+	}
 	result, err := relayconvert.ConvertRequest(c, info, types.RelayFormatClaude, request)
 	if err != nil {
 		return nil, err
 	}
-	return result.Value, nil
+	claudeRequest, ok := result.Value.(*dto.ClaudeRequest)
+	if !ok {
+		return nil, fmt.Errorf("expected Claude request, got %T", result.Value)
+	}
+	return a.finishClaudeRequest(c, info, claudeRequest)
+}
+
+// ConvertForDebug 按 ConvertOpenAIRequest 的完整流程转换请求并返回将发送给上游的 JSON，不会请求上游，
+// 用于排查转换后被 Anthropic 拒绝的请求
+func ConvertForDebug(c *gin.Context, info *relaycommon.RelayInfo, request *dto.GeneralOpenAIRequest) ([]byte, error) {
+	adaptor := &Adaptor{}
+	adaptor.Init(info)
+	converted, err := adaptor.ConvertOpenAIRequest(c, info, request)
+	if err != nil {
+		return nil, err
+	}
+	return common.Marshal(converted)
+}
+
+// normalizeClaudeToolChoice 校验原生 Claude 客户端传入的 tool_choice，并整理为 Anthropic 接受的结构：
+// 兼容旧版的字符串写法，非 tool 类型去掉 name，none 类型去掉 disable_parallel_tool_use
+func normalizeClaudeToolChoice(request *dto.ClaudeRequest) error {
+	if request == nil || request.ToolChoice == nil {
+		return nil
+	}
+	var toolChoice dto.ClaudeToolChoice
+	if choiceType, ok := request.ToolChoice.(string); ok {
+		toolChoice.Type = choiceType
+	} else {
+		parsed, err := common.Any2Type[dto.ClaudeToolChoice](request.ToolChoice)
+		if err != nil {
+			return types.NewErrorWithStatusCode(fmt.Errorf("invalid tool_choice: %w", err), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		}
+		toolChoice = parsed
+	}
+	switch toolChoice.Type {
+	case "auto", "any":
+		toolChoice.Name = ""
+	case "tool":
+		if toolChoice.Name == "" {
+			return types.NewErrorWithStatusCode(errors.New("invalid tool_choice: name is required when type is \"tool\""), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		}
+	case "none":
+		toolChoice.Name = ""
+		toolChoice.DisableParallelToolUse = false
+	default:
+		return types.NewErrorWithStatusCode(fmt.Errorf("invalid tool_choice type %q, supported types: auto, any, tool, none", toolChoice.Type), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	request.ToolChoice = &toolChoice
+	return nil
+}
+
+// stripToolsForNoneToolChoice 在开启兼容开关时，把 tool_choice=none 改写为不携带 tools，
+// 兼容不支持 none 类型的旧版 Claude API
+func stripToolsForNoneToolChoice(request *dto.ClaudeRequest) {
+	if request == nil || request.ToolChoice == nil || !model_setting.GetClaudeSettings().ToolChoiceNoneStripTools {
+		return
+	}
+	toolChoice, err := common.Any2Type[dto.ClaudeToolChoice](request.ToolChoice)
+	if err != nil || toolChoice.Type != "none" {
+		return
+	}
+	request.Tools = nil
+	request.ToolChoice = nil
+}
+
+// forceDisableParallelToolUse 在开启全局开关时，为携带工具的请求强制设置 disable_parallel_tool_use；
+// none 类型不接受该字段，保持原样
+func forceDisableParallelToolUse(request *dto.ClaudeRequest) {
+	if request == nil || len(request.GetTools()) == 0 || !model_setting.GetClaudeSettings().ForceDisableParallelToolUse {
+		return
+	}
+	toolChoice := dto.ClaudeToolChoice{Type: "auto"}
+	if request.ToolChoice != nil {
+		var err error
+		toolChoice, err = common.Any2Type[dto.ClaudeToolChoice](request.ToolChoice)
+		if err != nil || toolChoice.Type == "none" {
+			return
+		}
+	}
+	toolChoice.DisableParallelToolUse = true
+	request.ToolChoice = &toolChoice
+}
+
+// applyDefaultServiceTier 客户端未指定 service_tier 时使用配置的默认值
+func applyDefaultServiceTier(request *dto.ClaudeRequest) {
+	if request == nil || request.ServiceTier != "" {
+		return
+	}
+	request.ServiceTier = model_setting.GetClaudeSettings().DefaultServiceTier
+}
+
+// addMetadataIfMissing 在客户端未携带 metadata 时，用当前用户 id 的 HMAC 作为 metadata.user_id，
+// 使 Anthropic 的滥用信号能对应到本站用户，同时不暴露真实 id；返回是否由本站生成了 metadata
+func addMetadataIfMissing(c *gin.Context, request *dto.ClaudeRequest) bool {
+	if c == nil || request == nil || (len(request.Metadata) > 0 && string(request.Metadata) != "null") {
+		return false
+	}
+	metadata, ok := generateMetadata(c)
+	if !ok {
+		return false
+	}
+	request.Metadata = metadata
+	return true
+}
+
+// generateMetadata 按当前用户生成 metadata，未登录的请求不生成
+func generateMetadata(c *gin.Context) ([]byte, bool) {
+	userId := c.GetInt("id")
+	if userId == 0 {
+		return nil, false
+	}
+	metadata, err := common.Marshal(dto.ClaudeMetadata{
+		UserId: common.GenerateHMAC(fmt.Sprintf("user:%d", userId)),
+	})
+	if err != nil {
+		return nil, false
+	}
+	return metadata, true
+}
+
+// validateUpstreamModel 拒绝空的上游模型名；开启严格校验时，不在 ModelList 中的模型也直接返回错误并给出相近的模型名
+func validateUpstreamModel(info *relaycommon.RelayInfo) error {
+	if info == nil || info.ChannelMeta == nil {
+		return nil
+	}
+	model := strings.TrimSpace(info.UpstreamModelName)
+	if model == "" {
+		return types.NewErrorWithStatusCode(errors.New("model is required"), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	if !model_setting.GetClaudeSettings().StrictModelValidation || slices.Contains(ModelList, model) {
+		return nil
+	}
+	message := fmt.Sprintf("model %q is not supported by claude channel", model)
+	if suggestions := similarClaudeModels(model, 3); len(suggestions) > 0 {
+		message += ", did you mean: " + strings.Join(suggestions, ", ")
+	}
+	return types.NewErrorWithStatusCode(errors.New(message), types.ErrorCodeModelNotSupported, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+}
+
+// validateClaudeRequestSize 限制 system block 与 messages 的数量，在后续逐块处理前拒绝异常庞大的请求
+func validateClaudeRequestSize(request *dto.ClaudeRequest) error {
+	settings := model_setting.GetClaudeSettings()
+	if settings.MaxMessages > 0 && len(request.Messages) > settings.MaxMessages {
+		return types.NewErrorWithStatusCode(fmt.Errorf("too many messages: got %d, at most %d allowed", len(request.Messages), settings.MaxMessages), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	if settings.MaxSystemBlocks > 0 {
+		if blocks := claudeSystemBlockCount(request.System); blocks > settings.MaxSystemBlocks {
+			return types.NewErrorWithStatusCode(fmt.Errorf("too many system blocks: got %d, at most %d allowed", blocks, settings.MaxSystemBlocks), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		}
+	}
+	return nil
+}
+
+// validateClaudeToolInputSchemas 校验原生 Claude 请求中自定义工具的 input_schema，规则与 OpenAI function.parameters 转换时一致。
+// 服务端工具（web_search 等）不带 input_schema，直接跳过
+func validateClaudeToolInputSchemas(request *dto.ClaudeRequest) error {
+	for _, tool := range request.GetTools() {
+		toolMap, ok := tool.(map[string]any)
+		if !ok {
+			continue
+		}
+		rawSchema, exists := toolMap["input_schema"]
+		if !exists {
+			continue
+		}
+		name, _ := toolMap["name"].(string)
+		schema, ok := rawSchema.(map[string]any)
+		if !ok {
+			return types.NewErrorWithStatusCode(fmt.Errorf("invalid input_schema for tool %q: input_schema must be an object", name), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		}
+		if err := relayconvert.ValidateClaudeToolInputSchema(name, schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claudeSystemBlockCount 直接按切片长度计数，不经过 ParseSystem 的序列化往返
+func claudeSystemBlockCount(system any) int {
+	switch blocks := system.(type) {
+	case []any:
+		return len(blocks)
+	case []dto.ClaudeMediaMessage:
+		return len(blocks)
+	default:
+		return 0
+	}
+}
+
+// similarClaudeModels 按编辑距离返回 ModelList 中与 model 最接近的若干模型，差异过大的不返回
+func similarClaudeModels(model string, limit int) []string {
+	type candidate struct {
+		name     string
+		distance int
+	}
+	maxDistance := max(len(model)/3, 2)
+	candidates := make([]candidate, 0, len(ModelList))
+	for _, name := range ModelList {
+		if distance := levenshteinDistance(model, name); distance <= maxDistance {
+			candidates = append(candidates, candidate{name: name, distance: distance})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].distance < candidates[j].distance
+	})
+	suggestions := make([]string, 0, limit)
+	for i := 0; i < len(candidates) && i < limit; i++ {
+		suggestions = append(suggestions, candidates[i].name)
+	}
+	return suggestions
+}
+
+func levenshteinDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// applyModelAlias 将请求中的模型别名替换为实际模型名并同步 info.UpstreamModelName，
+// 别名记录到上下文中，转换为 OpenAI 格式的响应时 model 仍返回别名
+func applyModelAlias(c *gin.Context, info *relaycommon.RelayInfo, model *string) {
+	upstreamModel, ok := model_setting.GetClaudeSettings().ResolveModelAlias(*model)
+	if !ok {
+		return
+	}
+	if c != nil {
+		common.SetContextKey(c, constant.ContextKeyResponseModelAlias, *model)
+	}
+	*model = upstreamModel
+	if info.ChannelMeta != nil {
+		info.UpstreamModelName = upstreamModel
+	}
+}
+
+// setResolvedUpstreamModel 记录最终发往上游的模型名（如去掉 -thinking 后缀后），写入消费日志便于核对计费
+func setResolvedUpstreamModel(c *gin.Context, request *dto.ClaudeRequest) {
+	if c == nil || request == nil || request.Model == "" {
+		return
+	}
+	common.SetContextKey(c, constant.ContextKeyResolvedUpstreamModel, request.Model)
+}
+
+// claudeMaxThinkingTimeout 是按 max_tokens 放宽后的上游超时上限
+const claudeMaxThinkingTimeout = 2 * time.Hour
+
+// setThinkingUpstreamTimeout 按 max_tokens 为 thinking 请求放宽上游超时，避免大预算的思考过程被固定的 RELAY_TIMEOUT 截断；
+// RelayInfo 在重试间复用，每次转换都先清除上一次设置的超时
+func setThinkingUpstreamTimeout(info *relaycommon.RelayInfo, request *dto.ClaudeRequest) {
+	if info == nil {
+		return
+	}
+	info.UpstreamTimeout = 0
+	settings := model_setting.GetClaudeSettings()
+	if request == nil || settings.ThinkingTimeoutBaseSeconds <= 0 || common.RelayTimeout <= 0 {
+		return
+	}
+	if request.Thinking == nil || request.Thinking.Type == "disabled" || request.MaxTokens == nil {
+		return
+	}
+	seconds := float64(settings.ThinkingTimeoutBaseSeconds) + float64(*request.MaxTokens)/1000*settings.ThinkingTimeoutSecondsPer1KTokens
+	seconds = min(seconds, claudeMaxThinkingTimeout.Seconds())
+	if timeout := time.Duration(seconds * float64(time.Second)); timeout > time.Duration(common.RelayTimeout)*time.Second {
+		info.UpstreamTimeout = timeout
+	}
+}
+
+// recordDebugHeaders 记录请求模式、thinking 预算与 cache_control 断点数量
+func (a *Adaptor) recordDebugHeaders(request *dto.ClaudeRequest) {
+	if !common.DebugEnabled || request == nil {
+		return
+	}
+	mode := "message"
+	if a.RequestMode == RequestModeBatch {
+		mode = "batch"
+	} else if a.RequestMode == RequestModeCountTokens {
+		mode = "count_tokens"
+	}
+	thinkingBudget := "disabled"
+	if request.Thinking != nil {
+		if request.Thinking.BudgetTokens != nil {
+			thinkingBudget = strconv.Itoa(*request.Thinking.BudgetTokens)
+		} else if request.Thinking.Type != "" {
+			thinkingBudget = request.Thinking.Type
+		}
+	}
+	cacheBreakpoints := 0
+	if data, err := common.Marshal(request); err == nil {
+		// 字符串值中的引号会被转义，这里只会匹配到 cache_control 字段名
+		cacheBreakpoints = strings.Count(string(data), `"cache_control":`)
+	}
+	a.debugHeaders = map[string]string{
+		claudeDebugModeHeader:             mode,
+		claudeDebugThinkingBudgetHeader:   thinkingBudget,
+		claudeDebugCacheBreakpointsHeader: strconv.Itoa(cacheBreakpoints),
+	}
+}
+
+// buildClaudeMessageBatchRequest 把单个 Claude 请求包装为只含一条记录的 batch 请求
+func buildClaudeMessageBatchRequest(info *relaycommon.RelayInfo, request *dto.ClaudeRequest) (*dto.ClaudeMessageBatchRequest, error) {
+	if info.IsStream {
+		return nil, errors.New("claude message batches do not support stream")
+	}
+	customId := info.RequestId
+	if customId == "" {
+		customId = common.GetUUID()
+	}
+	request.Stream = nil
+	return &dto.ClaudeMessageBatchRequest{
+		Requests: []dto.ClaudeMessageBatchRequestItem{
+			{
+				CustomId: customId,
+				Params:   request,
+			},
+		},
+	}, nil
+}
+
+// buildClaudeCountTokensRequest 只保留 count_tokens 接口参与计数的字段
+func buildClaudeCountTokensRequest(info *relaycommon.RelayInfo, request *dto.ClaudeRequest) (*dto.ClaudeCountTokensRequest, error) {
+	if info.IsStream {
+		return nil, errors.New("claude count_tokens does not support stream")
+	}
+	return &dto.ClaudeCountTokensRequest{
+		Model:      request.Model,
+		System:     request.System,
+		Messages:   request.Messages,
+		Tools:      request.Tools,
+		ToolChoice: request.ToolChoice,
+		Thinking:   request.Thinking,
+	}, nil
+}
+
+// CountTokens 按 ConvertOpenAIRequest 的流程转换请求并调用上游 count_tokens 接口，返回输入 token 数，
+// 不会生成内容也不会向客户端写响应，便于在正式请求前预先检查额度
+func CountTokens(c *gin.Context, info *relaycommon.RelayInfo, request *dto.GeneralOpenAIRequest) (int, *types.NewAPIError) {
+	countInfo := *info
+	countInfo.IsStream = false
+	adaptor := &Adaptor{}
+	adaptor.Init(&countInfo)
+	adaptor.RequestMode = RequestModeCountTokens
+	converted, err := adaptor.ConvertOpenAIRequest(c, &countInfo, request)
+	if err != nil {
+		return 0, types.NewError(err, types.ErrorCodeConvertRequestFailed, types.ErrOptionWithSkipRetry())
+	}
+	body, err := common.Marshal(converted)
+	if err != nil {
+		return 0, types.NewError(err, types.ErrorCodeConvertRequestFailed, types.ErrOptionWithSkipRetry())
+	}
+	resp, err := adaptor.DoRequest(c, &countInfo, bytes.NewReader(body))
+	if err != nil {
+		return 0, types.NewOpenAIError(err, types.ErrorCodeDoRequestFailed, http.StatusInternalServerError)
+	}
+	httpResp, ok := resp.(*http.Response)
+	if !ok || httpResp == nil {
+		return 0, types.NewOpenAIError(fmt.Errorf("unexpected count_tokens response type %T", resp), types.ErrorCodeBadResponse, http.StatusInternalServerError)
+	}
+	defer service.CloseResponseBodyGracefully(httpResp)
+	if httpResp.StatusCode != http.StatusOK {
+		return 0, service.RelayErrorHandler(c.Request.Context(), httpResp, false)
+	}
+	countResponse, _, apiErr := readClaudeCountTokensResponse(httpResp)
+	if apiErr != nil {
+		return 0, apiErr
+	}
+	return countResponse.InputTokens, nil
 }
 
 func (a *Adaptor) ConvertRerankRequest(c *gin.Context, relayMode int, request dto.RerankRequest) (any, error) {
-	return nil, nil
+	// Anthropic 没有 rerank 接口，返回可重试的错误以便切换到其他渠道
+	return nil, types.NewErrorWithStatusCode(errors.New("claude channel does not support rerank"), types.ErrorCodeModelNotSupported, http.StatusNotImplemented)
 }
 
 func (a *Adaptor) ConvertEmbeddingRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.EmbeddingRequest) (any, error) {
-	//TODO implement me
-	return nil, errors.New("not implemented")
+	// Anthropic 没有 embeddings 接口，返回可重试的错误以便切换到其他渠道
+	return nil, types.NewErrorWithStatusCode(errors.New("claude channel does not support embeddings"), types.ErrorCodeModelNotSupported, http.StatusNotImplemented)
 }
 
+// ConvertOpenAIResponsesRequest 把 Responses 请求转换为 Claude 请求。Claude 无状态，previous_response_id 由 ResponseStore
+// 中保存的上一轮消息还原；默认存储只在当前进程内并按 LRU 淘汰，重启、淘汰或请求落到其他实例时找不到对应对话，
+// 此时返回 previous_response_not_found，客户端应改为在 input 中携带完整历史重发
 func (a *Adaptor) ConvertOpenAIResponsesRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.OpenAIResponsesRequest) (any, error) {
-	// TODO implement me
-	return nil, errors.New("not implemented")
+	previousResponseId := strings.TrimSpace(request.PreviousResponseID)
+	request.PreviousResponseID = ""
+	applyModelAlias(c, info, &request.Model)
+	if err := validateUpstreamModel(info); err != nil {
+		return nil, err
+	}
+	result, err := relayconvert.ConvertRequest(c, info, types.RelayFormatClaude, &request)
+	if err != nil {
+		return nil, err
+	}
+	claudeRequest, ok := result.Value.(*dto.ClaudeRequest)
+	if !ok {
+		return nil, fmt.Errorf("expected Claude messages request, got %T", result.Value)
+	}
+	if previousResponseId != "" {
+		if c == nil {
+			return nil, errors.New("previous_response_id requires request context")
+		}
+		history, ok := getResponseStore().Load(responseStoreKey(c, previousResponseId))
+		if !ok {
+			return nil, types.NewErrorWithStatusCode(fmt.Errorf("previous response %q not found, it may have expired; resend the full conversation in input", previousResponseId), types.ErrorCodePreviousResponseNotFound, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		}
+		claudeRequest.Messages = append(history, claudeRequest.Messages...)
+	}
+	if c != nil && string(request.Store) != "false" {
+		c.Set(claudeResponsesHistoryKey, claudeRequest.Messages)
+	}
+	return a.finishClaudeRequest(c, info, claudeRequest)
 }
 
 func (a *Adaptor) DoRequest(c *gin.Context, info *relaycommon.RelayInfo, requestBody io.Reader) (any, error) {
-	return channel.DoApiRequest(a, c, info, requestBody)
+	maxWaitSeconds := model_setting.GetClaudeSettings().RateLimitRetryMaxWaitSeconds
+	if maxWaitSeconds <= 0 {
+		return channel.DoApiRequest(a, c, info, requestBody)
+	}
+	// 重试时需要重放并改写请求体，只有开启重试时才读入内存
+	body, err := io.ReadAll(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("read request body failed: %w", err)
+	}
+	resp, err := channel.DoApiRequest(a, c, info, bytes.NewReader(body))
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+	maxWait := time.Duration(maxWaitSeconds) * time.Second
+	wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"))
+	if !ok {
+		wait = min(claudeRateLimitDefaultBackoff, maxWait)
+	}
+	if wait > maxWait {
+		return resp, nil
+	}
+	service.CloseResponseBodyGracefully(resp)
+	// batch 与 count_tokens 请求体中的 metadata 不在顶层，不做改写
+	if a.generatedMetadata && a.RequestMode == RequestModeMessage {
+		body = a.regenerateMetadata(c, body)
+	}
+	common.SysLog(fmt.Sprintf("claude channel #%d rate limited, retry 1/1 after %s", info.ChannelId, wait))
+	select {
+	case <-c.Request.Context().Done():
+		return nil, c.Request.Context().Err()
+	case <-time.After(wait):
+	}
+	return channel.DoApiRequest(a, c, info, bytes.NewReader(body))
+}
+
+// claudeRateLimitDefaultBackoff 是 429 响应未携带 retry-after 时的等待时间，不超过 RateLimitRetryMaxWaitSeconds
+const claudeRateLimitDefaultBackoff = time.Second
+
+// regenerateMetadata 为重试请求重新生成本站添加的 metadata，客户端自带的 metadata 不会走到这里
+func (a *Adaptor) regenerateMetadata(c *gin.Context, body []byte) []byte {
+	metadata, ok := generateMetadata(c)
+	if !ok {
+		return body
+	}
+	regenerated, err := sjson.SetRawBytes(body, "metadata", metadata)
+	if err != nil {
+		common.SysError(fmt.Sprintf("failed to regenerate claude metadata: %v", err))
+		return body
+	}
+	return regenerated
+}
+
+// parseRetryAfter 解析 retry-after 头，支持秒数和 HTTP 日期两种格式
+func parseRetryAfter(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	retryAt, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return max(time.Until(retryAt), 0), true
 }
 
 func (a *Adaptor) DoResponse(c *gin.Context, resp *http.Response, info *relaycommon.RelayInfo) (usage any, err *types.NewAPIError) {
 	info.FinalRequestRelayFormat = types.RelayFormatClaude
+	for key, value := range a.debugHeaders {
+		c.Header(key, value)
+	}
+	if a.RequestMode == RequestModeBatch {
+		return ClaudeMessageBatchHandler(c, resp, info, a.batchMaxTokens)
+	}
+	if a.RequestMode == RequestModeCountTokens {
+		return ClaudeCountTokensHandler(c, resp, info)
+	}
+	if info.RelayFormat == types.RelayFormatOpenAIResponses {
+		if info.IsStream {
+			return ClaudeResponsesStreamHandler(c, resp, info)
+		}
+		return ClaudeHandler(c, resp, info)
+	}
 	if info.IsStream {
 		return ClaudeStreamHandler(c, resp, info)
 	} else {
@@ -0,0 +1,1351 @@
+package claude
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/types"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+func TestConvertGeminiRequestBuildsClaudeMessages(t *testing.T) {
+	var geminiRequest dto.GeminiChatRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"systemInstruction": {"parts": [{"text": "be brief"}]},
+		"contents": [
+			{"role": "user", "parts": [{"text": "hello"}]},
+			{"role": "model", "parts": [{"text": "hi"}]},
+			{"role": "user", "parts": [{"text": "weather?"}]}
+		],
+		"generationConfig": {"temperature": 0.3, "topP": 0.9, "topK": 20, "maxOutputTokens": 256},
+		"tools": [{"functionDeclarations": [{
+			"name": "get_weather",
+			"description": "Get weather",
+			"parameters": {"type": "object", "properties": {"city": {"type": "string"}}, "required": ["city"]}
+		}]}]
+	}`, &geminiRequest))
+
+	info := &relaycommon.RelayInfo{
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+	adaptor := &Adaptor{}
+	converted, err := adaptor.ConvertGeminiRequest(nil, info, &geminiRequest)
+	require.NoError(t, err)
+
+	claudeRequest, ok := converted.(*dto.ClaudeRequest)
+	require.True(t, ok)
+	assert.Equal(t, "claude-sonnet-4-5-20250929", claudeRequest.Model)
+	require.NotNil(t, claudeRequest.Temperature)
+	assert.Equal(t, 0.3, *claudeRequest.Temperature)
+	require.NotNil(t, claudeRequest.TopP)
+	assert.Equal(t, 0.9, *claudeRequest.TopP)
+	require.NotNil(t, claudeRequest.TopK)
+	assert.Equal(t, 20, *claudeRequest.TopK)
+	require.NotNil(t, claudeRequest.MaxTokens)
+	assert.Equal(t, uint(256), *claudeRequest.MaxTokens)
+
+	systemBlocks, ok := claudeRequest.System.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.Len(t, systemBlocks, 1)
+	assert.Equal(t, "be brief", systemBlocks[0].GetText())
+
+	require.Len(t, claudeRequest.Messages, 3)
+	assert.Equal(t, "user", claudeRequest.Messages[0].Role)
+	assert.Equal(t, "assistant", claudeRequest.Messages[1].Role)
+	assert.Equal(t, "user", claudeRequest.Messages[2].Role)
+
+	tools, ok := claudeRequest.Tools.([]any)
+	require.True(t, ok)
+	require.Len(t, tools, 1)
+	tool, ok := tools[0].(*dto.Tool)
+	require.True(t, ok)
+	assert.Equal(t, "get_weather", tool.Name)
+	assert.Equal(t, "object", tool.InputSchema["type"])
+	assert.Equal(t, []any{"city"}, tool.InputSchema["required"])
+}
+
+func TestConvertEmbeddingRequestReturnsRetryableUnsupportedError(t *testing.T) {
+	adaptor := &Adaptor{}
+	converted, err := adaptor.ConvertEmbeddingRequest(nil, &relaycommon.RelayInfo{}, dto.EmbeddingRequest{
+		Model: "claude-sonnet-4-5-20250929",
+		Input: "hello",
+	})
+
+	require.Error(t, err)
+	assert.Nil(t, converted, "no upstream request body should be produced")
+
+	var apiErr *types.NewAPIError
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, types.ErrorCodeModelNotSupported, apiErr.GetErrorCode())
+	assert.Equal(t, http.StatusNotImplemented, apiErr.StatusCode)
+	assert.False(t, types.IsSkipRetryError(apiErr))
+	assert.Equal(t, "claude channel does not support embeddings", apiErr.ToOpenAIError().Message)
+}
+
+func TestConvertOpenAIRequestWrapsBatchEnvelopeInBatchMode(t *testing.T) {
+	enableMessageBatch(t)
+	var openAIRequest dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"max_tokens": 128,
+		"messages": [{"role": "user", "content": "hello"}]
+	}`, &openAIRequest))
+
+	info := &relaycommon.RelayInfo{
+		RequestId:      "20261015000000000000000abcd1234",
+		RequestHeaders: map[string]string{"X-Claude-Batch": "true"},
+		ChannelMeta: &relaycommon.ChannelMeta{
+			ChannelType:       constant.ChannelTypeAnthropic,
+			ChannelBaseUrl:    "https://api.anthropic.com",
+			UpstreamModelName: "claude-sonnet-4-5-20250929",
+		},
+	}
+	adaptor := &Adaptor{}
+	adaptor.Init(info)
+	require.Equal(t, RequestModeBatch, adaptor.RequestMode)
+
+	requestURL, err := adaptor.GetRequestURL(info)
+	require.NoError(t, err)
+	assert.Equal(t, "https://api.anthropic.com/v1/messages/batches", requestURL)
+
+	converted, err := adaptor.ConvertOpenAIRequest(nil, info, &openAIRequest)
+	require.NoError(t, err)
+	assert.Equal(t, 128, adaptor.batchMaxTokens)
+	data, err := common.Marshal(converted)
+	require.NoError(t, err)
+
+	var envelope map[string]any
+	require.NoError(t, common.Unmarshal(data, &envelope))
+	require.Len(t, envelope, 1)
+	requests, ok := envelope["requests"].([]any)
+	require.True(t, ok)
+	require.Len(t, requests, 1)
+	item, ok := requests[0].(map[string]any)
+	require.True(t, ok)
+	assert.Equal(t, "20261015000000000000000abcd1234", item["custom_id"])
+	params, ok := item["params"].(map[string]any)
+	require.True(t, ok)
+	assert.Equal(t, "claude-sonnet-4-5-20250929", params["model"])
+	assert.EqualValues(t, 128, params["max_tokens"])
+	assert.NotContains(t, params, "stream")
+	messages, ok := params["messages"].([]any)
+	require.True(t, ok)
+	require.Len(t, messages, 1)
+}
+
+func TestConvertOpenAIRequestRejectsStreamInBatchMode(t *testing.T) {
+	enableMessageBatch(t)
+	var openAIRequest dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"stream": true,
+		"messages": [{"role": "user", "content": "hello"}]
+	}`, &openAIRequest))
+
+	info := &relaycommon.RelayInfo{
+		IsStream:       true,
+		RequestHeaders: map[string]string{"X-Claude-Batch": "true"},
+		ChannelMeta:    &relaycommon.ChannelMeta{ChannelType: constant.ChannelTypeAnthropic, UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+	adaptor := &Adaptor{}
+	adaptor.Init(info)
+	require.Equal(t, RequestModeBatch, adaptor.RequestMode)
+
+	_, err := adaptor.ConvertOpenAIRequest(nil, info, &openAIRequest)
+	require.Error(t, err)
+}
+
+// enableMessageBatch 在测试期间开启 claude.message_batch_enabled
+func enableMessageBatch(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	original := settings.MessageBatchEnabled
+	settings.MessageBatchEnabled = true
+	t.Cleanup(func() { settings.MessageBatchEnabled = original })
+}
+
+func TestInitIgnoresBatchHeaderUnlessEnabledForAnthropicChannel(t *testing.T) {
+	newInfo := func(channelType int) *relaycommon.RelayInfo {
+		return &relaycommon.RelayInfo{
+			RequestHeaders: map[string]string{"X-Claude-Batch": "true"},
+			ChannelMeta:    &relaycommon.ChannelMeta{ChannelType: channelType},
+		}
+	}
+
+	// 默认关闭，客户端请求头不能自行开启 batch
+	adaptor := &Adaptor{}
+	adaptor.Init(newInfo(constant.ChannelTypeAnthropic))
+	assert.Equal(t, RequestModeMessage, adaptor.RequestMode)
+
+	enableMessageBatch(t)
+	adaptor.Init(newInfo(constant.ChannelTypeAws))
+	assert.Equal(t, RequestModeMessage, adaptor.RequestMode)
+	adaptor.Init(newInfo(constant.ChannelTypeAnthropic))
+	assert.Equal(t, RequestModeBatch, adaptor.RequestMode)
+}
+
+func TestInitDefaultsToMessageMode(t *testing.T) {
+	info := &relaycommon.RelayInfo{
+		ChannelMeta: &relaycommon.ChannelMeta{ChannelBaseUrl: "https://api.anthropic.com"},
+	}
+	adaptor := &Adaptor{}
+	adaptor.Init(info)
+	assert.Equal(t, RequestModeMessage, adaptor.RequestMode)
+
+	requestURL, err := adaptor.GetRequestURL(info)
+	require.NoError(t, err)
+	assert.Equal(t, "https://api.anthropic.com/v1/messages", requestURL)
+}
+
+func TestDoResponseReturnsBatchObjectInBatchMode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	batchJSON := `{"id":"msgbatch_01","type":"message_batch","processing_status":"in_progress","request_counts":{"processing":1,"succeeded":0,"errored":0,"canceled":0,"expired":0},"ended_at":null,"created_at":"2026-10-15T00:00:00Z","expires_at":"2026-10-16T00:00:00Z","cancel_initiated_at":null,"results_url":null}`
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(batchJSON)),
+	}
+	info := &relaycommon.RelayInfo{
+		RelayFormat: types.RelayFormatOpenAI,
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+	info.SetEstimatePromptTokens(20)
+
+	adaptor := &Adaptor{RequestMode: RequestModeBatch, batchMaxTokens: 128}
+	usage, apiErr := adaptor.DoResponse(ctx, resp, info)
+	require.Nil(t, apiErr)
+	require.NotNil(t, usage)
+	// 提交时按预估输入与 max_tokens 计费
+	assert.Equal(t, 20, usage.(*dto.Usage).PromptTokens)
+	assert.Equal(t, 128, usage.(*dto.Usage).CompletionTokens)
+	assert.Equal(t, 148, usage.(*dto.Usage).TotalTokens)
+	assert.JSONEq(t, batchJSON, recorder.Body.String())
+}
+
+func TestDoRequestRetriesOnceAfterRateLimit(t *testing.T) {
+	originMaxWait := model_setting.GetClaudeSettings().RateLimitRetryMaxWaitSeconds
+	model_setting.GetClaudeSettings().RateLimitRetryMaxWaitSeconds = 1
+	t.Cleanup(func() {
+		model_setting.GetClaudeSettings().RateLimitRetryMaxWaitSeconds = originMaxWait
+	})
+
+	service.InitHttpClient()
+	var requestBodies []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requestBodies = append(requestBodies, string(body))
+		if len(requestBodies) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"type":"error","error":{"type":"rate_limit_error","message":"rate limited"}}`))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"id":"msg_1","type":"message"}`))
+	}))
+	defer upstream.Close()
+
+	gin.SetMode(gin.TestMode)
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	ctx.Request.Header.Set("Content-Type", "application/json")
+	info := &relaycommon.RelayInfo{
+		ChannelMeta: &relaycommon.ChannelMeta{
+			ChannelBaseUrl: upstream.URL,
+			ApiKey:         "sk-test",
+		},
+	}
+	adaptor := &Adaptor{}
+	adaptor.Init(info)
+
+	requestBody := `{"model":"claude-sonnet-4-5-20250929","messages":[{"role":"user","content":"hi"}]}`
+	result, err := adaptor.DoRequest(ctx, info, strings.NewReader(requestBody))
+	require.NoError(t, err)
+	resp, ok := result.(*http.Response)
+	require.True(t, ok)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{requestBody, requestBody}, requestBodies, "the retry must replay the same body")
+}
+
+func TestDoRequestDoesNotRetryWhenRetryAfterExceedsMaxWait(t *testing.T) {
+	originMaxWait := model_setting.GetClaudeSettings().RateLimitRetryMaxWaitSeconds
+	model_setting.GetClaudeSettings().RateLimitRetryMaxWaitSeconds = 1
+	t.Cleanup(func() {
+		model_setting.GetClaudeSettings().RateLimitRetryMaxWaitSeconds = originMaxWait
+	})
+
+	service.InitHttpClient()
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer upstream.Close()
+
+	gin.SetMode(gin.TestMode)
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	info := &relaycommon.RelayInfo{
+		ChannelMeta: &relaycommon.ChannelMeta{ChannelBaseUrl: upstream.URL},
+	}
+	adaptor := &Adaptor{}
+	adaptor.Init(info)
+
+	result, err := adaptor.DoRequest(ctx, info, strings.NewReader(`{}`))
+	require.NoError(t, err)
+	resp := result.(*http.Response)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, 1, requests)
+}
+
+func TestDoRequestRetriesWithDefaultBackoffAndRegeneratesMetadata(t *testing.T) {
+	originMaxWait := model_setting.GetClaudeSettings().RateLimitRetryMaxWaitSeconds
+	model_setting.GetClaudeSettings().RateLimitRetryMaxWaitSeconds = 5
+	t.Cleanup(func() {
+		model_setting.GetClaudeSettings().RateLimitRetryMaxWaitSeconds = originMaxWait
+	})
+
+	service.InitHttpClient()
+	var requestBodies []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requestBodies = append(requestBodies, string(body))
+		if len(requestBodies) == 1 {
+			// 不携带 Retry-After
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"id":"msg_1","type":"message"}`))
+	}))
+	defer upstream.Close()
+
+	gin.SetMode(gin.TestMode)
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	ctx.Set("id", 42)
+	info := &relaycommon.RelayInfo{
+		ChannelMeta: &relaycommon.ChannelMeta{
+			ChannelBaseUrl:    upstream.URL,
+			UpstreamModelName: "claude-sonnet-4-5-20250929",
+		},
+	}
+	adaptor := &Adaptor{}
+	adaptor.Init(info)
+	_, err := adaptor.ConvertClaudeRequest(ctx, info, &dto.ClaudeRequest{
+		Model:    "claude-sonnet-4-5-20250929",
+		Messages: []dto.ClaudeMessage{{Role: "user", Content: "hi"}},
+	})
+	require.NoError(t, err)
+
+	start := time.Now()
+	result, err := adaptor.DoRequest(ctx, info, strings.NewReader(`{"model":"claude-sonnet-4-5-20250929","metadata":{"user_id":"stale"}}`))
+	require.NoError(t, err)
+	resp, ok := result.(*http.Response)
+	require.True(t, ok)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.GreaterOrEqual(t, time.Since(start), claudeRateLimitDefaultBackoff)
+	require.Len(t, requestBodies, 2)
+	var metadata dto.ClaudeMetadata
+	require.NoError(t, common.UnmarshalJsonStr(gjson.Get(requestBodies[1], "metadata").Raw, &metadata))
+	assert.Equal(t, common.GenerateHMAC("user:42"), metadata.UserId)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	wait, ok := parseRetryAfter("3")
+	require.True(t, ok)
+	assert.Equal(t, 3*time.Second, wait)
+
+	wait, ok = parseRetryAfter(time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+	require.True(t, ok)
+	assert.Zero(t, wait)
+
+	_, ok = parseRetryAfter("")
+	assert.False(t, ok)
+	_, ok = parseRetryAfter("soon")
+	assert.False(t, ok)
+}
+
+func TestConvertImageRequestReturnsRetryableUnsupportedError(t *testing.T) {
+	adaptor := &Adaptor{}
+	converted, err := adaptor.ConvertImageRequest(nil, &relaycommon.RelayInfo{}, dto.ImageRequest{
+		Model:  "claude-sonnet-4-5-20250929",
+		Prompt: "a cat",
+	})
+
+	require.Error(t, err)
+	assert.Nil(t, converted, "no upstream request body should be produced")
+
+	var apiErr *types.NewAPIError
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, types.ErrorCodeModelNotSupported, apiErr.GetErrorCode())
+	assert.Equal(t, http.StatusNotImplemented, apiErr.StatusCode)
+	assert.False(t, types.IsSkipRetryError(apiErr))
+	assert.Contains(t, apiErr.ToOpenAIError().Message, "claude messages")
+}
+
+func TestConvertOpenAIResponsesRequestAndResponseRoundTrip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/responses", nil)
+
+	var responsesRequest dto.OpenAIResponsesRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"instructions": "be brief",
+		"input": [{"role": "user", "content": [{"type": "input_text", "text": "hello"}]}],
+		"max_output_tokens": 8192,
+		"reasoning": {"effort": "medium"}
+	}`, &responsesRequest))
+
+	info := &relaycommon.RelayInfo{
+		RelayFormat: types.RelayFormatOpenAIResponses,
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+	adaptor := &Adaptor{}
+	converted, err := adaptor.ConvertOpenAIResponsesRequest(ctx, info, responsesRequest)
+	require.NoError(t, err)
+
+	claudeRequest, ok := converted.(*dto.ClaudeRequest)
+	require.True(t, ok)
+	system, err := common.Any2Type[[]dto.ClaudeMediaMessage](claudeRequest.System)
+	require.NoError(t, err)
+	require.Len(t, system, 1)
+	assert.Equal(t, "be brief", system[0].GetText())
+	require.Len(t, claudeRequest.Messages, 1)
+	assert.Equal(t, "user", claudeRequest.Messages[0].Role)
+	require.NotNil(t, claudeRequest.Thinking)
+	require.NotNil(t, claudeRequest.Thinking.BudgetTokens)
+	assert.Equal(t, 2048, *claudeRequest.Thinking.BudgetTokens)
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(`{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-5-20250929","content":[{"type":"text","text":"hi there"}],"stop_reason":"end_turn","usage":{"input_tokens":10,"output_tokens":4}}`)),
+	}
+	usage, apiErr := adaptor.DoResponse(ctx, resp, info)
+	require.Nil(t, apiErr)
+	claudeUsage, ok := usage.(*dto.Usage)
+	require.True(t, ok)
+	assert.Equal(t, 10, claudeUsage.PromptTokens)
+	assert.Equal(t, 4, claudeUsage.CompletionTokens)
+
+	var responsesResponse dto.OpenAIResponsesResponse
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &responsesResponse))
+	assert.Equal(t, "response", responsesResponse.Object)
+	require.Len(t, responsesResponse.Output, 1)
+	require.Len(t, responsesResponse.Output[0].Content, 1)
+	assert.Equal(t, "output_text", responsesResponse.Output[0].Content[0].Type)
+	assert.Equal(t, "hi there", responsesResponse.Output[0].Content[0].Text)
+	require.NotNil(t, responsesResponse.Usage)
+	assert.Equal(t, 10, responsesResponse.Usage.InputTokens)
+	assert.Equal(t, 4, responsesResponse.Usage.OutputTokens)
+}
+
+func TestConvertRequestStripsToolsForNoneToolChoiceWhenEnabled(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	original := settings.ToolChoiceNoneStripTools
+	t.Cleanup(func() { settings.ToolChoiceNoneStripTools = original })
+
+	info := &relaycommon.RelayInfo{
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+	newClaudeRequest := func() *dto.ClaudeRequest {
+		var request dto.ClaudeRequest
+		require.NoError(t, common.UnmarshalJsonStr(`{
+			"model": "claude-sonnet-4-5-20250929",
+			"messages": [{"role": "user", "content": "hello"}],
+			"tools": [{"name": "get_weather", "input_schema": {"type": "object"}}],
+			"tool_choice": {"type": "none"}
+		}`, &request))
+		return &request
+	}
+	newOpenAIRequest := func() *dto.GeneralOpenAIRequest {
+		var request dto.GeneralOpenAIRequest
+		require.NoError(t, common.UnmarshalJsonStr(`{
+			"model": "claude-sonnet-4-5-20250929",
+			"messages": [{"role": "user", "content": "hello"}],
+			"tools": [{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object"}}}],
+			"tool_choice": "none"
+		}`, &request))
+		return &request
+	}
+
+	settings.ToolChoiceNoneStripTools = false
+	converted, err := (&Adaptor{}).ConvertClaudeRequest(nil, info, newClaudeRequest())
+	require.NoError(t, err)
+	assert.NotNil(t, converted.(*dto.ClaudeRequest).Tools)
+	assert.NotNil(t, converted.(*dto.ClaudeRequest).ToolChoice)
+
+	settings.ToolChoiceNoneStripTools = true
+	converted, err = (&Adaptor{}).ConvertClaudeRequest(nil, info, newClaudeRequest())
+	require.NoError(t, err)
+	assert.Nil(t, converted.(*dto.ClaudeRequest).Tools)
+	assert.Nil(t, converted.(*dto.ClaudeRequest).ToolChoice)
+
+	converted, err = (&Adaptor{}).ConvertOpenAIRequest(nil, info, newOpenAIRequest())
+	require.NoError(t, err)
+	assert.Nil(t, converted.(*dto.ClaudeRequest).Tools)
+	assert.Nil(t, converted.(*dto.ClaudeRequest).ToolChoice)
+}
+
+func TestConvertClaudeRequestNormalizesToolChoice(t *testing.T) {
+	testCases := []struct {
+		name       string
+		toolChoice string
+		expected   *dto.ClaudeToolChoice
+		errMessage string
+	}{
+		{
+			name:       "auto drops stray name",
+			toolChoice: `{"type": "auto", "name": "get_weather", "disable_parallel_tool_use": true}`,
+			expected:   &dto.ClaudeToolChoice{Type: "auto", DisableParallelToolUse: true},
+		},
+		{
+			name:       "any",
+			toolChoice: `{"type": "any"}`,
+			expected:   &dto.ClaudeToolChoice{Type: "any"},
+		},
+		{
+			name:       "legacy string any",
+			toolChoice: `"any"`,
+			expected:   &dto.ClaudeToolChoice{Type: "any"},
+		},
+		{
+			name:       "tool",
+			toolChoice: `{"type": "tool", "name": "get_weather"}`,
+			expected:   &dto.ClaudeToolChoice{Type: "tool", Name: "get_weather"},
+		},
+		{
+			name:       "tool without name",
+			toolChoice: `{"type": "tool"}`,
+			errMessage: "name is required",
+		},
+		{
+			name:       "none strips disable_parallel_tool_use",
+			toolChoice: `{"type": "none", "disable_parallel_tool_use": true}`,
+			expected:   &dto.ClaudeToolChoice{Type: "none"},
+		},
+		{
+			name:       "unknown type",
+			toolChoice: `{"type": "required"}`,
+			errMessage: `invalid tool_choice type "required"`,
+		},
+	}
+	info := &relaycommon.RelayInfo{
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var request dto.ClaudeRequest
+			require.NoError(t, common.UnmarshalJsonStr(`{
+				"model": "claude-sonnet-4-5-20250929",
+				"messages": [{"role": "user", "content": "hello"}],
+				"tools": [{"name": "get_weather", "input_schema": {"type": "object"}}],
+				"tool_choice": `+tc.toolChoice+`
+			}`, &request))
+
+			converted, err := (&Adaptor{}).ConvertClaudeRequest(nil, info, &request)
+			if tc.errMessage != "" {
+				var apiErr *types.NewAPIError
+				require.ErrorAs(t, err, &apiErr)
+				assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+				assert.Contains(t, err.Error(), tc.errMessage)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, converted.(*dto.ClaudeRequest).ToolChoice)
+		})
+	}
+}
+
+func TestSetupRequestHeaderAnthropicVersionPrecedence(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	originVersions := settings.ModelAnthropicVersions
+	settings.ModelAnthropicVersions = map[string]string{"claude-opus-4-1": "2025-01-01"}
+	t.Cleanup(func() {
+		settings.ModelAnthropicVersions = originVersions
+	})
+
+	tests := []struct {
+		name          string
+		model         string
+		clientVersion string
+		want          string
+	}{
+		{name: "client header wins over model setting", model: "claude-opus-4-1", clientVersion: "2024-10-22", want: "2024-10-22"},
+		{name: "model setting wins over default", model: "claude-opus-4-1", want: "2025-01-01"},
+		{name: "thinking variant uses base model setting", model: "claude-opus-4-1-thinking", want: "2025-01-01"},
+		{name: "falls back to default", model: "claude-sonnet-4-5", want: model_setting.DefaultAnthropicVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+			if tt.clientVersion != "" {
+				c.Request.Header.Set("anthropic-version", tt.clientVersion)
+			}
+			info := &relaycommon.RelayInfo{
+				OriginModelName: tt.model,
+				ChannelMeta:     &relaycommon.ChannelMeta{ApiKey: "sk-test"},
+			}
+
+			headers := http.Header{}
+			require.NoError(t, (&Adaptor{}).SetupRequestHeader(c, &headers, info))
+			assert.Equal(t, tt.want, headers.Get("anthropic-version"))
+		})
+	}
+}
+
+func TestSetupRequestHeaderMergesClientAnthropicBeta(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	originHeaders := settings.HeadersSettings
+	settings.HeadersSettings = map[string]map[string][]string{
+		"claude-sonnet-4-5": {"anthropic-beta": {"token-efficient-tools-2025-02-19", "output-128k-2025-02-19"}},
+	}
+	t.Cleanup(func() {
+		settings.HeadersSettings = originHeaders
+	})
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	c.Request.Header.Add("anthropic-beta", "files-api-2025-04-14")
+	c.Request.Header.Add("anthropic-beta", "output-128k-2025-02-19, files-api-2025-04-14")
+	info := &relaycommon.RelayInfo{
+		OriginModelName: "claude-sonnet-4-5",
+		ChannelMeta:     &relaycommon.ChannelMeta{ApiKey: "sk-test"},
+	}
+
+	headers := http.Header{}
+	require.NoError(t, (&Adaptor{}).SetupRequestHeader(c, &headers, info))
+	assert.Equal(t, "files-api-2025-04-14,output-128k-2025-02-19,token-efficient-tools-2025-02-19", headers.Get("anthropic-beta"))
+}
+
+func TestConvertOpenAIRequestResponseFormatJsonSchemaRoundTrip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [{"role": "user", "content": "Extract: Alice is 30"}],
+		"response_format": {"type": "json_schema", "json_schema": {
+			"name": "person",
+			"schema": {"type": "object", "properties": {"name": {"type": "string"}, "age": {"type": "integer"}}, "required": ["name", "age"]}
+		}}
+	}`, &request))
+
+	info := &relaycommon.RelayInfo{
+		RelayFormat: types.RelayFormatOpenAI,
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+	adaptor := &Adaptor{}
+	converted, err := adaptor.ConvertOpenAIRequest(ctx, info, &request)
+	require.NoError(t, err)
+
+	claudeRequest, ok := converted.(*dto.ClaudeRequest)
+	require.True(t, ok)
+	require.Len(t, claudeRequest.Tools, 1)
+	tool, ok := claudeRequest.Tools.([]any)[0].(*dto.Tool)
+	require.True(t, ok)
+	assert.Equal(t, "object", tool.InputSchema["type"])
+	toolChoice, ok := claudeRequest.ToolChoice.(*dto.ClaudeToolChoice)
+	require.True(t, ok)
+	assert.Equal(t, "tool", toolChoice.Type)
+	assert.Equal(t, tool.Name, toolChoice.Name)
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body: io.NopCloser(strings.NewReader(`{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-5-20250929",` +
+			`"content":[{"type":"tool_use","id":"toolu_1","name":"` + tool.Name + `","input":{"name":"Alice","age":30}}],` +
+			`"stop_reason":"tool_use","usage":{"input_tokens":20,"output_tokens":10}}`)),
+	}
+	_, apiErr := adaptor.DoResponse(ctx, resp, info)
+	require.Nil(t, apiErr)
+
+	var openAIResponse dto.OpenAITextResponse
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &openAIResponse))
+	require.Len(t, openAIResponse.Choices, 1)
+	assert.JSONEq(t, `{"name":"Alice","age":30}`, openAIResponse.Choices[0].Message.StringContent())
+	assert.Empty(t, openAIResponse.Choices[0].Message.ToolCalls)
+	assert.Equal(t, "stop", openAIResponse.Choices[0].FinishReason)
+}
+
+func TestConvertRequestForcesDisableParallelToolUseWhenEnabled(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	original := settings.ForceDisableParallelToolUse
+	t.Cleanup(func() { settings.ForceDisableParallelToolUse = original })
+
+	info := &relaycommon.RelayInfo{
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+	newOpenAIRequest := func() *dto.GeneralOpenAIRequest {
+		var request dto.GeneralOpenAIRequest
+		require.NoError(t, common.UnmarshalJsonStr(`{
+			"model": "claude-sonnet-4-5-20250929",
+			"messages": [{"role": "user", "content": "hello"}],
+			"tools": [{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object"}}}]
+		}`, &request))
+		return &request
+	}
+
+	settings.ForceDisableParallelToolUse = false
+	converted, err := (&Adaptor{}).ConvertOpenAIRequest(nil, info, newOpenAIRequest())
+	require.NoError(t, err)
+	assert.Nil(t, converted.(*dto.ClaudeRequest).ToolChoice)
+
+	settings.ForceDisableParallelToolUse = true
+	converted, err = (&Adaptor{}).ConvertOpenAIRequest(nil, info, newOpenAIRequest())
+	require.NoError(t, err)
+	toolChoice, ok := converted.(*dto.ClaudeRequest).ToolChoice.(*dto.ClaudeToolChoice)
+	require.True(t, ok)
+	assert.Equal(t, "auto", toolChoice.Type)
+	assert.True(t, toolChoice.DisableParallelToolUse)
+
+	var claudeRequest dto.ClaudeRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [{"role": "user", "content": "hello"}],
+		"tools": [{"name": "get_weather", "input_schema": {"type": "object"}}],
+		"tool_choice": {"type": "tool", "name": "get_weather"}
+	}`, &claudeRequest))
+	converted, err = (&Adaptor{}).ConvertClaudeRequest(nil, info, &claudeRequest)
+	require.NoError(t, err)
+	toolChoice, ok = converted.(*dto.ClaudeRequest).ToolChoice.(*dto.ClaudeToolChoice)
+	require.True(t, ok)
+	assert.Equal(t, "tool", toolChoice.Type)
+	assert.Equal(t, "get_weather", toolChoice.Name)
+	assert.True(t, toolChoice.DisableParallelToolUse)
+}
+
+func TestConvertClaudeRequestDerivesMetadataUserIdFromAuthenticatedUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	info := &relaycommon.RelayInfo{
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+	newContext := func(userId int) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+		c.Set("id", userId)
+		return c
+	}
+	newRequest := func(metadata string) *dto.ClaudeRequest {
+		request := &dto.ClaudeRequest{
+			Model:    "claude-sonnet-4-5-20250929",
+			Messages: []dto.ClaudeMessage{{Role: "user", Content: "hello"}},
+		}
+		if metadata != "" {
+			request.Metadata = []byte(metadata)
+		}
+		return request
+	}
+	userIdOf := func(converted any) string {
+		var metadata dto.ClaudeMetadata
+		require.NoError(t, common.Unmarshal(converted.(*dto.ClaudeRequest).Metadata, &metadata))
+		return metadata.UserId
+	}
+
+	first, err := (&Adaptor{}).ConvertClaudeRequest(newContext(42), info, newRequest(""))
+	require.NoError(t, err)
+	again, err := (&Adaptor{}).ConvertClaudeRequest(newContext(42), info, newRequest(""))
+	require.NoError(t, err)
+	other, err := (&Adaptor{}).ConvertClaudeRequest(newContext(7), info, newRequest(""))
+	require.NoError(t, err)
+
+	assert.Equal(t, common.GenerateHMAC("user:42"), userIdOf(first))
+	assert.Equal(t, userIdOf(first), userIdOf(again))
+	assert.NotEqual(t, userIdOf(first), userIdOf(other))
+
+	// 客户端自带的 metadata 原样保留
+	kept, err := (&Adaptor{}).ConvertClaudeRequest(newContext(42), info, newRequest(`{"user_id":"client-user"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "client-user", userIdOf(kept))
+}
+
+func TestConvertRequestValidatesUpstreamModel(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	original := settings.StrictModelValidation
+	t.Cleanup(func() { settings.StrictModelValidation = original })
+
+	newInfo := func(model string) *relaycommon.RelayInfo {
+		return &relaycommon.RelayInfo{ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: model}}
+	}
+	newOpenAIRequest := func(model string) *dto.GeneralOpenAIRequest {
+		return &dto.GeneralOpenAIRequest{
+			Model:    model,
+			Messages: []dto.Message{{Role: "user", Content: "hello"}},
+		}
+	}
+
+	settings.StrictModelValidation = false
+	_, err := (&Adaptor{}).ConvertOpenAIRequest(nil, newInfo(""), newOpenAIRequest(""))
+	require.Error(t, err)
+	var apiErr *types.NewAPIError
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+
+	_, err = (&Adaptor{}).ConvertOpenAIRequest(nil, newInfo("claude-sonet-4-5-20250929"), newOpenAIRequest("claude-sonet-4-5-20250929"))
+	require.NoError(t, err)
+
+	settings.StrictModelValidation = true
+	_, err = (&Adaptor{}).ConvertOpenAIRequest(nil, newInfo("claude-sonet-4-5-20250929"), newOpenAIRequest("claude-sonet-4-5-20250929"))
+	require.Error(t, err)
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, types.ErrorCodeModelNotSupported, apiErr.GetErrorCode())
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	assert.Contains(t, err.Error(), "did you mean: claude-sonnet-4-5-20250929")
+
+	_, err = (&Adaptor{}).ConvertClaudeRequest(nil, newInfo("claude-sonnet-4-5-20250929"), &dto.ClaudeRequest{
+		Model:    "claude-sonnet-4-5-20250929",
+		Messages: []dto.ClaudeMessage{{Role: "user", Content: "hello"}},
+	})
+	require.NoError(t, err)
+}
+
+func TestConvertForDebugMatchesConvertedUpstreamRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newContext := func() *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		c.Set("id", 42)
+		return c
+	}
+	newInfo := func() *relaycommon.RelayInfo {
+		return &relaycommon.RelayInfo{
+			RelayFormat: types.RelayFormatOpenAI,
+			ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+		}
+	}
+	newRequest := func() *dto.GeneralOpenAIRequest {
+		var request dto.GeneralOpenAIRequest
+		require.NoError(t, common.UnmarshalJsonStr(`{
+			"model": "claude-sonnet-4-5-20250929",
+			"messages": [
+				{"role": "system", "content": "be brief"},
+				{"role": "user", "content": "hello"}
+			],
+			"tools": [{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object"}}}],
+			"tool_choice": "auto"
+		}`, &request))
+		return &request
+	}
+
+	debugOutput, err := ConvertForDebug(newContext(), newInfo(), newRequest())
+	require.NoError(t, err)
+
+	info := newInfo()
+	adaptor := &Adaptor{}
+	adaptor.Init(info)
+	converted, err := adaptor.ConvertOpenAIRequest(newContext(), info, newRequest())
+	require.NoError(t, err)
+	expected, err := common.Marshal(converted)
+	require.NoError(t, err)
+
+	assert.JSONEq(t, string(expected), string(debugOutput))
+	assert.Contains(t, string(debugOutput), `"metadata"`)
+}
+
+func TestConvertOpenAIRequestRecordsResolvedUpstreamModelForThinkingSuffix(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	info := &relaycommon.RelayInfo{
+		OriginModelName: "claude-sonnet-4-5-20250929-thinking",
+		RelayFormat:     types.RelayFormatOpenAI,
+		ChannelMeta:     &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929-thinking"},
+	}
+	request := &dto.GeneralOpenAIRequest{
+		Model:    "claude-sonnet-4-5-20250929-thinking",
+		Messages: []dto.Message{{Role: "user", Content: "hello"}},
+	}
+	converted, err := (&Adaptor{}).ConvertOpenAIRequest(c, info, request)
+	require.NoError(t, err)
+	require.Equal(t, "claude-sonnet-4-5-20250929", converted.(*dto.ClaudeRequest).Model)
+
+	other := service.GenerateTextOtherInfo(c, info, 1, 1, 1, 0, 0, 0, 1)
+	assert.Equal(t, "claude-sonnet-4-5-20250929", other["resolved_upstream_model"])
+	assert.Equal(t, "claude-sonnet-4-5-20250929-thinking", info.OriginModelName)
+}
+
+func TestConvertRerankRequestReturnsRetryableUnsupportedError(t *testing.T) {
+	converted, err := (&Adaptor{}).ConvertRerankRequest(nil, 0, dto.RerankRequest{
+		Model:     "claude-sonnet-4-5-20250929",
+		Query:     "hello",
+		Documents: []any{"a", "b"},
+	})
+
+	require.Error(t, err)
+	assert.Nil(t, converted, "no upstream request body should be produced")
+
+	var apiErr *types.NewAPIError
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, types.ErrorCodeModelNotSupported, apiErr.GetErrorCode())
+	assert.Equal(t, http.StatusNotImplemented, apiErr.StatusCode)
+	assert.False(t, types.IsSkipRetryError(apiErr))
+}
+
+func TestDoResponseEchoesConversionDebugHeadersWhenDebugEnabled(t *testing.T) {
+	originalDebug := common.DebugEnabled
+	t.Cleanup(func() { common.DebugEnabled = originalDebug })
+
+	newRequest := func() *dto.GeneralOpenAIRequest {
+		var request dto.GeneralOpenAIRequest
+		require.NoError(t, common.UnmarshalJsonStr(`{
+			"model": "claude-sonnet-4-5-20250929-thinking",
+			"max_tokens": 2000,
+			"messages": [
+				{"role": "system", "content": [{"type": "text", "text": "static rules", "cache_control": {"type": "ephemeral"}}]},
+				{"role": "user", "content": [{"type": "text", "text": "hello", "cache_control": {"type": "ephemeral"}}]}
+			]
+		}`, &request))
+		return &request
+	}
+	run := func() http.Header {
+		gin.SetMode(gin.TestMode)
+		recorder := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(recorder)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		info := &relaycommon.RelayInfo{
+			RelayFormat: types.RelayFormatOpenAI,
+			ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929-thinking"},
+		}
+		adaptor := &Adaptor{}
+		adaptor.Init(info)
+		_, err := adaptor.ConvertOpenAIRequest(ctx, info, newRequest())
+		require.NoError(t, err)
+
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body: io.NopCloser(strings.NewReader(`{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-5-20250929",` +
+				`"content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":20,"output_tokens":10}}`)),
+		}
+		_, apiErr := adaptor.DoResponse(ctx, resp, info)
+		require.Nil(t, apiErr)
+		return recorder.Header()
+	}
+
+	common.DebugEnabled = true
+	header := run()
+	assert.Equal(t, "message", header.Get("X-Claude-Mode"))
+	assert.Equal(t, "1600", header.Get("X-Claude-Thinking-Budget"))
+	assert.Equal(t, "2", header.Get("X-Claude-Cache-Breakpoints"))
+
+	common.DebugEnabled = false
+	header = run()
+	assert.Empty(t, header.Get("X-Claude-Mode"))
+	assert.Empty(t, header.Get("X-Claude-Thinking-Budget"))
+	assert.Empty(t, header.Get("X-Claude-Cache-Breakpoints"))
+}
+
+func TestConvertClaudeRequestExtendsUpstreamTimeoutForThinking(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	originalBase, originalPer1K, originalRelayTimeout := settings.ThinkingTimeoutBaseSeconds, settings.ThinkingTimeoutSecondsPer1KTokens, common.RelayTimeout
+	t.Cleanup(func() {
+		settings.ThinkingTimeoutBaseSeconds = originalBase
+		settings.ThinkingTimeoutSecondsPer1KTokens = originalPer1K
+		common.RelayTimeout = originalRelayTimeout
+	})
+	settings.ThinkingTimeoutBaseSeconds = 60
+	settings.ThinkingTimeoutSecondsPer1KTokens = 10
+	common.RelayTimeout = 120
+
+	convert := func(request string) *relaycommon.RelayInfo {
+		var claudeRequest dto.ClaudeRequest
+		require.NoError(t, common.UnmarshalJsonStr(request, &claudeRequest))
+		info := &relaycommon.RelayInfo{
+			ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+		}
+		_, err := (&Adaptor{}).ConvertClaudeRequest(nil, info, &claudeRequest)
+		require.NoError(t, err)
+		return info
+	}
+
+	plain := convert(`{"model": "claude-sonnet-4-5-20250929", "max_tokens": 64000, "messages": [{"role": "user", "content": "hello"}]}`)
+	thinking := convert(`{"model": "claude-sonnet-4-5-20250929", "max_tokens": 64000, "thinking": {"type": "enabled", "budget_tokens": 48000}, "messages": [{"role": "user", "content": "hello"}]}`)
+	smallThinking := convert(`{"model": "claude-sonnet-4-5-20250929", "max_tokens": 2048, "thinking": {"type": "enabled", "budget_tokens": 1024}, "messages": [{"role": "user", "content": "hello"}]}`)
+
+	assert.Zero(t, plain.UpstreamTimeout)
+	assert.Equal(t, 700*time.Second, thinking.UpstreamTimeout)
+	// 计算结果不超过 RELAY_TIMEOUT 时沿用全局超时
+	assert.Zero(t, smallThinking.UpstreamTimeout)
+}
+
+func TestConvertClaudeRequestResetsUpstreamTimeoutOnReusedRelayInfo(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	originalBase, originalPer1K, originalRelayTimeout := settings.ThinkingTimeoutBaseSeconds, settings.ThinkingTimeoutSecondsPer1KTokens, common.RelayTimeout
+	t.Cleanup(func() {
+		settings.ThinkingTimeoutBaseSeconds = originalBase
+		settings.ThinkingTimeoutSecondsPer1KTokens = originalPer1K
+		common.RelayTimeout = originalRelayTimeout
+	})
+	settings.ThinkingTimeoutBaseSeconds = 60
+	settings.ThinkingTimeoutSecondsPer1KTokens = 10
+	common.RelayTimeout = 120
+
+	// 重试时复用同一个 RelayInfo
+	info := &relaycommon.RelayInfo{
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+	convert := func(request string) {
+		var claudeRequest dto.ClaudeRequest
+		require.NoError(t, common.UnmarshalJsonStr(request, &claudeRequest))
+		_, err := (&Adaptor{}).ConvertClaudeRequest(nil, info, &claudeRequest)
+		require.NoError(t, err)
+	}
+
+	convert(`{"model": "claude-sonnet-4-5-20250929", "max_tokens": 64000, "thinking": {"type": "enabled", "budget_tokens": 48000}, "messages": [{"role": "user", "content": "hello"}]}`)
+	require.Equal(t, 700*time.Second, info.UpstreamTimeout)
+
+	convert(`{"model": "claude-sonnet-4-5-20250929", "max_tokens": 64000, "messages": [{"role": "user", "content": "hello"}]}`)
+	assert.Zero(t, info.UpstreamTimeout)
+}
+
+func TestConvertClaudeRequestPreservesDocumentCitations(t *testing.T) {
+	var request dto.ClaudeRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"max_tokens": 1024,
+		"messages": [{"role": "user", "content": [
+			{"type": "document", "source": {"type": "text", "media_type": "text/plain", "data": "The grass is green."}, "citations": {"enabled": true}},
+			{"type": "text", "text": "What color is the grass?"}
+		]}]
+	}`, &request))
+	info := &relaycommon.RelayInfo{
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+
+	converted, err := (&Adaptor{}).ConvertClaudeRequest(nil, info, &request)
+	require.NoError(t, err)
+	body, err := common.Marshal(converted)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"citations":{"enabled":true}`)
+}
+
+func TestConvertClaudeRequestLimitsSystemBlocksAndMessages(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	originalBlocks, originalMessages := settings.MaxSystemBlocks, settings.MaxMessages
+	settings.MaxSystemBlocks = 2
+	settings.MaxMessages = 2
+	t.Cleanup(func() {
+		settings.MaxSystemBlocks = originalBlocks
+		settings.MaxMessages = originalMessages
+	})
+	info := &relaycommon.RelayInfo{
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+
+	testCases := []struct {
+		name       string
+		body       string
+		errMessage string
+	}{
+		{
+			name:       "too many system blocks",
+			body:       `{"model": "claude-sonnet-4-5-20250929", "system": [{"type": "text", "text": "a"}, {"type": "text", "text": "b"}, {"type": "text", "text": "c"}], "messages": [{"role": "user", "content": "hello"}]}`,
+			errMessage: "too many system blocks: got 3, at most 2 allowed",
+		},
+		{
+			name:       "too many messages",
+			body:       `{"model": "claude-sonnet-4-5-20250929", "messages": [{"role": "user", "content": "a"}, {"role": "assistant", "content": "b"}, {"role": "user", "content": "c"}]}`,
+			errMessage: "too many messages: got 3, at most 2 allowed",
+		},
+		{
+			name: "within limits",
+			body: `{"model": "claude-sonnet-4-5-20250929", "system": [{"type": "text", "text": "a"}, {"type": "text", "text": "b"}], "messages": [{"role": "user", "content": "hello"}]}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var request dto.ClaudeRequest
+			require.NoError(t, common.UnmarshalJsonStr(tc.body, &request))
+
+			_, err := (&Adaptor{}).ConvertClaudeRequest(nil, info, &request)
+			if tc.errMessage == "" {
+				require.NoError(t, err)
+				return
+			}
+			var apiErr *types.NewAPIError
+			require.ErrorAs(t, err, &apiErr)
+			assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+			assert.Contains(t, err.Error(), tc.errMessage)
+		})
+	}
+}
+
+func TestConvertClaudeRequestValidatesToolInputSchema(t *testing.T) {
+	info := &relaycommon.RelayInfo{
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+
+	testCases := []struct {
+		name       string
+		tools      string
+		errMessage string
+	}{
+		{
+			name:  "valid schema and server tool",
+			tools: `[{"name": "get_weather", "input_schema": {"type": "object", "properties": {"city": {"type": "string"}}, "required": ["city"]}}, {"type": "web_search_20250305", "name": "web_search"}]`,
+		},
+		{
+			name:       "non-object type",
+			tools:      `[{"name": "get_weather", "input_schema": {"type": "string"}}]`,
+			errMessage: `invalid input_schema for tool "get_weather": type must be "object"`,
+		},
+		{
+			name:       "undefined required property",
+			tools:      `[{"name": "get_weather", "input_schema": {"type": "object", "properties": {}, "required": ["city"]}}]`,
+			errMessage: "required property city is not defined in properties",
+		},
+		{
+			name:       "schema is not an object",
+			tools:      `[{"name": "get_weather", "input_schema": "object"}]`,
+			errMessage: "input_schema must be an object",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var request dto.ClaudeRequest
+			require.NoError(t, common.UnmarshalJsonStr(`{"model": "claude-sonnet-4-5-20250929", "messages": [{"role": "user", "content": "hello"}], "tools": `+tc.tools+`}`, &request))
+
+			_, err := (&Adaptor{}).ConvertClaudeRequest(nil, info, &request)
+			if tc.errMessage == "" {
+				require.NoError(t, err)
+				return
+			}
+			var apiErr *types.NewAPIError
+			require.ErrorAs(t, err, &apiErr)
+			assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+			assert.Contains(t, err.Error(), tc.errMessage)
+		})
+	}
+}
+
+func TestConvertRequestSetsServiceTier(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	original := settings.DefaultServiceTier
+	t.Cleanup(func() { settings.DefaultServiceTier = original })
+
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	info := &relaycommon.RelayInfo{
+		RelayFormat: types.RelayFormatOpenAI,
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+
+	settings.DefaultServiceTier = ""
+	openAIRequest := &dto.GeneralOpenAIRequest{
+		Model:       "claude-sonnet-4-5-20250929",
+		Messages:    []dto.Message{{Role: "user", Content: "hello"}},
+		ServiceTier: json.RawMessage(`"priority"`),
+	}
+	converted, err := (&Adaptor{}).ConvertOpenAIRequest(c, info, openAIRequest)
+	require.NoError(t, err)
+	body, err := common.Marshal(converted)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"service_tier":"auto"`)
+
+	settings.DefaultServiceTier = "standard_only"
+	var claudeRequest dto.ClaudeRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{"model": "claude-sonnet-4-5-20250929", "messages": [{"role": "user", "content": "hello"}]}`, &claudeRequest))
+	converted, err = (&Adaptor{}).ConvertClaudeRequest(c, info, &claudeRequest)
+	require.NoError(t, err)
+	body, err = common.Marshal(converted)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"service_tier":"standard_only"`)
+
+	require.NoError(t, common.UnmarshalJsonStr(`{"model": "claude-sonnet-4-5-20250929", "service_tier": "auto", "messages": [{"role": "user", "content": "hello"}]}`, &claudeRequest))
+	converted, err = (&Adaptor{}).ConvertClaudeRequest(c, info, &claudeRequest)
+	require.NoError(t, err)
+	assert.Equal(t, "auto", converted.(*dto.ClaudeRequest).ServiceTier)
+}
+
+func TestModelAliasRewritesUpstreamModelAndKeepsAliasInResponse(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	original := settings.ModelAliases
+	settings.ModelAliases = map[string]string{"claude-smart": "claude-sonnet-4-5-20250929"}
+	t.Cleanup(func() { settings.ModelAliases = original })
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	info := &relaycommon.RelayInfo{
+		RelayFormat:     types.RelayFormatOpenAI,
+		OriginModelName: "claude-smart",
+		ChannelMeta:     &relaycommon.ChannelMeta{UpstreamModelName: "claude-smart"},
+	}
+
+	adaptor := &Adaptor{}
+	adaptor.Init(info)
+	assert.Equal(t, "claude-sonnet-4-5-20250929", info.UpstreamModelName)
+
+	converted, err := adaptor.ConvertOpenAIRequest(c, info, &dto.GeneralOpenAIRequest{
+		Model:    "claude-smart",
+		Messages: []dto.Message{{Role: "user", Content: "hello"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "claude-sonnet-4-5-20250929", converted.(*dto.ClaudeRequest).Model)
+	assert.Equal(t, "claude-sonnet-4-5-20250929", info.UpstreamModelName)
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(`{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-5-20250929","content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":12,"output_tokens":4}}`)),
+	}
+	_, apiErr := adaptor.DoResponse(c, resp, info)
+	require.Nil(t, apiErr)
+	var textResponse dto.OpenAITextResponse
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &textResponse))
+	assert.Equal(t, "claude-smart", textResponse.Model)
+}
+
+func TestCountTokensUsesCountTokensEndpoint(t *testing.T) {
+	service.InitHttpClient()
+	var requestPath string
+	var requestBody map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestPath = r.URL.Path
+		body, _ := io.ReadAll(r.Body)
+		_ = common.Unmarshal(body, &requestBody)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"input_tokens":42}`))
+	}))
+	defer upstream.Close()
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	info := &relaycommon.RelayInfo{
+		RelayFormat: types.RelayFormatOpenAI,
+		IsStream:    true,
+		ChannelMeta: &relaycommon.ChannelMeta{
+			ChannelBaseUrl:    upstream.URL,
+			ApiKey:            "sk-test",
+			UpstreamModelName: "claude-sonnet-4-5-20250929",
+		},
+	}
+
+	inputTokens, apiErr := CountTokens(c, info, &dto.GeneralOpenAIRequest{
+		Model:    "claude-sonnet-4-5-20250929",
+		Messages: []dto.Message{{Role: "system", Content: "be brief"}, {Role: "user", Content: "hello"}},
+	})
+	require.Nil(t, apiErr)
+	assert.Equal(t, 42, inputTokens)
+	assert.Equal(t, "/v1/messages/count_tokens", requestPath)
+	assert.Equal(t, "claude-sonnet-4-5-20250929", requestBody["model"])
+	assert.NotNil(t, requestBody["system"])
+	assert.NotContains(t, requestBody, "max_tokens")
+	assert.NotContains(t, requestBody, "stream")
+	assert.Empty(t, recorder.Body.String(), "counting must not write to the client")
+	assert.True(t, info.IsStream)
+
+	info.IsStream = false
+	info.RequestHeaders = map[string]string{claudeCountTokensHeader: "true"}
+	adaptor := &Adaptor{}
+	adaptor.Init(info)
+	requestURL, err := adaptor.GetRequestURL(info)
+	require.NoError(t, err)
+	assert.Equal(t, upstream.URL+"/v1/messages/count_tokens", requestURL)
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(`{"input_tokens":42}`)),
+	}
+	usage, apiErr := adaptor.DoResponse(c, resp, info)
+	require.Nil(t, apiErr)
+	assert.Zero(t, usage.(*dto.Usage).TotalTokens)
+	assert.JSONEq(t, `{"input_tokens":42}`, recorder.Body.String())
+}
+
+func TestConvertResponsesAndGeminiRequestsApplyPostProcessing(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	originalParallel := settings.ForceDisableParallelToolUse
+	originalTier := settings.DefaultServiceTier
+	settings.ForceDisableParallelToolUse = true
+	settings.DefaultServiceTier = "standard_only"
+	t.Cleanup(func() {
+		settings.ForceDisableParallelToolUse = originalParallel
+		settings.DefaultServiceTier = originalTier
+	})
+
+	gin.SetMode(gin.TestMode)
+	newContext := func() *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/responses", nil)
+		c.Set("id", 42)
+		return c
+	}
+	newInfo := func(format types.RelayFormat) *relaycommon.RelayInfo {
+		return &relaycommon.RelayInfo{
+			RelayFormat: format,
+			ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+		}
+	}
+	assertPostProcessed := func(converted any) {
+		claudeRequest, ok := converted.(*dto.ClaudeRequest)
+		require.True(t, ok)
+		toolChoice, ok := claudeRequest.ToolChoice.(*dto.ClaudeToolChoice)
+		require.True(t, ok)
+		assert.True(t, toolChoice.DisableParallelToolUse)
+		assert.Equal(t, "standard_only", claudeRequest.ServiceTier)
+		var metadata dto.ClaudeMetadata
+		require.NoError(t, common.Unmarshal(claudeRequest.Metadata, &metadata))
+		assert.Equal(t, common.GenerateHMAC("user:42"), metadata.UserId)
+	}
+
+	var responsesRequest dto.OpenAIResponsesRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"input": [{"role": "user", "content": [{"type": "input_text", "text": "weather?"}]}],
+		"tools": [{"type": "function", "name": "get_weather", "parameters": {"type": "object"}}]
+	}`, &responsesRequest))
+	converted, err := (&Adaptor{}).ConvertOpenAIResponsesRequest(newContext(), newInfo(types.RelayFormatOpenAIResponses), responsesRequest)
+	require.NoError(t, err)
+	assertPostProcessed(converted)
+
+	var geminiRequest dto.GeminiChatRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"contents": [{"role": "user", "parts": [{"text": "weather?"}]}],
+		"tools": [{"functionDeclarations": [{"name": "get_weather", "parameters": {"type": "object"}}]}]
+	}`, &geminiRequest))
+	converted, err = (&Adaptor{}).ConvertGeminiRequest(newContext(), newInfo(types.RelayFormatGemini), &geminiRequest)
+	require.NoError(t, err)
+	assertPostProcessed(converted)
+
+	// 空的上游模型名与其他入口一样直接拒绝
+	_, err = (&Adaptor{}).ConvertGeminiRequest(newContext(), &relaycommon.RelayInfo{ChannelMeta: &relaycommon.ChannelMeta{}}, &geminiRequest)
+	require.Error(t, err)
+}
@@ -0,0 +1,120 @@
+package claude
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+)
+
+// MessageBatchOwner 记录 batch 提交时的用户、渠道与多 key 序号，查询状态和结果时据此回到同一上游 key，
+// 并拒绝其他用户通过猜测 batch id 读取结果
+type MessageBatchOwner struct {
+	UserId    int `json:"user_id"`
+	ChannelId int `json:"channel_id"`
+	KeyIndex  int `json:"key_index"`
+}
+
+// messageBatchOwnerTTL 与 Anthropic 保留 batch 结果的时长一致
+const messageBatchOwnerTTL = 29 * 24 * time.Hour
+
+// defaultMessageBatchOwnerCapacity 是未启用 Redis 时内存中最多保留的 batch 数，超出后淘汰最早提交的
+const defaultMessageBatchOwnerCapacity = 4096
+
+const messageBatchOwnerRedisPrefix = "claude_message_batch:"
+
+var messageBatchOwners = newMemoryMessageBatchOwnerStore(defaultMessageBatchOwnerCapacity)
+
+// saveMessageBatchOwner 在 batch 创建成功后记录归属；启用 Redis 时多实例共享，否则仅当前实例可查询
+func saveMessageBatchOwner(batchId string, info *relaycommon.RelayInfo) {
+	if batchId == "" || info == nil || info.ChannelMeta == nil {
+		return
+	}
+	owner := MessageBatchOwner{
+		UserId:    info.UserId,
+		ChannelId: info.ChannelId,
+		KeyIndex:  info.ChannelMultiKeyIndex,
+	}
+	if common.RedisEnabled && common.RDB != nil {
+		data, err := common.Marshal(owner)
+		if err == nil {
+			if err = common.RedisSet(messageBatchOwnerRedisPrefix+batchId, string(data), messageBatchOwnerTTL); err == nil {
+				return
+			}
+		}
+		common.SysError("failed to save claude message batch owner: " + err.Error())
+	}
+	messageBatchOwners.save(batchId, owner)
+}
+
+// LoadMessageBatchOwner 返回 batch 提交时记录的归属，batch 不是经本服务提交或记录已过期时返回 false
+func LoadMessageBatchOwner(batchId string) (MessageBatchOwner, bool) {
+	if common.RedisEnabled && common.RDB != nil {
+		if data, err := common.RedisGet(messageBatchOwnerRedisPrefix + batchId); err == nil {
+			var owner MessageBatchOwner
+			if err = common.UnmarshalJsonStr(data, &owner); err == nil {
+				return owner, true
+			}
+		}
+	}
+	return messageBatchOwners.load(batchId)
+}
+
+type memoryMessageBatchOwnerStore struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	items    map[string]*list.Element
+}
+
+type memoryMessageBatchOwnerEntry struct {
+	batchId   string
+	owner     MessageBatchOwner
+	expiresAt time.Time
+}
+
+func newMemoryMessageBatchOwnerStore(capacity int) *memoryMessageBatchOwnerStore {
+	return &memoryMessageBatchOwnerStore{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (s *memoryMessageBatchOwnerStore) save(batchId string, owner MessageBatchOwner) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if element, ok := s.items[batchId]; ok {
+		s.remove(element)
+	}
+	s.items[batchId] = s.order.PushFront(&memoryMessageBatchOwnerEntry{
+		batchId:   batchId,
+		owner:     owner,
+		expiresAt: time.Now().Add(messageBatchOwnerTTL),
+	})
+	for s.capacity > 0 && s.order.Len() > s.capacity {
+		s.remove(s.order.Back())
+	}
+}
+
+func (s *memoryMessageBatchOwnerStore) load(batchId string) (MessageBatchOwner, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.items[batchId]
+	if !ok {
+		return MessageBatchOwner{}, false
+	}
+	entry := element.Value.(*memoryMessageBatchOwnerEntry)
+	if time.Now().After(entry.expiresAt) {
+		s.remove(element)
+		return MessageBatchOwner{}, false
+	}
+	return entry.owner, true
+}
+
+func (s *memoryMessageBatchOwnerStore) remove(element *list.Element) {
+	s.order.Remove(element)
+	delete(s.items, element.Value.(*memoryMessageBatchOwnerEntry).batchId)
+}
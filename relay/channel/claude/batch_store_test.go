@@ -0,0 +1,57 @@
+package claude
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaudeMessageBatchHandlerRecordsBatchOwner(t *testing.T) {
+	originalRedisEnabled := common.RedisEnabled
+	common.RedisEnabled = false
+	t.Cleanup(func() { common.RedisEnabled = originalRedisEnabled })
+
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(`{"id":"msgbatch_owner_test","type":"message_batch","processing_status":"in_progress"}`)),
+	}
+	info := &relaycommon.RelayInfo{
+		UserId:      7,
+		ChannelMeta: &relaycommon.ChannelMeta{ChannelId: 3, ChannelMultiKeyIndex: 2},
+	}
+
+	_, apiErr := ClaudeMessageBatchHandler(c, resp, info, 0)
+	require.Nil(t, apiErr)
+
+	owner, ok := LoadMessageBatchOwner("msgbatch_owner_test")
+	require.True(t, ok)
+	assert.Equal(t, MessageBatchOwner{UserId: 7, ChannelId: 3, KeyIndex: 2}, owner)
+
+	_, ok = LoadMessageBatchOwner("msgbatch_unknown")
+	assert.False(t, ok)
+}
+
+func TestMemoryMessageBatchOwnerStoreEvictsOldest(t *testing.T) {
+	store := newMemoryMessageBatchOwnerStore(2)
+	store.save("a", MessageBatchOwner{UserId: 1})
+	store.save("b", MessageBatchOwner{UserId: 2})
+	store.save("c", MessageBatchOwner{UserId: 3})
+
+	_, ok := store.load("a")
+	assert.False(t, ok)
+	owner, ok := store.load("c")
+	require.True(t, ok)
+	assert.Equal(t, 3, owner.UserId)
+}
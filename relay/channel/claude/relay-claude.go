@@ -1,9 +1,18 @@
 package claude
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/constant"
@@ -16,6 +25,7 @@ import (
 	"github.com/QuantumNous/new-api/setting/model_setting"
 	"github.com/QuantumNous/new-api/types"
 
+	"github.com/andybalholm/brotli"
 	"github.com/gin-gonic/gin"
 )
 
@@ -83,7 +93,65 @@ func FormatClaudeResponseInfo(claudeResponse *dto.ClaudeResponse, oaiResponse *d
 	return relayconvert.FormatClaudeResponseInfo(claudeResponse, oaiResponse, claudeInfo)
 }
 
+// claudeOverloadedStatusCode 是 Anthropic 过载时使用的非标准状态码
+const claudeOverloadedStatusCode = 529
+
+// resolveAnthropicVersion 与发往上游的 anthropic-version 请求头保持一致：优先客户端传入，否则按模型取配置
+func resolveAnthropicVersion(c *gin.Context, info *relaycommon.RelayInfo) string {
+	if c != nil && c.Request != nil {
+		if anthropicVersion := c.Request.Header.Get("anthropic-version"); anthropicVersion != "" {
+			return anthropicVersion
+		}
+	}
+	return model_setting.GetClaudeSettings().GetAnthropicVersion(info.OriginModelName)
+}
+
+// claudeSystemFingerprint 由模型名和 anthropic-version 生成稳定的 system_fingerprint，
+// 部分 OpenAI 客户端依赖该字段做缓存或统计
+func claudeSystemFingerprint(model string, anthropicVersion string) string {
+	sum := common.Sha256Raw([]byte(model + "|" + anthropicVersion))
+	return "fp_" + hex.EncodeToString(sum)[:10]
+}
+
+// openAIResponseModel 返回 OpenAI 格式响应中的 model，请求使用了模型别名时返回别名
+func openAIResponseModel(c *gin.Context, model string) string {
+	if c == nil {
+		return model
+	}
+	if alias := common.GetContextKeyString(c, constant.ContextKeyResponseModelAlias); alias != "" {
+		return alias
+	}
+	return model
+}
+
+// claudeErrorStatusCode 按 Claude 错误类型给出状态码；overloaded_error 属于临时错误，
+// 使用 529 以便按状态码重试规则切换到其他渠道，而不是当作渠道故障
+func claudeErrorStatusCode(claudeError *types.ClaudeError) int {
+	if claudeError != nil && claudeError.Type == "overloaded_error" {
+		return claudeOverloadedStatusCode
+	}
+	return http.StatusInternalServerError
+}
+
+// getUpstreamRequestId 读取 Anthropic 返回的 request-id 响应头，兼容 x-request-id
+func getUpstreamRequestId(resp *http.Response) string {
+	if resp == nil {
+		return ""
+	}
+	if requestId := resp.Header.Get("request-id"); requestId != "" {
+		return requestId
+	}
+	return resp.Header.Get("x-request-id")
+}
+
 func HandleStreamResponseData(c *gin.Context, info *relaycommon.RelayInfo, claudeInfo *ClaudeResponseInfo, data string) *types.NewAPIError {
+	// ping 心跳不需要解析，原生 Claude 格式原样转发，其他格式直接忽略
+	if isClaudePingEvent(data) {
+		if info.RelayFormat == types.RelayFormatClaude {
+			helper.ClaudeChunkData(c, dto.ClaudeResponse{Type: "ping"}, data)
+		}
+		return nil
+	}
 	var claudeResponse dto.ClaudeResponse
 	err := common.UnmarshalJsonStr(data, &claudeResponse)
 	if err != nil {
@@ -91,7 +159,7 @@ func HandleStreamResponseData(c *gin.Context, info *relaycommon.RelayInfo, claud
 		return types.NewError(err, types.ErrorCodeBadResponseBody)
 	}
 	if claudeError := claudeResponse.GetClaudeError(); claudeError != nil && claudeError.Type != "" {
-		return types.WithClaudeError(*claudeError, http.StatusInternalServerError)
+		return types.WithClaudeError(*claudeError, claudeErrorStatusCode(claudeError), types.ErrOptionWithUpstreamRequestId(claudeInfo.UpstreamRequestId))
 	}
 	if claudeResponse.StopReason != "" {
 		maybeMarkClaudeRefusal(c, claudeResponse.StopReason)
@@ -118,21 +186,81 @@ func HandleStreamResponseData(c *gin.Context, info *relaycommon.RelayInfo, claud
 	} else if info.RelayFormat == types.RelayFormatOpenAI {
 		response := StreamResponseClaude2OpenAI(&claudeResponse)
 
-		if !FormatClaudeResponseInfo(&claudeResponse, response, claudeInfo) {
+		if !FormatClaudeResponseInfo(&claudeResponse, response, claudeInfo) || response == nil {
 			return nil
 		}
 
+		response.Model = openAIResponseModel(c, response.Model)
+		response.SetSystemFingerprint(claudeSystemFingerprint(info.UpstreamModelName, resolveAnthropicVersion(c, info)))
 		err = helper.ObjectData(c, response)
 		if err != nil {
 			logger.LogError(c, "send_stream_response_failed: "+err.Error())
 		}
+		sendPartialUsageIfNeeded(c, info, claudeInfo)
+	} else if info.RelayFormat == types.RelayFormatGemini {
+		response := StreamResponseClaude2OpenAI(&claudeResponse)
+
+		if !FormatClaudeResponseInfo(&claudeResponse, response, claudeInfo) || response == nil {
+			return nil
+		}
+
+		result, err := relayconvert.ConvertStreamResponse(c, info, types.RelayFormatGemini, response)
+		if err != nil {
+			return types.NewError(err, types.ErrorCodeBadResponseBody)
+		}
+		geminiResponse, ok := result.Value.(*dto.GeminiChatResponse)
+		if !ok {
+			return types.NewError(fmt.Errorf("expected Gemini stream response, got %T", result.Value), types.ErrorCodeBadResponseBody)
+		}
+		// 没有实际内容的 chunk（如 message_start）不发送
+		if geminiResponse == nil {
+			return nil
+		}
+		geminiResponseStr, err := common.Marshal(geminiResponse)
+		if err != nil {
+			return types.NewError(err, types.ErrorCodeBadResponseBody)
+		}
+		c.Render(-1, common.CustomEvent{Data: "data: " + string(geminiResponseStr)})
+		_ = helper.FlushWriter(c)
 	}
 	return nil
 }
 
+// sendPartialUsageIfNeeded 按 StreamUsageIntervalTokens 下发中间用量 chunk，便于客户端在长输出过程中跟踪消耗。
+// Claude 只在 message_delta 给出最终输出 token 数，这里按新增文本增量估算，避免每次都重新计算全文
+func sendPartialUsageIfNeeded(c *gin.Context, info *relaycommon.RelayInfo, claudeInfo *ClaudeResponseInfo) {
+	interval := model_setting.GetClaudeSettings().StreamUsageIntervalTokens
+	if interval <= 0 || !info.ShouldIncludeUsage || claudeInfo.Done || claudeInfo.Usage == nil {
+		return
+	}
+	if newText := claudeInfo.ResponseText.String()[claudeInfo.PartialUsageTextBytes:]; newText != "" {
+		claudeInfo.PartialUsageTokens += service.EstimateTokenByModel(info.UpstreamModelName, newText)
+		claudeInfo.PartialUsageTextBytes = claudeInfo.ResponseText.Len()
+	}
+	completionTokens := max(claudeInfo.PartialUsageTokens, claudeInfo.Usage.CompletionTokens)
+	if completionTokens-claudeInfo.PartialUsageReported < interval {
+		return
+	}
+	claudeInfo.PartialUsageReported = completionTokens
+	partialUsage := *claudeInfo.Usage
+	partialUsage.CompletionTokens = completionTokens
+	response := helper.GenerateFinalUsageResponse(claudeInfo.ResponseId, claudeInfo.Created, openAIResponseModel(c, info.UpstreamModelName), buildOpenAIStyleUsageFromClaudeUsage(&partialUsage))
+	response.SetSystemFingerprint(claudeSystemFingerprint(info.UpstreamModelName, resolveAnthropicVersion(c, info)))
+	if err := helper.ObjectData(c, response); err != nil {
+		logger.LogError(c, "send_partial_usage_failed: "+err.Error())
+	}
+}
+
+// hasClaudePromptUsage 判断上游是否已下发输入用量；完全命中缓存时 input_tokens 为 0，但 cache_read_input_tokens 不为 0
+func hasClaudePromptUsage(usage *dto.Usage) bool {
+	return usage.PromptTokens > 0 || usage.PromptTokensDetails.CachedTokens > 0 || usage.PromptTokensDetails.CacheCreationTokensTotal() > 0
+}
+
 func HandleStreamFinalResponse(c *gin.Context, info *relaycommon.RelayInfo, claudeInfo *ClaudeResponseInfo) {
-	if claudeInfo.Usage.PromptTokens == 0 {
-		//上游出错
+	if !hasClaudePromptUsage(claudeInfo.Usage) && info.GetEstimatePromptTokens() > 0 {
+		// 上游没有发送 message_start 等情况下拿不到 input_tokens，使用请求预估的 prompt tokens 兜底
+		claudeInfo.Usage.PromptTokens = info.GetEstimatePromptTokens()
+		claudeInfo.Usage.TotalTokens = claudeInfo.Usage.PromptTokens + claudeInfo.Usage.CompletionTokens
 	}
 	if claudeInfo.Usage.CompletionTokens == 0 || !claudeInfo.Done {
 		if common.DebugEnabled {
@@ -144,7 +272,7 @@ func HandleStreamFinalResponse(c *gin.Context, info *relaycommon.RelayInfo, clau
 			(!claudeInfo.Done && fallback.CompletionTokens > claudeInfo.Usage.CompletionTokens) {
 			claudeInfo.Usage.CompletionTokens = fallback.CompletionTokens
 		}
-		if claudeInfo.Usage.PromptTokens == 0 {
+		if !hasClaudePromptUsage(claudeInfo.Usage) {
 			claudeInfo.Usage.PromptTokens = fallback.PromptTokens
 		}
 		claudeInfo.Usage.TotalTokens = claudeInfo.Usage.PromptTokens + claudeInfo.Usage.CompletionTokens
@@ -161,7 +289,8 @@ func HandleStreamFinalResponse(c *gin.Context, info *relaycommon.RelayInfo, clau
 	} else if info.RelayFormat == types.RelayFormatOpenAI {
 		if info.ShouldIncludeUsage {
 			openAIUsage := buildOpenAIStyleUsageFromClaudeUsage(claudeInfo.Usage)
-			response := helper.GenerateFinalUsageResponse(claudeInfo.ResponseId, claudeInfo.Created, info.UpstreamModelName, openAIUsage)
+			response := helper.GenerateFinalUsageResponse(claudeInfo.ResponseId, claudeInfo.Created, openAIResponseModel(c, info.UpstreamModelName), openAIUsage)
+			response.SetSystemFingerprint(claudeSystemFingerprint(info.UpstreamModelName, resolveAnthropicVersion(c, info)))
 			err := helper.ObjectData(c, response)
 			if err != nil {
 				common.SysLog("send final response failed: " + err.Error())
@@ -171,13 +300,27 @@ func HandleStreamFinalResponse(c *gin.Context, info *relaycommon.RelayInfo, clau
 	}
 }
 
+// isClaudePingEvent 判断 SSE data 是否为 Anthropic 的 ping 心跳，如 {"type": "ping"}
+func isClaudePingEvent(data string) bool {
+	if len(data) > 32 || !strings.Contains(data, `"ping"`) {
+		return false
+	}
+	return strings.ReplaceAll(data, " ", "") == `{"type":"ping"}`
+}
+
 func ClaudeStreamHandler(c *gin.Context, resp *http.Response, info *relaycommon.RelayInfo) (*dto.Usage, *types.NewAPIError) {
 	claudeInfo := &ClaudeResponseInfo{
-		ResponseId:   helper.GetResponseID(c),
-		Created:      common.GetTimestamp(),
-		Model:        info.UpstreamModelName,
-		ResponseText: strings.Builder{},
-		Usage:        &dto.Usage{},
+		ResponseId:        helper.GetResponseID(c),
+		Created:           common.GetTimestamp(),
+		Model:             info.UpstreamModelName,
+		ResponseText:      strings.Builder{},
+		Usage:             &dto.Usage{},
+		UpstreamRequestId: getUpstreamRequestId(resp),
+	}
+	if seconds := model_setting.GetClaudeSettings().StreamIdlePingSeconds; seconds > 0 && info.RelayFormat == types.RelayFormatOpenAI {
+		info.StreamIdlePingInterval = time.Duration(seconds) * time.Second
+		// RelayInfo 在重试间复用，Ping 间隔只对本次 Claude 流生效
+		defer func() { info.StreamIdlePingInterval = 0 }()
 	}
 	var err *types.NewAPIError
 	helper.StreamScannerHandler(c, resp, info, func(data string, sr *helper.StreamResult) {
@@ -200,8 +343,11 @@ func HandleClaudeResponseData(c *gin.Context, info *relaycommon.RelayInfo, claud
 	if err != nil {
 		return types.NewError(err, types.ErrorCodeBadResponseBody)
 	}
+	if claudeInfo.UpstreamRequestId == "" {
+		claudeInfo.UpstreamRequestId = getUpstreamRequestId(httpResp)
+	}
 	if claudeError := claudeResponse.GetClaudeError(); claudeError != nil && claudeError.Type != "" {
-		return types.WithClaudeError(*claudeError, http.StatusInternalServerError)
+		return types.WithClaudeError(*claudeError, claudeErrorStatusCode(claudeError), types.ErrOptionWithUpstreamRequestId(claudeInfo.UpstreamRequestId))
 	}
 	maybeMarkClaudeRefusal(c, claudeResponse.StopReason)
 	if claudeInfo.Usage == nil {
@@ -217,22 +363,50 @@ func HandleClaudeResponseData(c *gin.Context, info *relaycommon.RelayInfo, claud
 		claudeInfo.Usage.PromptTokensDetails.CachedCreationTokens = claudeResponse.Usage.CacheCreationInputTokens
 		claudeInfo.Usage.ClaudeCacheCreation5mTokens = claudeResponse.Usage.GetCacheCreation5mTokens()
 		claudeInfo.Usage.ClaudeCacheCreation1hTokens = claudeResponse.Usage.GetCacheCreation1hTokens()
+		if claudeResponse.Usage.ServerToolUse != nil {
+			claudeInfo.Usage.WebSearchRequests = claudeResponse.Usage.ServerToolUse.WebSearchRequests
+		}
 	}
 	var responseData []byte
 	switch info.RelayFormat {
 	case types.RelayFormatOpenAI:
 		openaiResponse := ResponseClaude2OpenAI(&claudeResponse)
+		openaiResponse.Model = openAIResponseModel(c, openaiResponse.Model)
 		openaiResponse.Usage = buildOpenAIStyleUsageFromClaudeUsage(claudeInfo.Usage)
+		openaiResponse.SystemFingerprint = claudeSystemFingerprint(info.UpstreamModelName, resolveAnthropicVersion(c, info))
 		responseData, err = common.Marshal(openaiResponse)
 		if err != nil {
 			return types.NewError(err, types.ErrorCodeBadResponseBody)
 		}
 	case types.RelayFormatClaude:
 		responseData = data
-	}
-
-	if claudeResponse.Usage != nil && claudeResponse.Usage.ServerToolUse != nil && claudeResponse.Usage.ServerToolUse.WebSearchRequests > 0 {
-		c.Set("claude_web_search_requests", claudeResponse.Usage.ServerToolUse.WebSearchRequests)
+	case types.RelayFormatGemini:
+		convertResult, err := relayconvert.ConvertResponse(c, info, types.RelayFormatGemini, &claudeResponse)
+		if err != nil {
+			return types.NewError(err, types.ErrorCodeBadResponseBody)
+		}
+		responseData, err = common.Marshal(convertResult.Value)
+		if err != nil {
+			return types.NewError(err, types.ErrorCodeBadResponseBody)
+		}
+	case types.RelayFormatOpenAIResponses:
+		convertResult, err := relayconvert.ConvertResponse(c, info, types.RelayFormatOpenAIResponses, &claudeResponse)
+		if err != nil {
+			return types.NewError(err, types.ErrorCodeBadResponseBody)
+		}
+		responsesResp, ok := convertResult.Value.(*dto.OpenAIResponsesResponse)
+		if !ok {
+			return types.NewError(fmt.Errorf("expected OpenAI responses response, got %T", convertResult.Value), types.ErrorCodeBadResponseBody)
+		}
+		if convertResult.Usage == nil || convertResult.Usage.TotalTokens == 0 {
+			openAIUsage := buildOpenAIStyleUsageFromClaudeUsage(claudeInfo.Usage)
+			responsesResp.Usage = relayconvert.UsageFromChatUsage(&openAIUsage)
+		}
+		responseData, err = common.Marshal(responsesResp)
+		if err != nil {
+			return types.NewError(err, types.ErrorCodeBadResponseBody)
+		}
+		saveResponsesTurn(c, responsesResp.ID, claudeResponse.Content)
 	}
 
 	service.IOCopyBytesGracefully(c, httpResp, responseData)
@@ -243,13 +417,14 @@ func ClaudeHandler(c *gin.Context, resp *http.Response, info *relaycommon.RelayI
 	defer service.CloseResponseBodyGracefully(resp)
 
 	claudeInfo := &ClaudeResponseInfo{
-		ResponseId:   helper.GetResponseID(c),
-		Created:      common.GetTimestamp(),
-		Model:        info.UpstreamModelName,
-		ResponseText: strings.Builder{},
-		Usage:        &dto.Usage{},
+		ResponseId:        helper.GetResponseID(c),
+		Created:           common.GetTimestamp(),
+		Model:             info.UpstreamModelName,
+		ResponseText:      strings.Builder{},
+		Usage:             &dto.Usage{},
+		UpstreamRequestId: getUpstreamRequestId(resp),
 	}
-	responseBody, err := io.ReadAll(resp.Body)
+	responseBody, err := io.ReadAll(newClaudeResponseBodyReader(resp))
 	if err != nil {
 		return nil, types.NewError(err, types.ErrorCodeBadResponseBody)
 	}
@@ -260,3 +435,125 @@ func ClaudeHandler(c *gin.Context, resp *http.Response, info *relaycommon.RelayI
 	}
 	return claudeInfo.Usage, nil
 }
+
+// ClaudeMessageBatchHandler 处理创建 batch 的响应，原样返回 batch 对象；
+// batch 结果异步产生，创建时拿不到实际用量，按预估的输入 token 与请求的 max_tokens 计费，避免上游已计费而用户零消耗
+func ClaudeMessageBatchHandler(c *gin.Context, resp *http.Response, info *relaycommon.RelayInfo, maxTokens int) (*dto.Usage, *types.NewAPIError) {
+	defer service.CloseResponseBodyGracefully(resp)
+
+	responseBody, err := io.ReadAll(newClaudeResponseBodyReader(resp))
+	if err != nil {
+		return nil, types.NewError(err, types.ErrorCodeBadResponseBody)
+	}
+	logger.LogDebug(c, "responseBody: %s", responseBody)
+	var batch dto.ClaudeMessageBatch
+	if err := common.Unmarshal(responseBody, &batch); err != nil {
+		return nil, types.NewError(err, types.ErrorCodeBadResponseBody)
+	}
+	if batch.Id == "" {
+		return nil, types.NewError(fmt.Errorf("claude message batch response has no id"), types.ErrorCodeBadResponseBody)
+	}
+	saveMessageBatchOwner(batch.Id, info)
+	service.IOCopyBytesGracefully(c, resp, responseBody)
+	usage := &dto.Usage{
+		PromptTokens:     info.GetEstimatePromptTokens(),
+		CompletionTokens: maxTokens,
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return usage, nil
+}
+
+// readClaudeCountTokensResponse 读取并解析 count_tokens 接口返回的 {input_tokens}
+func readClaudeCountTokensResponse(resp *http.Response) (*dto.ClaudeCountTokensResponse, []byte, *types.NewAPIError) {
+	responseBody, err := io.ReadAll(newClaudeResponseBodyReader(resp))
+	if err != nil {
+		return nil, nil, types.NewError(err, types.ErrorCodeBadResponseBody)
+	}
+	var countResponse dto.ClaudeCountTokensResponse
+	if err := common.Unmarshal(responseBody, &countResponse); err != nil {
+		return nil, nil, types.NewError(err, types.ErrorCodeBadResponseBody)
+	}
+	return &countResponse, responseBody, nil
+}
+
+// ClaudeCountTokensHandler 原样返回 count_tokens 的结果；计数不产生生成内容，按空用量结算
+func ClaudeCountTokensHandler(c *gin.Context, resp *http.Response, info *relaycommon.RelayInfo) (*dto.Usage, *types.NewAPIError) {
+	defer service.CloseResponseBodyGracefully(resp)
+
+	_, responseBody, apiErr := readClaudeCountTokensResponse(resp)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	logger.LogDebug(c, "responseBody: %s", responseBody)
+	service.IOCopyBytesGracefully(c, resp, responseBody)
+	return &dto.Usage{}, nil
+}
+
+// claudeResponseHeaderPeekSize 是校验压缩头时预读的字节数，足以覆盖 gzip/zlib 头部
+const claudeResponseHeaderPeekSize = 512
+
+// newClaudeResponseBodyReader 按 Content-Encoding 直接包装上游响应体做流式解压，
+// 压缩头无效时回退为原始数据
+func newClaudeResponseBodyReader(resp *http.Response) io.Reader {
+	contentEncoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if contentEncoding != "gzip" && contentEncoding != "deflate" && contentEncoding != "br" {
+		return resp.Body
+	}
+	// 先在预读的数据上校验压缩头，失败时 buffered 中的数据未被消费，可以原样回退
+	buffered := bufio.NewReader(resp.Body)
+	header, _ := buffered.Peek(claudeResponseHeaderPeekSize)
+	if err := validateCompressedHeader(contentEncoding, header); err != nil {
+		logClaudeDecompressFallback(resp, contentEncoding, err)
+		return buffered
+	}
+	reader, err := newDecompressReader(contentEncoding, buffered)
+	if err != nil {
+		logClaudeDecompressFallback(resp, contentEncoding, err)
+		return buffered
+	}
+	// 已解压，不能再把 Content-Encoding 透传给客户端
+	resp.Header.Del("Content-Encoding")
+	return reader
+}
+
+// logClaudeDecompressFallback 记录解压失败回退原始数据的情况，只在调试模式下输出，避免上游不稳定时刷屏
+func logClaudeDecompressFallback(resp *http.Response, contentEncoding string, err error) {
+	if !common.DebugEnabled {
+		return
+	}
+	contentLength := "unknown"
+	if resp.ContentLength >= 0 {
+		contentLength = strconv.FormatInt(resp.ContentLength, 10)
+	}
+	common.SysLog(fmt.Sprintf("failed to create %s reader for claude response, fallback to raw body (content-length: %s): %s",
+		contentEncoding, contentLength, err.Error()))
+}
+
+// validateCompressedHeader 在预读的数据上校验压缩格式。brotli 没有可在创建 reader 时校验的头部，
+// 需要试读一次；预读数据不完整导致的 EOF 不算格式错误
+func validateCompressedHeader(contentEncoding string, header []byte) error {
+	reader, err := newDecompressReader(contentEncoding, bytes.NewReader(header))
+	if err != nil {
+		return err
+	}
+	if contentEncoding != "br" {
+		return nil
+	}
+	if _, err := reader.Read(make([]byte, 1)); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	return nil
+}
+
+func newDecompressReader(contentEncoding string, r io.Reader) (io.Reader, error) {
+	switch contentEncoding {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return zlib.NewReader(r)
+	case "br":
+		return brotli.NewReader(r), nil
+	default:
+		return r, nil
+	}
+}
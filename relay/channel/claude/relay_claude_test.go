@@ -1,11 +1,27 @@
 package claude
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
 	"github.com/QuantumNous/new-api/service/relayconvert"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -373,3 +389,721 @@ func TestOpenAIChatRequestToClaudeMessages_ClaudeOpus48ThinkingUsesAdaptiveHighE
 	require.Nil(t, claudeRequest.TopP)
 	require.Nil(t, claudeRequest.TopK)
 }
+
+func TestClaudeHandlerDecodesBrotliResponse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+
+	responseJSON := `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-5-20250929","content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":12,"output_tokens":3,"cache_read_input_tokens":5}}`
+	var compressed bytes.Buffer
+	writer := brotli.NewWriter(&compressed)
+	_, err := writer.Write([]byte(responseJSON))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Encoding": []string{"br"}},
+		Body:       io.NopCloser(&compressed),
+	}
+	info := &relaycommon.RelayInfo{
+		RelayFormat: types.RelayFormatClaude,
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+
+	usage, apiErr := ClaudeHandler(ctx, resp, info)
+	require.Nil(t, apiErr)
+	require.NotNil(t, usage)
+	assert.Equal(t, 12, usage.PromptTokens)
+	assert.Equal(t, 3, usage.CompletionTokens)
+	assert.Equal(t, 5, usage.PromptTokensDetails.CachedTokens)
+	assert.JSONEq(t, responseJSON, recorder.Body.String())
+	assert.Empty(t, recorder.Header().Get("Content-Encoding"))
+}
+
+func TestClaudeHandlerReportsWebSearchRequestsInUsage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(`{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-5-20250929","content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":12,"output_tokens":3,"server_tool_use":{"web_search_requests":2}}}`)),
+	}
+	info := &relaycommon.RelayInfo{
+		RelayFormat: types.RelayFormatClaude,
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+
+	usage, apiErr := ClaudeHandler(ctx, resp, info)
+	require.Nil(t, apiErr)
+	require.NotNil(t, usage)
+	assert.Equal(t, 2, usage.WebSearchRequests)
+}
+
+func TestClaudeHandlerFallsBackToRawBodyOnInvalidEncodingHeader(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+
+	responseJSON := `{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"hi"}],"usage":{"input_tokens":7,"output_tokens":2}}`
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Encoding": []string{"gzip"}},
+		Body:       io.NopCloser(strings.NewReader(responseJSON)),
+	}
+	info := &relaycommon.RelayInfo{
+		RelayFormat: types.RelayFormatClaude,
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+
+	usage, apiErr := ClaudeHandler(ctx, resp, info)
+	require.Nil(t, apiErr)
+	assert.Equal(t, 7, usage.PromptTokens)
+	assert.Equal(t, 2, usage.CompletionTokens)
+}
+
+func TestHandleStreamFinalResponseFallsBackToEstimatedPromptTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	info := &relaycommon.RelayInfo{
+		RelayFormat:        types.RelayFormatOpenAI,
+		ShouldIncludeUsage: true,
+		ChannelMeta:        &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+	info.SetEstimatePromptTokens(42)
+	claudeInfo := &ClaudeResponseInfo{
+		ResponseId: "chatcmpl-test",
+		Model:      info.UpstreamModelName,
+		Usage:      &dto.Usage{},
+	}
+
+	// 上游缺失 message_start，input_tokens 从未下发
+	events := []string{
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"hello"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":7}}`,
+		`{"type":"message_stop"}`,
+	}
+	for _, event := range events {
+		require.Nil(t, HandleStreamResponseData(ctx, info, claudeInfo, event))
+	}
+	HandleStreamFinalResponse(ctx, info, claudeInfo)
+
+	assert.Equal(t, 42, claudeInfo.Usage.PromptTokens)
+	assert.Equal(t, 7, claudeInfo.Usage.CompletionTokens)
+	assert.Equal(t, 49, claudeInfo.Usage.TotalTokens)
+
+	var usageChunk string
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if strings.Contains(line, `"usage"`) {
+			usageChunk = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	require.NotEmpty(t, usageChunk)
+	var response dto.ChatCompletionsStreamResponse
+	require.NoError(t, common.UnmarshalJsonStr(usageChunk, &response))
+	require.NotNil(t, response.Usage)
+	assert.Equal(t, 42, response.Usage.PromptTokens)
+	assert.Equal(t, 7, response.Usage.CompletionTokens)
+}
+
+func BenchmarkClaudeHandlerGzipResponse(b *testing.B) {
+	gin.SetMode(gin.TestMode)
+	responseJSON := `{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"` +
+		strings.Repeat("tool output ", 64*1024) + `"}],"usage":{"input_tokens":12,"output_tokens":3}}`
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, _ = writer.Write([]byte(responseJSON))
+	_ = writer.Close()
+	info := &relaycommon.RelayInfo{
+		RelayFormat: types.RelayFormatClaude,
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Encoding": []string{"gzip"}},
+			Body:       io.NopCloser(bytes.NewReader(compressed.Bytes())),
+		}
+		if _, apiErr := ClaudeHandler(ctx, resp, info); apiErr != nil {
+			b.Fatal(apiErr)
+		}
+	}
+}
+
+func TestHandleClaudeResponseDataAttachesUpstreamRequestId(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	httpResp := &http.Response{Header: http.Header{}}
+	httpResp.Header.Set("request-id", "req_011abc")
+	info := &relaycommon.RelayInfo{RelayFormat: types.RelayFormatOpenAI}
+	claudeInfo := &ClaudeResponseInfo{Usage: &dto.Usage{}}
+	body := []byte(`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)
+
+	apiErr := HandleClaudeResponseData(c, info, claudeInfo, httpResp, body)
+	require.NotNil(t, apiErr)
+	assert.JSONEq(t, `{"upstream_request_id":"req_011abc"}`, string(apiErr.Metadata))
+	// request id 只放在 Metadata 中，不改动返回给客户端的错误信息
+	assert.Equal(t, "Overloaded", apiErr.ToOpenAIError().Message)
+}
+
+func TestErrOptionWithUpstreamRequestIdMergesMetadata(t *testing.T) {
+	apiErr := types.NewErrorWithStatusCode(errors.New("overloaded"), types.ErrorCodeBadResponseStatusCode, http.StatusServiceUnavailable)
+	apiErr.Metadata = []byte(`{"retry_after":"3"}`)
+
+	types.ErrOptionWithUpstreamRequestId("req_011abc")(apiErr)
+
+	assert.JSONEq(t, `{"retry_after":"3","upstream_request_id":"req_011abc"}`, string(apiErr.Metadata))
+}
+
+func TestClaudeStreamHandlerAttachesUpstreamRequestId(t *testing.T) {
+	oldStreamingTimeout := constant.StreamingTimeout
+	constant.StreamingTimeout = 300
+	t.Cleanup(func() {
+		constant.StreamingTimeout = oldStreamingTimeout
+	})
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader("event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"api_error\",\"message\":\"Internal\"}}\n\n")),
+	}
+	resp.Header.Set("x-request-id", "req_stream_1")
+	info := &relaycommon.RelayInfo{
+		RelayFormat: types.RelayFormatClaude,
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5"},
+	}
+
+	_, apiErr := ClaudeStreamHandler(c, resp, info)
+	require.NotNil(t, apiErr)
+	assert.JSONEq(t, `{"upstream_request_id":"req_stream_1"}`, string(apiErr.Metadata))
+	assert.NotContains(t, apiErr.Error(), "req_stream_1")
+}
+
+func TestHandleStreamResponseDataKeepsSeededIdWithoutMessageStart(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	info := &relaycommon.RelayInfo{
+		RelayFormat:        types.RelayFormatOpenAI,
+		ShouldIncludeUsage: true,
+		ChannelMeta:        &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+	claudeInfo := &ClaudeResponseInfo{
+		ResponseId: "chatcmpl-seeded",
+		Model:      info.UpstreamModelName,
+		Usage:      &dto.Usage{},
+	}
+
+	// 流直接从 content_block_delta 开始，没有 message_start
+	events := []string{
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"hello"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" world"}}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":2}}`,
+	}
+	for _, event := range events {
+		require.Nil(t, HandleStreamResponseData(ctx, info, claudeInfo, event))
+	}
+	HandleStreamFinalResponse(ctx, info, claudeInfo)
+
+	chunks := 0
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		payload, ok := strings.CutPrefix(line, "data: ")
+		if !ok || payload == "[DONE]" {
+			continue
+		}
+		var chunk dto.ChatCompletionsStreamResponse
+		require.NoError(t, common.UnmarshalJsonStr(payload, &chunk))
+		assert.Equal(t, "chatcmpl-seeded", chunk.Id)
+		chunks++
+	}
+	// 两个文本 chunk、结束 chunk 和 usage chunk
+	assert.Equal(t, 4, chunks)
+}
+
+func TestHandleStreamFinalResponseKeepsZeroInputTokensOnFullCacheHit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	info := &relaycommon.RelayInfo{
+		RelayFormat: types.RelayFormatOpenAI,
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+	info.SetEstimatePromptTokens(42)
+	claudeInfo := &ClaudeResponseInfo{
+		ResponseId: "chatcmpl-test",
+		Model:      info.UpstreamModelName,
+		Usage:      &dto.Usage{},
+	}
+
+	// 完全命中缓存：input_tokens 为 0，输入全部计入 cache_read_input_tokens
+	events := []string{
+		`{"type":"message_start","message":{"id":"msg_1","model":"claude-sonnet-4-5-20250929","usage":{"input_tokens":0,"cache_read_input_tokens":40,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"hello"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":7}}`,
+		`{"type":"message_stop"}`,
+	}
+	for _, event := range events {
+		require.Nil(t, HandleStreamResponseData(ctx, info, claudeInfo, event))
+	}
+	HandleStreamFinalResponse(ctx, info, claudeInfo)
+
+	assert.Equal(t, 0, claudeInfo.Usage.PromptTokens)
+	assert.Equal(t, 40, claudeInfo.Usage.PromptTokensDetails.CachedTokens)
+	assert.Equal(t, 7, claudeInfo.Usage.CompletionTokens)
+}
+
+func TestHandleStreamFinalResponseOmitsUsageChunkWhenClientOptsOut(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	// stream_options.include_usage=false 时 compatible_handler 会把 ShouldIncludeUsage 置为 false
+	info := &relaycommon.RelayInfo{
+		RelayFormat:        types.RelayFormatOpenAI,
+		ShouldIncludeUsage: false,
+		ChannelMeta:        &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+	claudeInfo := &ClaudeResponseInfo{
+		ResponseId: "chatcmpl-test",
+		Model:      info.UpstreamModelName,
+		Usage:      &dto.Usage{PromptTokens: 10, CompletionTokens: 3},
+		Done:       true,
+	}
+
+	HandleStreamFinalResponse(ctx, info, claudeInfo)
+
+	assert.Equal(t, "data: [DONE]", strings.TrimSpace(recorder.Body.String()))
+	assert.Equal(t, 10, claudeInfo.Usage.PromptTokens)
+}
+
+func TestClaudeOverloadedErrorIsRetryable(t *testing.T) {
+	info := &relaycommon.RelayInfo{RelayFormat: types.RelayFormatClaude}
+
+	tests := []struct {
+		name       string
+		errorType  string
+		wantStatus int
+	}{
+		{name: "overloaded", errorType: "overloaded_error", wantStatus: 529},
+		{name: "api error", errorType: "api_error", wantStatus: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := `{"type":"error","error":{"type":"` + tt.errorType + `","message":"upstream failed"}}`
+
+			streamErr := HandleStreamResponseData(nil, info, &ClaudeResponseInfo{Usage: &dto.Usage{}}, data)
+			require.NotNil(t, streamErr)
+			assert.Equal(t, tt.wantStatus, streamErr.StatusCode)
+
+			apiErr := HandleClaudeResponseData(nil, info, &ClaudeResponseInfo{Usage: &dto.Usage{}}, nil, []byte(data))
+			require.NotNil(t, apiErr)
+			assert.Equal(t, tt.wantStatus, apiErr.StatusCode)
+			assert.False(t, types.IsSkipRetryError(apiErr))
+			assert.True(t, operation_setting.ShouldRetryByStatusCode(apiErr.StatusCode))
+		})
+	}
+}
+
+func TestClaudeStreamHandlerSendsIdlePingsForOpenAIFormat(t *testing.T) {
+	oldStreamingTimeout := constant.StreamingTimeout
+	constant.StreamingTimeout = 300
+	settings := model_setting.GetClaudeSettings()
+	oldIdlePing := settings.StreamIdlePingSeconds
+	settings.StreamIdlePingSeconds = 1
+	t.Cleanup(func() {
+		constant.StreamingTimeout = oldStreamingTimeout
+		settings.StreamIdlePingSeconds = oldIdlePing
+	})
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer pw.Close()
+		fmt.Fprint(pw, "data: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"model\":\"claude-sonnet-4-5\",\"usage\":{\"input_tokens\":5}}}\n\n")
+		// 模拟 thinking 阶段上游长时间只发送 ping 事件
+		time.Sleep(2300 * time.Millisecond)
+		fmt.Fprint(pw, "data: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"hi\"}}\n\n")
+		fmt.Fprint(pw, "data: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":1}}\n\n")
+	}()
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	info := &relaycommon.RelayInfo{
+		RelayFormat: types.RelayFormatOpenAI,
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5"},
+	}
+
+	_, apiErr := ClaudeStreamHandler(c, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: pr}, info)
+	require.Nil(t, apiErr)
+
+	body := recorder.Body.String()
+	textChunk := strings.Index(body, `"content":"hi"`)
+	require.Greater(t, textChunk, 0)
+	assert.GreaterOrEqual(t, strings.Count(body[:textChunk], ": PING"), 1)
+	// 重试时复用的 RelayInfo 不应带着 Ping 间隔进入其他渠道的流
+	assert.Zero(t, info.StreamIdlePingInterval)
+}
+
+func TestHandleStreamResponseDataSkipsPingEvents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for _, data := range []string{`{"type":"ping"}`, `{"type": "ping"}`} {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		claudeInfo := &ClaudeResponseInfo{Usage: &dto.Usage{}}
+
+		info := &relaycommon.RelayInfo{RelayFormat: types.RelayFormatOpenAI}
+		require.Nil(t, HandleStreamResponseData(c, info, claudeInfo, data))
+		assert.Empty(t, recorder.Body.String())
+
+		info = &relaycommon.RelayInfo{RelayFormat: types.RelayFormatClaude}
+		require.Nil(t, HandleStreamResponseData(c, info, claudeInfo, data))
+		assert.Contains(t, recorder.Body.String(), "event: ping\n")
+		assert.Contains(t, recorder.Body.String(), "data: "+data+"\n")
+	}
+	assert.False(t, isClaudePingEvent(`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"ping"}}`))
+}
+
+func BenchmarkHandleStreamResponseDataPing(b *testing.B) {
+	gin.SetMode(gin.TestMode)
+	const data = `{"type": "ping"}`
+	info := &relaycommon.RelayInfo{RelayFormat: types.RelayFormatOpenAI}
+
+	b.Run("fast_path", func(b *testing.B) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		claudeInfo := &ClaudeResponseInfo{Usage: &dto.Usage{}}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if apiErr := HandleStreamResponseData(c, info, claudeInfo, data); apiErr != nil {
+				b.Fatal(apiErr)
+			}
+		}
+	})
+	// 对照：走快速路径之前每个 ping 都要完整反序列化
+	b.Run("unmarshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var claudeResponse dto.ClaudeResponse
+			if err := common.UnmarshalJsonStr(data, &claudeResponse); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestClaudeHandlerStripsReasoningContent(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	original := settings.StripReasoningContent
+	settings.StripReasoningContent = true
+	t.Cleanup(func() { settings.StripReasoningContent = original })
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(`{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-5-20250929","content":[{"type":"thinking","thinking":"let me think","signature":"sig"},{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":12,"output_tokens":40}}`)),
+	}
+	info := &relaycommon.RelayInfo{
+		RelayFormat: types.RelayFormatOpenAI,
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+
+	usage, apiErr := ClaudeHandler(ctx, resp, info)
+	require.Nil(t, apiErr)
+	// output_tokens 已包含 thinking token
+	assert.Equal(t, 40, usage.CompletionTokens)
+	assert.NotContains(t, recorder.Body.String(), "reasoning_content")
+	assert.NotContains(t, recorder.Body.String(), "let me think")
+	assert.Contains(t, recorder.Body.String(), `"content":"hi"`)
+}
+
+func TestHandleStreamResponseDataStripsReasoningContent(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	original := settings.StripReasoningContent
+	settings.StripReasoningContent = true
+	t.Cleanup(func() { settings.StripReasoningContent = original })
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	info := &relaycommon.RelayInfo{
+		RelayFormat:        types.RelayFormatOpenAI,
+		ShouldIncludeUsage: true,
+		ChannelMeta:        &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+	claudeInfo := &ClaudeResponseInfo{
+		ResponseId: "chatcmpl-1",
+		Model:      info.UpstreamModelName,
+		Usage:      &dto.Usage{},
+	}
+
+	events := []string{
+		`{"type":"message_start","message":{"id":"msg_1","model":"claude-sonnet-4-5-20250929","usage":{"input_tokens":12,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"let me think"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"signature_delta","signature":"sig"}}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"hi"}}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":40}}`,
+	}
+	for _, event := range events {
+		require.Nil(t, HandleStreamResponseData(ctx, info, claudeInfo, event))
+	}
+	HandleStreamFinalResponse(ctx, info, claudeInfo)
+
+	body := recorder.Body.String()
+	assert.NotContains(t, body, "reasoning_content")
+	assert.NotContains(t, body, "let me think")
+	assert.Contains(t, body, `"content":"hi"`)
+	assert.Equal(t, 40, claudeInfo.Usage.CompletionTokens)
+}
+
+func TestClaudeHandlerExposesCacheCreationSplitInOpenAIUsage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(`{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-5-20250929","content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":12,"output_tokens":3,"cache_read_input_tokens":20,"cache_creation_input_tokens":30,"cache_creation":{"ephemeral_5m_input_tokens":10,"ephemeral_1h_input_tokens":20}}}`)),
+	}
+	info := &relaycommon.RelayInfo{
+		RelayFormat: types.RelayFormatOpenAI,
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+
+	_, apiErr := ClaudeHandler(ctx, resp, info)
+	require.Nil(t, apiErr)
+
+	var response dto.OpenAITextResponse
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &response))
+	require.NotNil(t, response.Usage.CacheCreation)
+	assert.Equal(t, 10, response.Usage.CacheCreation.Ephemeral5mInputTokens)
+	assert.Equal(t, 20, response.Usage.CacheCreation.Ephemeral1hInputTokens)
+	assert.Equal(t, 20, response.Usage.PromptTokensDetails.CachedTokens)
+	assert.Equal(t, 30, response.Usage.PromptTokensDetails.CacheWriteTokens)
+}
+
+func TestClaudeDecompressFallbackLogsOnlyInDebugMode(t *testing.T) {
+	var logs bytes.Buffer
+	originalWriter, originalDebug := gin.DefaultWriter, common.DebugEnabled
+	gin.DefaultWriter = &logs
+	t.Cleanup(func() {
+		gin.DefaultWriter = originalWriter
+		common.DebugEnabled = originalDebug
+	})
+
+	newResp := func() *http.Response {
+		return &http.Response{
+			Header:        http.Header{"Content-Encoding": []string{"deflate"}},
+			ContentLength: 5,
+			Body:          io.NopCloser(strings.NewReader("plain")),
+		}
+	}
+
+	common.DebugEnabled = false
+	body, err := io.ReadAll(newClaudeResponseBodyReader(newResp()))
+	require.NoError(t, err)
+	assert.Equal(t, "plain", string(body))
+	assert.Empty(t, logs.String())
+
+	common.DebugEnabled = true
+	body, err = io.ReadAll(newClaudeResponseBodyReader(newResp()))
+	require.NoError(t, err)
+	assert.Equal(t, "plain", string(body))
+	assert.Contains(t, logs.String(), "failed to create deflate reader")
+	assert.Contains(t, logs.String(), "content-length: 5")
+
+	logs.Reset()
+	resp := newResp()
+	resp.ContentLength = -1
+	_, err = io.ReadAll(newClaudeResponseBodyReader(resp))
+	require.NoError(t, err)
+	assert.Contains(t, logs.String(), "content-length: unknown")
+	assert.NotContains(t, logs.String(), "content-length: -1")
+}
+
+func TestClaudeResponseBodyReaderValidatesBrotli(t *testing.T) {
+	plain := `{"id":"msg_1","type":"message","content":[]}`
+	resp := &http.Response{
+		Header:        http.Header{"Content-Encoding": []string{"br"}},
+		ContentLength: -1,
+		Body:          io.NopCloser(strings.NewReader(plain)),
+	}
+	body, err := io.ReadAll(newClaudeResponseBodyReader(resp))
+	require.NoError(t, err)
+	assert.Equal(t, plain, string(body))
+	assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+
+	var compressed bytes.Buffer
+	writer := brotli.NewWriter(&compressed)
+	_, err = writer.Write([]byte(strings.Repeat(plain, 100)))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	resp = &http.Response{
+		Header:        http.Header{"Content-Encoding": []string{"br"}},
+		ContentLength: int64(compressed.Len()),
+		Body:          io.NopCloser(&compressed),
+	}
+	body, err = io.ReadAll(newClaudeResponseBodyReader(resp))
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat(plain, 100), string(body))
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+}
+
+func TestHandleStreamResponseDataSendsPartialUsage(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	original := settings.StreamUsageIntervalTokens
+	settings.StreamUsageIntervalTokens = 5
+	t.Cleanup(func() { settings.StreamUsageIntervalTokens = original })
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	info := &relaycommon.RelayInfo{
+		RelayFormat:        types.RelayFormatOpenAI,
+		ShouldIncludeUsage: true,
+		ChannelMeta:        &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+	claudeInfo := &ClaudeResponseInfo{
+		ResponseId: "chatcmpl-1",
+		Model:      info.UpstreamModelName,
+		Usage:      &dto.Usage{},
+	}
+
+	events := []string{
+		`{"type":"message_start","message":{"id":"msg_1","model":"claude-sonnet-4-5-20250929","usage":{"input_tokens":12,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+	}
+	for i := 0; i < 6; i++ {
+		events = append(events, `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"the quick brown fox jumps over the lazy dog "}}`)
+	}
+	events = append(events, `{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":100}}`)
+	for _, event := range events {
+		require.Nil(t, HandleStreamResponseData(ctx, info, claudeInfo, event))
+	}
+	HandleStreamFinalResponse(ctx, info, claudeInfo)
+
+	var usages []*dto.Usage
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		payload, ok := strings.CutPrefix(line, "data: ")
+		if !ok || payload == "[DONE]" {
+			continue
+		}
+		var chunk dto.ChatCompletionsStreamResponse
+		require.NoError(t, common.UnmarshalJsonStr(payload, &chunk))
+		if chunk.Usage != nil {
+			usages = append(usages, chunk.Usage)
+		}
+	}
+	// 中间用量逐步增长，最后一个是 message_delta 给出的最终用量
+	require.Greater(t, len(usages), 2)
+	for i := 1; i < len(usages); i++ {
+		assert.Greater(t, usages[i].CompletionTokens, usages[i-1].CompletionTokens)
+	}
+	assert.Equal(t, 100, usages[len(usages)-1].CompletionTokens)
+	assert.Equal(t, 12, usages[0].PromptTokens)
+}
+
+func TestClaudeSystemFingerprintIsStable(t *testing.T) {
+	fingerprint := claudeSystemFingerprint("claude-sonnet-4-5-20250929", "2023-06-01")
+	assert.Equal(t, fingerprint, claudeSystemFingerprint("claude-sonnet-4-5-20250929", "2023-06-01"))
+	assert.Regexp(t, `^fp_[0-9a-f]{10}$`, fingerprint)
+	assert.NotEqual(t, fingerprint, claudeSystemFingerprint("claude-opus-4-1-20250805", "2023-06-01"))
+	assert.NotEqual(t, fingerprint, claudeSystemFingerprint("claude-sonnet-4-5-20250929", "2024-01-01"))
+}
+
+func TestClaudeResponsesCarrySystemFingerprint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	info := &relaycommon.RelayInfo{
+		RelayFormat:        types.RelayFormatOpenAI,
+		ShouldIncludeUsage: true,
+		OriginModelName:    "claude-sonnet-4-5-20250929",
+		ChannelMeta:        &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+	}
+	newContext := func(recorder *httptest.ResponseRecorder) *gin.Context {
+		ctx, _ := gin.CreateTestContext(recorder)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		ctx.Request.Header.Set("anthropic-version", "2023-06-01")
+		return ctx
+	}
+	want := claudeSystemFingerprint("claude-sonnet-4-5-20250929", "2023-06-01")
+
+	recorder := httptest.NewRecorder()
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(`{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-5-20250929","content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":12,"output_tokens":4}}`)),
+	}
+	_, apiErr := ClaudeHandler(newContext(recorder), resp, info)
+	require.Nil(t, apiErr)
+	var textResponse dto.OpenAITextResponse
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &textResponse))
+	assert.Equal(t, want, textResponse.SystemFingerprint)
+
+	recorder = httptest.NewRecorder()
+	ctx := newContext(recorder)
+	claudeInfo := &ClaudeResponseInfo{ResponseId: "chatcmpl-1", Model: info.UpstreamModelName, Usage: &dto.Usage{}}
+	events := []string{
+		`{"type":"message_start","message":{"id":"msg_1","model":"claude-sonnet-4-5-20250929","usage":{"input_tokens":12,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"hi"}}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":4}}`,
+	}
+	for _, event := range events {
+		require.Nil(t, HandleStreamResponseData(ctx, info, claudeInfo, event))
+	}
+	HandleStreamFinalResponse(ctx, info, claudeInfo)
+
+	chunks := 0
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		payload, ok := strings.CutPrefix(line, "data: ")
+		if !ok || payload == "[DONE]" {
+			continue
+		}
+		var chunk dto.ChatCompletionsStreamResponse
+		require.NoError(t, common.UnmarshalJsonStr(payload, &chunk))
+		assert.Equal(t, want, chunk.GetSystemFingerprint())
+		chunks++
+	}
+	assert.Greater(t, chunks, 1)
+}
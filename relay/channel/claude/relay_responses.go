@@ -0,0 +1,104 @@
+package claude
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service/relayconvert"
+	"github.com/QuantumNous/new-api/types"
+	"github.com/gin-gonic/gin"
+)
+
+// ClaudeResponsesStreamHandler 将 Claude 流式事件先转为 OpenAI chat chunk，再经由状态机转为 Responses 流式事件
+func ClaudeResponsesStreamHandler(c *gin.Context, resp *http.Response, info *relaycommon.RelayInfo) (*dto.Usage, *types.NewAPIError) {
+	claudeInfo := &ClaudeResponseInfo{
+		ResponseId:        helper.GetResponseID(c),
+		Created:           common.GetTimestamp(),
+		Model:             info.UpstreamModelName,
+		ResponseText:      strings.Builder{},
+		Usage:             &dto.Usage{},
+		UpstreamRequestId: getUpstreamRequestId(resp),
+	}
+	// message_start 会用上游 id 覆盖 ResponseId，这里记下实际下发给客户端的 response id
+	responseId := claudeInfo.ResponseId
+	var streamContent claudeStreamContent
+	state, err := relayconvert.NewResponseStreamState(types.RelayFormatOpenAI, types.RelayFormatOpenAIResponses, relayconvert.ResponseStreamOptions{
+		ID:      claudeInfo.ResponseId,
+		Model:   info.UpstreamModelName,
+		Created: claudeInfo.Created,
+	})
+	if err != nil {
+		return nil, types.NewOpenAIError(err, types.ErrorCodeBadResponse, http.StatusInternalServerError)
+	}
+
+	sendEvents := func(results []relayconvert.ResponseResult) *types.NewAPIError {
+		for _, result := range results {
+			event, ok := result.Value.(relayconvert.ChatToResponsesStreamEvent)
+			if !ok {
+				return types.NewOpenAIError(fmt.Errorf("expected OAI responses stream event, got %T", result.Value), types.ErrorCodeBadResponse, http.StatusInternalServerError)
+			}
+			data, err := common.Marshal(event.Payload)
+			if err != nil {
+				return types.NewOpenAIError(err, types.ErrorCodeJsonMarshalFailed, http.StatusInternalServerError)
+			}
+			helper.ResponseChunkData(c, dto.ResponsesStreamResponse{Type: event.Type}, string(data))
+		}
+		return nil
+	}
+
+	var streamErr *types.NewAPIError
+	helper.StreamScannerHandler(c, resp, info, func(data string, sr *helper.StreamResult) {
+		if isClaudePingEvent(data) {
+			return
+		}
+		var claudeResponse dto.ClaudeResponse
+		if err := common.UnmarshalJsonStr(data, &claudeResponse); err != nil {
+			streamErr = types.NewError(err, types.ErrorCodeBadResponseBody)
+			sr.Stop(streamErr)
+			return
+		}
+		if claudeError := claudeResponse.GetClaudeError(); claudeError != nil && claudeError.Type != "" {
+			streamErr = types.WithClaudeError(*claudeError, claudeErrorStatusCode(claudeError), types.ErrOptionWithUpstreamRequestId(claudeInfo.UpstreamRequestId))
+			sr.Stop(streamErr)
+			return
+		}
+		if claudeResponse.Delta != nil && claudeResponse.Delta.StopReason != nil {
+			maybeMarkClaudeRefusal(c, *claudeResponse.Delta.StopReason)
+		}
+		streamContent.add(&claudeResponse)
+		response := StreamResponseClaude2OpenAI(&claudeResponse)
+		if !FormatClaudeResponseInfo(&claudeResponse, response, claudeInfo) || response == nil {
+			return
+		}
+		results, err := relayconvert.ConvertStreamResponseChunk(c, info, state, response)
+		if err != nil {
+			streamErr = types.NewOpenAIError(err, types.ErrorCodeBadResponse, http.StatusInternalServerError)
+			sr.Stop(streamErr)
+			return
+		}
+		if streamErr = sendEvents(results); streamErr != nil {
+			sr.Stop(streamErr)
+		}
+	})
+	if streamErr != nil {
+		return nil, streamErr
+	}
+
+	HandleStreamFinalResponse(c, info, claudeInfo)
+	openAIUsage := buildOpenAIStyleUsageFromClaudeUsage(claudeInfo.Usage)
+	state.SetUsage(&openAIUsage)
+	finalResults, err := relayconvert.FinalizeStreamResponse(c, info, state)
+	if err != nil {
+		return nil, types.NewOpenAIError(err, types.ErrorCodeBadResponse, http.StatusInternalServerError)
+	}
+	if streamErr = sendEvents(finalResults); streamErr != nil {
+		return nil, streamErr
+	}
+	saveResponsesTurn(c, responseId, streamContent.content())
+	return claudeInfo.Usage, nil
+}
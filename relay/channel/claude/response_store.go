@@ -0,0 +1,215 @@
+package claude
+
+import (
+	"container/list"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/gin-gonic/gin"
+)
+
+// ResponseStore 保存 Responses 模式下每轮对话转换后的 Claude 消息。Claude 本身无状态，
+// 客户端通过 previous_response_id 续接对话时据此还原上下文；多实例部署可通过 SetResponseStore 换成共享存储
+type ResponseStore interface {
+	Load(key string) ([]dto.ClaudeMessage, bool)
+	Save(key string, messages []dto.ClaudeMessage)
+}
+
+// defaultResponseStoreCapacity 是默认内存存储最多保留的对话轮数，超出后淘汰最久未使用的
+const defaultResponseStoreCapacity = 1024
+
+// defaultResponseStoreMaxBytes 是默认内存存储按序列化大小计算的总上限，对话中内联的图片/文件会很快占满条数上限对应的内存
+const defaultResponseStoreMaxBytes = 64 << 20
+
+// claudeResponsesHistoryKey 在 gin context 中保存本轮发往上游的完整消息，响应成功后与 assistant 回复一起存储
+const claudeResponsesHistoryKey = "claude_responses_history"
+
+var responseStore atomic.Pointer[ResponseStore]
+
+func init() {
+	SetResponseStore(NewMemoryResponseStore(defaultResponseStoreCapacity, defaultResponseStoreMaxBytes))
+}
+
+// SetResponseStore 替换 previous_response_id 使用的存储，可与请求并发调用
+func SetResponseStore(store ResponseStore) {
+	responseStore.Store(&store)
+}
+
+func getResponseStore() ResponseStore {
+	return *responseStore.Load()
+}
+
+type memoryResponseStore struct {
+	mu        sync.Mutex
+	capacity  int
+	maxBytes  int64
+	usedBytes int64
+	order     *list.List
+	items     map[string]*list.Element
+}
+
+type memoryResponseStoreEntry struct {
+	key      string
+	messages []dto.ClaudeMessage
+	size     int64
+}
+
+// NewMemoryResponseStore 创建按 LRU 淘汰的进程内存储，capacity 限制条数，maxBytes 限制序列化后的总字节数，0 表示不限制
+func NewMemoryResponseStore(capacity int, maxBytes int64) ResponseStore {
+	return &memoryResponseStore{
+		capacity: capacity,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (s *memoryResponseStore) Load(key string) ([]dto.ClaudeMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	s.order.MoveToFront(element)
+	return slices.Clone(element.Value.(*memoryResponseStoreEntry).messages), true
+}
+
+func (s *memoryResponseStore) Save(key string, messages []dto.ClaudeMessage) {
+	var size int64
+	if s.maxBytes > 0 {
+		data, err := common.Marshal(messages)
+		if err != nil {
+			return
+		}
+		size = int64(len(data))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if element, ok := s.items[key]; ok {
+		s.remove(element)
+	}
+	// 单轮就超过总上限时不保存，续接时按 previous response 不存在处理
+	if s.maxBytes > 0 && size > s.maxBytes {
+		return
+	}
+	s.items[key] = s.order.PushFront(&memoryResponseStoreEntry{key: key, messages: messages, size: size})
+	s.usedBytes += size
+	for (s.capacity > 0 && s.order.Len() > s.capacity) || (s.maxBytes > 0 && s.usedBytes > s.maxBytes) {
+		s.remove(s.order.Back())
+	}
+}
+
+func (s *memoryResponseStore) remove(element *list.Element) {
+	entry := element.Value.(*memoryResponseStoreEntry)
+	s.order.Remove(element)
+	delete(s.items, entry.key)
+	s.usedBytes -= entry.size
+}
+
+// responseStoreKey 按用户隔离 response id，避免其他用户通过猜测 id 读取对话内容
+func responseStoreKey(c *gin.Context, responseId string) string {
+	return fmt.Sprintf("%d:%s", c.GetInt("id"), responseId)
+}
+
+// saveResponsesTurn 把本轮请求消息和 assistant 回复存为 responseId 对应的上下文
+func saveResponsesTurn(c *gin.Context, responseId string, content []dto.ClaudeMediaMessage) {
+	if c == nil || responseId == "" || len(content) == 0 {
+		return
+	}
+	history, ok := c.Get(claudeResponsesHistoryKey)
+	if !ok {
+		return
+	}
+	messages, ok := history.([]dto.ClaudeMessage)
+	if !ok {
+		return
+	}
+	messages = append(slices.Clone(messages), dto.ClaudeMessage{Role: "assistant", Content: content})
+	getResponseStore().Save(responseStoreKey(c, responseId), messages)
+}
+
+// claudeStreamContent 按 content block 序号累积流式事件，还原完整的 assistant 消息内容
+type claudeStreamContent struct {
+	blocks map[int]*dto.ClaudeMediaMessage
+	inputs map[int]*strings.Builder
+}
+
+func (s *claudeStreamContent) add(claudeResponse *dto.ClaudeResponse) {
+	switch claudeResponse.Type {
+	case "content_block_start":
+		if claudeResponse.ContentBlock == nil {
+			return
+		}
+		switch claudeResponse.ContentBlock.Type {
+		case "text", "thinking", "redacted_thinking", "tool_use":
+		default:
+			return
+		}
+		if s.blocks == nil {
+			s.blocks = make(map[int]*dto.ClaudeMediaMessage)
+			s.inputs = make(map[int]*strings.Builder)
+		}
+		block := *claudeResponse.ContentBlock
+		s.blocks[claudeResponse.GetIndex()] = &block
+	case "content_block_delta":
+		block, ok := s.blocks[claudeResponse.GetIndex()]
+		if !ok || claudeResponse.Delta == nil {
+			return
+		}
+		switch claudeResponse.Delta.Type {
+		case "text_delta":
+			block.SetText(block.GetText() + claudeResponse.Delta.GetText())
+		case "thinking_delta":
+			if claudeResponse.Delta.Thinking != nil {
+				thinking := *claudeResponse.Delta.Thinking
+				if block.Thinking != nil {
+					thinking = *block.Thinking + thinking
+				}
+				block.Thinking = &thinking
+			}
+		case "signature_delta":
+			block.Signature += claudeResponse.Delta.Signature
+		case "input_json_delta":
+			if claudeResponse.Delta.PartialJson != nil {
+				input, ok := s.inputs[claudeResponse.GetIndex()]
+				if !ok {
+					input = &strings.Builder{}
+					s.inputs[claudeResponse.GetIndex()] = input
+				}
+				input.WriteString(*claudeResponse.Delta.PartialJson)
+			}
+		}
+	}
+}
+
+func (s *claudeStreamContent) content() []dto.ClaudeMediaMessage {
+	blockIndexes := make([]int, 0, len(s.blocks))
+	for blockIndex := range s.blocks {
+		blockIndexes = append(blockIndexes, blockIndex)
+	}
+	sort.Ints(blockIndexes)
+
+	content := make([]dto.ClaudeMediaMessage, 0, len(blockIndexes))
+	for _, blockIndex := range blockIndexes {
+		block := *s.blocks[blockIndex]
+		if block.Type == "tool_use" {
+			block.Input = map[string]any{}
+			if input, ok := s.inputs[blockIndex]; ok && input.Len() > 0 {
+				// 参数不完整（如因 max_tokens 截断）时保留空对象，避免续接请求因非法 JSON 被拒绝
+				var parsed map[string]any
+				if err := common.UnmarshalJsonStr(input.String(), &parsed); err == nil {
+					block.Input = parsed
+				}
+			}
+		}
+		content = append(content, block)
+	}
+	return content
+}
@@ -0,0 +1,150 @@
+package claude
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/types"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertOpenAIResponsesRequestRestoresPreviousResponse(t *testing.T) {
+	originalStore := getResponseStore()
+	SetResponseStore(NewMemoryResponseStore(8, 0))
+	t.Cleanup(func() { SetResponseStore(originalStore) })
+
+	gin.SetMode(gin.TestMode)
+	newContext := func(userId int) (*gin.Context, *httptest.ResponseRecorder) {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/responses", nil)
+		c.Set("id", userId)
+		return c, recorder
+	}
+	newInfo := func() *relaycommon.RelayInfo {
+		return &relaycommon.RelayInfo{
+			RelayFormat: types.RelayFormatOpenAIResponses,
+			ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "claude-sonnet-4-5-20250929"},
+		}
+	}
+	newRequest := func(previousResponseId string, input string) dto.OpenAIResponsesRequest {
+		request := dto.OpenAIResponsesRequest{
+			Model:              "claude-sonnet-4-5-20250929",
+			PreviousResponseID: previousResponseId,
+		}
+		request.Input, _ = common.Marshal(input)
+		return request
+	}
+
+	// 第一轮：正常请求并记录 assistant 回复
+	c, recorder := newContext(42)
+	info := newInfo()
+	adaptor := &Adaptor{}
+	adaptor.Init(info)
+	_, err := adaptor.ConvertOpenAIResponsesRequest(c, info, newRequest("", "What is the capital of France?"))
+	require.NoError(t, err)
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body: io.NopCloser(strings.NewReader(`{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-5-20250929",` +
+			`"content":[{"type":"text","text":"Paris."}],"stop_reason":"end_turn","usage":{"input_tokens":12,"output_tokens":3}}`)),
+	}
+	_, apiErr := adaptor.DoResponse(c, resp, info)
+	require.Nil(t, apiErr)
+	var firstResponse dto.OpenAIResponsesResponse
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &firstResponse))
+	require.NotEmpty(t, firstResponse.ID)
+
+	// 第二轮：通过 previous_response_id 续接，上一轮的问答出现在本轮消息之前
+	c, _ = newContext(42)
+	info = newInfo()
+	adaptor = &Adaptor{}
+	adaptor.Init(info)
+	converted, err := adaptor.ConvertOpenAIResponsesRequest(c, info, newRequest(firstResponse.ID, "And of Italy?"))
+	require.NoError(t, err)
+	claudeRequest, ok := converted.(*dto.ClaudeRequest)
+	require.True(t, ok)
+	data, err := common.Marshal(claudeRequest.Messages)
+	require.NoError(t, err)
+	var messages []struct {
+		Role    string `json:"role"`
+		Content any    `json:"content"`
+	}
+	require.NoError(t, common.Unmarshal(data, &messages))
+	require.Len(t, messages, 3)
+	assert.Equal(t, "user", messages[0].Role)
+	assert.Contains(t, string(data), "What is the capital of France?")
+	assert.Equal(t, "assistant", messages[1].Role)
+	assert.Contains(t, string(data), "Paris.")
+	assert.Equal(t, "user", messages[2].Role)
+	assert.Contains(t, string(data), "And of Italy?")
+
+	// 其他用户不能读取这段对话
+	c, _ = newContext(7)
+	_, err = (&Adaptor{}).ConvertOpenAIResponsesRequest(c, newInfo(), newRequest(firstResponse.ID, "And of Italy?"))
+	require.Error(t, err)
+	var newAPIErr *types.NewAPIError
+	require.ErrorAs(t, err, &newAPIErr)
+	assert.Equal(t, http.StatusBadRequest, newAPIErr.StatusCode)
+	assert.Equal(t, types.ErrorCodePreviousResponseNotFound, newAPIErr.GetErrorCode())
+}
+
+func TestClaudeStreamContentRebuildsAssistantBlocks(t *testing.T) {
+	events := []string{
+		`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-5-20250929"}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"Need the weather."}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"signature_delta","signature":"sig_1"}}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"Checking "}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"now."}}`,
+		`{"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}}`,
+		`{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}`,
+		`{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"\"Paris\"}"}}`,
+	}
+	var streamContent claudeStreamContent
+	for _, event := range events {
+		var claudeResponse dto.ClaudeResponse
+		require.NoError(t, common.UnmarshalJsonStr(event, &claudeResponse))
+		streamContent.add(&claudeResponse)
+	}
+
+	data, err := common.Marshal(streamContent.content())
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"type":"thinking","thinking":"Need the weather.","signature":"sig_1"},
+		{"type":"text","text":"Checking now."},
+		{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}}
+	]`, string(data))
+}
+
+func TestMemoryResponseStoreEvictsByBytes(t *testing.T) {
+	newMessages := func(text string) []dto.ClaudeMessage {
+		return []dto.ClaudeMessage{{Role: "user", Content: text}}
+	}
+	data, err := common.Marshal(newMessages(strings.Repeat("a", 100)))
+	require.NoError(t, err)
+	store := NewMemoryResponseStore(0, int64(len(data))*2)
+
+	store.Save("1", newMessages(strings.Repeat("a", 100)))
+	store.Save("2", newMessages(strings.Repeat("b", 100)))
+	store.Save("3", newMessages(strings.Repeat("c", 100)))
+	_, ok := store.Load("1")
+	assert.False(t, ok, "the oldest entry must be evicted once the byte cap is exceeded")
+	_, ok = store.Load("3")
+	assert.True(t, ok)
+
+	store.Save("4", newMessages(strings.Repeat("d", 1000)))
+	_, ok = store.Load("4")
+	assert.False(t, ok, "an entry larger than the byte cap must not be stored")
+	_, ok = store.Load("2")
+	assert.True(t, ok)
+}
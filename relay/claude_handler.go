@@ -52,60 +52,7 @@ func ClaudeHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *typ
 		request.MaxTokens = &defaultMaxTokens
 	}
 
-	if baseModel, effortLevel, ok := reasoning.TrimEffortSuffix(request.Model); ok && effortLevel != "" &&
-		(strings.HasPrefix(request.Model, "claude-opus-4-6") ||
-			strings.HasPrefix(request.Model, "claude-opus-4-7") ||
-			strings.HasPrefix(request.Model, "claude-opus-4-8")) {
-		request.Model = baseModel
-		request.Thinking = &dto.Thinking{
-			Type: "adaptive",
-		}
-		request.OutputConfig = json.RawMessage(fmt.Sprintf(`{"effort":"%s"}`, effortLevel))
-		if strings.HasPrefix(request.Model, "claude-opus-4-7") ||
-			strings.HasPrefix(request.Model, "claude-opus-4-8") {
-			// Opus 4.7/4.8 reject non-default temperature/top_p/top_k with 400
-			// and defaults display to "omitted"; restore the 4.6 visible summary.
-			request.Thinking.Display = "summarized"
-			request.Temperature = nil
-			request.TopP = nil
-			request.TopK = nil
-		} else {
-			request.Temperature = common.GetPointer[float64](1.0)
-		}
-		info.UpstreamModelName = request.Model
-	} else if model_setting.GetClaudeSettings().ThinkingAdapterEnabled &&
-		strings.HasSuffix(request.Model, "-thinking") {
-		if request.Thinking == nil {
-			baseModel := strings.TrimSuffix(request.Model, "-thinking")
-			if strings.HasPrefix(baseModel, "claude-opus-4-7") ||
-				strings.HasPrefix(baseModel, "claude-opus-4-8") {
-				// Opus 4.7/4.8 reject thinking.type="enabled"; use adaptive at high effort.
-				request.Thinking = &dto.Thinking{Type: "adaptive", Display: "summarized"}
-				request.OutputConfig = json.RawMessage(`{"effort":"high"}`)
-				request.Temperature = nil
-				request.TopP = nil
-				request.TopK = nil
-			} else {
-				// 因为BudgetTokens 必须大于1024
-				if request.MaxTokens == nil || *request.MaxTokens < 1280 {
-					request.MaxTokens = common.GetPointer[uint](1280)
-				}
-
-				// BudgetTokens 为 max_tokens 的 80%
-				request.Thinking = &dto.Thinking{
-					Type:         "enabled",
-					BudgetTokens: common.GetPointer[int](int(float64(*request.MaxTokens) * model_setting.GetClaudeSettings().ThinkingAdapterBudgetTokensPercentage)),
-				}
-				// TODO: 临时处理
-				// https://docs.anthropic.com/en/docs/build-with-claude/extended-thinking#important-considerations-when-using-extended-thinking
-				request.Temperature = common.GetPointer[float64](1.0)
-			}
-		}
-		if !model_setting.ShouldPreserveThinkingSuffix(info.OriginModelName) {
-			request.Model = strings.TrimSuffix(request.Model, "-thinking")
-		}
-		info.UpstreamModelName = request.Model
-	}
+	applyClaudeThinkingAdapter(info, request)
 
 	if info.ChannelSetting.SystemPrompt != "" {
 		if request.System == nil {
@@ -120,14 +67,7 @@ func ClaudeHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *typ
 					request.SetStringSystem(info.ChannelSetting.SystemPrompt + "\n" + existing)
 				}
 			} else {
-				systemContents := request.ParseSystem()
-				newSystem := dto.ClaudeMediaMessage{Type: dto.ContentTypeText}
-				newSystem.SetText(info.ChannelSetting.SystemPrompt)
-				if len(systemContents) == 0 {
-					request.System = []dto.ClaudeMediaMessage{newSystem}
-				} else {
-					request.System = append([]dto.ClaudeMediaMessage{newSystem}, systemContents...)
-				}
+				request.System = prependClaudeSystemPrompt(request.ParseSystem(), info.ChannelSetting.SystemPrompt)
 			}
 		}
 	}
@@ -225,3 +165,98 @@ func ClaudeHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *typ
 	service.PostTextConsumeQuota(c, info, usage.(*dto.Usage), nil)
 	return nil
 }
+
+// prependClaudeSystemPrompt 将渠道系统提示词放到 system 第一位；客户端已在其他位置带上相同内容时去掉重复的块，保证只出现一次。
+// 客户端的重复块带有 cache_control 时保留该块、不再插入渠道副本，避免丢失客户端设置的缓存断点
+func prependClaudeSystemPrompt(systemContents []dto.ClaudeMediaMessage, systemPrompt string) []dto.ClaudeMediaMessage {
+	isDuplicate := func(content dto.ClaudeMediaMessage) bool {
+		return content.Type == dto.ContentTypeText && strings.TrimSpace(content.GetText()) == strings.TrimSpace(systemPrompt)
+	}
+	cachedIndex := -1
+	for i, content := range systemContents {
+		if isDuplicate(content) && len(content.CacheControl) > 0 {
+			cachedIndex = i
+			break
+		}
+	}
+	result := make([]dto.ClaudeMediaMessage, 0, len(systemContents)+1)
+	if cachedIndex < 0 {
+		newSystem := dto.ClaudeMediaMessage{Type: dto.ContentTypeText}
+		newSystem.SetText(systemPrompt)
+		result = append(result, newSystem)
+	}
+	for i, content := range systemContents {
+		if i != cachedIndex && isDuplicate(content) {
+			continue
+		}
+		result = append(result, content)
+	}
+	return result
+}
+
+// resolveClaudeModelAlias 返回别名对应的实际模型名；别名在渠道 ConvertClaudeRequest 中才替换，这里只用于判断
+func resolveClaudeModelAlias(model string) string {
+	resolved, _ := model_setting.GetClaudeSettings().ResolveModelAlias(model)
+	return resolved
+}
+
+// isClaudeAdaptiveOnlyModel 判断模型（按别名解析后）是否为只接受 adaptive thinking 的 Opus 4.7/4.8
+func isClaudeAdaptiveOnlyModel(model string) bool {
+	resolved := resolveClaudeModelAlias(model)
+	return strings.HasPrefix(resolved, "claude-opus-4-7") || strings.HasPrefix(resolved, "claude-opus-4-8")
+}
+
+// applyClaudeThinkingAdapter 把带 effort 后缀或 -thinking 后缀的模型改写为对应的 thinking 配置，
+// 模型是否支持 adaptive thinking 按别名解析后的模型判断
+func applyClaudeThinkingAdapter(info *relaycommon.RelayInfo, request *dto.ClaudeRequest) {
+	if baseModel, effortLevel, ok := reasoning.TrimEffortSuffix(request.Model); ok && effortLevel != "" &&
+		(strings.HasPrefix(resolveClaudeModelAlias(baseModel), "claude-opus-4-6") || isClaudeAdaptiveOnlyModel(baseModel)) {
+		request.Model = baseModel
+		request.Thinking = &dto.Thinking{
+			Type: "adaptive",
+		}
+		request.OutputConfig = json.RawMessage(fmt.Sprintf(`{"effort":"%s"}`, effortLevel))
+		if isClaudeAdaptiveOnlyModel(request.Model) {
+			// Opus 4.7/4.8 reject non-default temperature/top_p/top_k with 400
+			// and defaults display to "omitted"; restore the 4.6 visible summary.
+			request.Thinking.Display = "summarized"
+			request.Temperature = nil
+			request.TopP = nil
+			request.TopK = nil
+		} else {
+			request.Temperature = common.GetPointer[float64](1.0)
+		}
+		info.UpstreamModelName = request.Model
+	} else if model_setting.GetClaudeSettings().ThinkingAdapterEnabled &&
+		strings.HasSuffix(request.Model, "-thinking") {
+		if request.Thinking == nil {
+			baseModel := strings.TrimSuffix(request.Model, "-thinking")
+			if isClaudeAdaptiveOnlyModel(baseModel) {
+				// Opus 4.7/4.8 reject thinking.type="enabled"; use adaptive at high effort.
+				request.Thinking = &dto.Thinking{Type: "adaptive", Display: "summarized"}
+				request.OutputConfig = json.RawMessage(`{"effort":"high"}`)
+				request.Temperature = nil
+				request.TopP = nil
+				request.TopK = nil
+			} else {
+				// 因为BudgetTokens 必须大于1024
+				if request.MaxTokens == nil || *request.MaxTokens < 1280 {
+					request.MaxTokens = common.GetPointer[uint](1280)
+				}
+
+				// BudgetTokens 为 max_tokens 按模型配置的比例，默认 80%
+				request.Thinking = &dto.Thinking{
+					Type:         "enabled",
+					BudgetTokens: common.GetPointer[int](int(float64(*request.MaxTokens) * model_setting.GetClaudeSettings().GetThinkingBudgetTokensPercentage(resolveClaudeModelAlias(baseModel)))),
+				}
+				// TODO: 临时处理
+				// https://docs.anthropic.com/en/docs/build-with-claude/extended-thinking#important-considerations-when-using-extended-thinking
+				request.Temperature = common.GetPointer[float64](1.0)
+			}
+		}
+		if !model_setting.ShouldPreserveThinkingSuffix(info.OriginModelName) {
+			request.Model = strings.TrimSuffix(request.Model, "-thinking")
+		}
+		info.UpstreamModelName = request.Model
+	}
+}
@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrependClaudeSystemPromptDeduplicates(t *testing.T) {
+	prompt := "You are a helpful assistant."
+	userSystem := dto.ClaudeMediaMessage{Type: dto.ContentTypeText}
+	userSystem.SetText("Answer in Chinese.")
+	duplicated := dto.ClaudeMediaMessage{Type: dto.ContentTypeText}
+	duplicated.SetText(prompt)
+
+	system := prependClaudeSystemPrompt([]dto.ClaudeMediaMessage{userSystem, duplicated}, prompt)
+
+	require.Len(t, system, 2)
+	assert.Equal(t, prompt, system[0].GetText())
+	assert.Equal(t, "Answer in Chinese.", system[1].GetText())
+}
+
+func TestPrependClaudeSystemPromptKeepsOtherBlocks(t *testing.T) {
+	userSystem := dto.ClaudeMediaMessage{Type: dto.ContentTypeText}
+	userSystem.SetText("Answer in Chinese.")
+
+	system := prependClaudeSystemPrompt([]dto.ClaudeMediaMessage{userSystem}, "You are a helpful assistant.")
+
+	require.Len(t, system, 2)
+	assert.Equal(t, "You are a helpful assistant.", system[0].GetText())
+	assert.Equal(t, "Answer in Chinese.", system[1].GetText())
+}
+
+func TestPrependClaudeSystemPromptKeepsCachedClientBlock(t *testing.T) {
+	prompt := "You are a helpful assistant."
+	userSystem := dto.ClaudeMediaMessage{Type: dto.ContentTypeText}
+	userSystem.SetText("Answer in Chinese.")
+	cached := dto.ClaudeMediaMessage{Type: dto.ContentTypeText, CacheControl: []byte(`{"type":"ephemeral"}`)}
+	cached.SetText(prompt)
+	duplicated := dto.ClaudeMediaMessage{Type: dto.ContentTypeText}
+	duplicated.SetText(prompt)
+
+	system := prependClaudeSystemPrompt([]dto.ClaudeMediaMessage{userSystem, cached, duplicated}, prompt)
+
+	require.Len(t, system, 2)
+	assert.Equal(t, "Answer in Chinese.", system[0].GetText())
+	assert.Equal(t, prompt, system[1].GetText())
+	assert.JSONEq(t, `{"type":"ephemeral"}`, string(system[1].CacheControl))
+}
+
+func TestApplyClaudeThinkingAdapterUsesResolvedModelAlias(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	originalAliases := settings.ModelAliases
+	settings.ModelAliases = map[string]string{"claude-smart": "claude-opus-4-7"}
+	t.Cleanup(func() { settings.ModelAliases = originalAliases })
+
+	info := &relaycommon.RelayInfo{
+		OriginModelName: "claude-smart-thinking",
+		ChannelMeta:     &relaycommon.ChannelMeta{},
+	}
+	request := &dto.ClaudeRequest{
+		Model:       "claude-smart-thinking",
+		MaxTokens:   common.GetPointer[uint](4096),
+		Temperature: common.GetPointer[float64](0.5),
+	}
+
+	applyClaudeThinkingAdapter(info, request)
+
+	// 别名指向 Opus 4.7，只能使用 adaptive thinking 且不能带 temperature
+	require.NotNil(t, request.Thinking)
+	assert.Equal(t, "adaptive", request.Thinking.Type)
+	assert.Nil(t, request.Temperature)
+	assert.JSONEq(t, `{"effort":"high"}`, string(request.OutputConfig))
+	// 别名由渠道转换时再替换为实际模型
+	assert.Equal(t, "claude-smart", request.Model)
+}
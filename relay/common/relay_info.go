@@ -107,6 +107,9 @@ type RelayInfo struct {
 	RequestHeaders         map[string]string
 	ShouldIncludeUsage     bool
 	DisablePing            bool // 是否禁止向下游发送自定义 Ping
+	// StreamIdlePingInterval 大于 0 时，下游连续该时长没有收到任何数据就发送一次 Ping（全局 Ping 开启时不生效）
+	StreamIdlePingInterval time.Duration
+	UpstreamTimeout        time.Duration // 大于 0 时覆盖本次上游请求的超时（默认为 RELAY_TIMEOUT），用于耗时较长的 thinking 请求
 	ClientWs               *websocket.Conn
 	TargetWs               *websocket.Conn
 	InputAudioFormat       string
@@ -111,6 +111,9 @@ func TextHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *types
 			return types.NewError(err, types.ErrorCodeConvertRequestFailed, types.ErrOptionWithSkipRetry())
 		}
 		relaycommon.AppendRequestConversionFromRequest(info, convertedRequest)
+		if openAIRequest, ok := convertedRequest.(*dto.GeneralOpenAIRequest); ok {
+			openAIRequest.StripNonUpstreamMessageFields()
+		}
 
 		if info.ChannelSetting.SystemPrompt != "" {
 			// 如果有系统提示，则将其添加到请求中
@@ -196,6 +196,53 @@ func StreamScannerHandler(c *gin.Context, resp *http.Response, info *relaycommon
 		})
 	}
 
+	// 空闲 Ping：上游长时间没有可下发的内容（如 thinking 阶段）时保持下游连接，已有数据写出的周期内不发送
+	if idlePingInterval := info.StreamIdlePingInterval; idlePingInterval > 0 && !pingEnabled && !info.DisablePing {
+		wg.Add(1)
+		gopool.Go(func() {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.LogError(c, fmt.Sprintf("idle ping goroutine panic: %v", r))
+					info.StreamStatus.SetEndReason(relaycommon.StreamEndReasonPanic, fmt.Errorf("idle ping panic: %v", r))
+					stop()
+				}
+				wg.Done()
+			}()
+
+			idleTicker := time.NewTicker(idlePingInterval)
+			defer idleTicker.Stop()
+			writeMutex.Lock()
+			lastSize := c.Writer.Size()
+			writeMutex.Unlock()
+			for {
+				select {
+				case <-idleTicker.C:
+					var err error
+					func() {
+						writeMutex.Lock()
+						defer writeMutex.Unlock()
+						if c.Writer.Size() == lastSize {
+							ExtendWriteDeadline(c)
+							err = PingData(c)
+						}
+						lastSize = c.Writer.Size()
+					}()
+					if err != nil {
+						logger.LogError(c, "idle ping data error: "+err.Error())
+						info.StreamStatus.SetEndReason(relaycommon.StreamEndReasonPingFail, err)
+						return
+					}
+				case <-ctx.Done():
+					return
+				case <-stopChan:
+					return
+				case <-c.Request.Context().Done():
+					return
+				}
+			}
+		})
+	}
+
 	dataChan := make(chan string, 10)
 
 	wg.Add(1)
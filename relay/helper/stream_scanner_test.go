@@ -571,3 +571,47 @@ func TestStreamScannerHandler_StreamStatus_ReplacesPreInitialized(t *testing.T)
 	assert.Equal(t, relaycommon.StreamEndReasonDone, info.StreamStatus.EndReason)
 	assert.Equal(t, 0, info.StreamStatus.TotalErrorCount())
 }
+
+func TestStreamScannerHandler_IdlePingOnlyDuringGaps(t *testing.T) {
+	pr, pw := io.Pipe()
+	go func() {
+		defer pw.Close()
+		// 长时间空闲后数据持续到达
+		time.Sleep(500 * time.Millisecond)
+		for i := 0; i < 10; i++ {
+			fmt.Fprintf(pw, "data: chunk_%d\n", i)
+			time.Sleep(30 * time.Millisecond)
+		}
+		fmt.Fprint(pw, "data: [DONE]\n")
+	}()
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	resp := &http.Response{Body: pr}
+	info := &relaycommon.RelayInfo{
+		ChannelMeta:            &relaycommon.ChannelMeta{},
+		StreamIdlePingInterval: 100 * time.Millisecond,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		StreamScannerHandler(c, resp, info, func(data string, sr *StreamResult) {
+			_ = StringData(c, data)
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for stream to finish")
+	}
+
+	body := recorder.Body.String()
+	firstChunk := strings.Index(body, "chunk_0")
+	require.Greater(t, firstChunk, 0)
+	assert.GreaterOrEqual(t, strings.Count(body[:firstChunk], ": PING"), 2, "expected pings during the idle gap")
+	assert.LessOrEqual(t, strings.Count(body[firstChunk:], ": PING"), 1, "pings should stop once data flows")
+}
@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/types"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRerankHelperReturnsUnsupportedErrorForClaudeChannel(t *testing.T) {
+	var upstreamHits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/rerank", nil)
+	common.SetContextKey(c, constant.ContextKeyChannelType, constant.ChannelTypeAnthropic)
+	common.SetContextKey(c, constant.ContextKeyChannelBaseUrl, upstream.URL)
+	common.SetContextKey(c, constant.ContextKeyOriginalModel, "claude-sonnet-4-5-20250929")
+
+	info := &relaycommon.RelayInfo{
+		OriginModelName: "claude-sonnet-4-5-20250929",
+		Request: &dto.RerankRequest{
+			Model:     "claude-sonnet-4-5-20250929",
+			Query:     "hello",
+			Documents: []any{"a", "b"},
+		},
+	}
+
+	apiErr := RerankHelper(c, info)
+	require.NotNil(t, apiErr)
+	assert.Equal(t, types.ErrorCodeModelNotSupported, apiErr.GetErrorCode())
+	assert.Equal(t, http.StatusNotImplemented, apiErr.StatusCode)
+	assert.False(t, types.IsSkipRetryError(apiErr))
+	assert.Zero(t, upstreamHits.Load())
+}
@@ -79,6 +79,11 @@ func SetRelayRouter(router *gin.Engine) {
 			controller.Relay(c, types.RelayFormatOpenAIRealtime)
 		})
 	}
+	{
+		// claude message batch 查询按提交时记录的渠道转发，不经过 Distribute
+		relayV1Router.GET("/messages/batches/:batch_id", controller.RetrieveClaudeMessageBatch)
+		relayV1Router.GET("/messages/batches/:batch_id/results", controller.GetClaudeMessageBatchResults)
+	}
 	{
 		//http router
 		httpRouter := relayV1Router.Group("")
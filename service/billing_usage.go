@@ -19,6 +19,8 @@ const (
 
 func effectiveBillingUsage(usage *dto.Usage) *dto.Usage {
 	if billingUsage, ok := usageFromBillingUsage(usage); ok {
+		// 工具调用次数不在 BillingUsage 中，需要从原始 usage 带过来
+		billingUsage.WebSearchRequests = usage.WebSearchRequests
 		return billingUsage
 	}
 	return usage
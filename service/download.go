@@ -2,6 +2,7 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -22,6 +23,11 @@ type WorkerRequest struct {
 
 // DoWorkerRequest 通过Worker发送请求
 func DoWorkerRequest(req *WorkerRequest) (*http.Response, error) {
+	return DoWorkerRequestContext(context.Background(), req)
+}
+
+// DoWorkerRequestContext 通过Worker发送请求，ctx 取消时中断请求
+func DoWorkerRequestContext(ctx context.Context, req *WorkerRequest) (*http.Response, error) {
 	if !system_setting.EnableWorker() {
 		return nil, fmt.Errorf("worker not enabled")
 	}
@@ -46,17 +52,27 @@ func DoWorkerRequest(req *WorkerRequest) (*http.Response, error) {
 		return nil, fmt.Errorf("failed to marshal worker payload: %v", err)
 	}
 
-	return GetHttpClient().Post(workerUrl, "application/json", bytes.NewBuffer(workerPayload))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, workerUrl, bytes.NewBuffer(workerPayload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create worker request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	return GetHttpClient().Do(httpReq)
 }
 
 func DoDownloadRequest(originUrl string, reason ...string) (resp *http.Response, err error) {
+	return DoDownloadRequestContext(context.Background(), originUrl, reason...)
+}
+
+// DoDownloadRequestContext 下载远程文件，ctx 取消时中断下载
+func DoDownloadRequestContext(ctx context.Context, originUrl string, reason ...string) (resp *http.Response, err error) {
 	if system_setting.EnableWorker() {
 		common.SysLog(fmt.Sprintf("downloading file from worker: %s, reason: %s", originUrl, strings.Join(reason, ", ")))
 		req := &WorkerRequest{
 			URL: originUrl,
 			Key: system_setting.WorkerValidKey,
 		}
-		return DoWorkerRequest(req)
+		return DoWorkerRequestContext(ctx, req)
 	} else {
 		// SSRF防护：验证请求URL（非Worker模式）
 		if err := ValidateSSRFProtectedFetchURL(originUrl); err != nil {
@@ -64,6 +80,10 @@ func DoDownloadRequest(originUrl string, reason ...string) (resp *http.Response,
 		}
 
 		common.SysLog(fmt.Sprintf("downloading from origin: %s, reason: %s", common.MaskSensitiveInfo(originUrl), strings.Join(reason, ", ")))
-		return GetSSRFProtectedHTTPClient().Get(originUrl)
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, originUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		return GetSSRFProtectedHTTPClient().Do(httpReq)
 	}
 }
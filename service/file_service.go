@@ -2,6 +2,7 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/constant"
@@ -45,6 +47,11 @@ func getBase64ContextCacheKey(data string, mimeType string) string {
 // LoadFileSource 加载文件源数据
 // 这是统一的入口，会自动处理缓存和不同的来源类型
 func LoadFileSource(c *gin.Context, source types.FileSource, reason ...string) (*types.CachedFileData, error) {
+	return loadFileSource(context.Background(), c, source, 0, reason...)
+}
+
+// loadFileSource 加载文件源数据，远程下载随 ctx 取消；maxBytes 大于 0 时超过该大小的远程文件直接拒绝
+func loadFileSource(ctx context.Context, c *gin.Context, source types.FileSource, maxBytes int64, reason ...string) (*types.CachedFileData, error) {
 	if source == nil {
 		return nil, fmt.Errorf("file source is nil")
 	}
@@ -89,7 +96,14 @@ func LoadFileSource(c *gin.Context, source types.FileSource, reason ...string) (
 				return data, nil
 			}
 		}
-		cachedData, err = loadFromURL(c, s.URL, reason...)
+		if data, ok := loadFileFromUrlCache(s.URL); ok {
+			cachedData = data
+			break
+		}
+		cachedData, err = loadFromURL(ctx, c, s.URL, maxBytes, reason...)
+		if err == nil {
+			storeFileToUrlCache(s.URL, cachedData)
+		}
 	case *types.Base64Source:
 		if c != nil {
 			contextKey = getBase64ContextCacheKey(s.Base64Data, s.MimeType)
@@ -123,8 +137,13 @@ func LoadFileSource(c *gin.Context, source types.FileSource, reason ...string) (
 	return cachedData, nil
 }
 
+// fileSourceCleanupMu 保护清理列表的读-追加-写，同一请求内可能并发加载多个文件
+var fileSourceCleanupMu sync.Mutex
+
 // registerSourceForCleanup 注册 FileSource 到 context 以便请求结束时清理
 func registerSourceForCleanup(c *gin.Context, source types.FileSource) {
+	fileSourceCleanupMu.Lock()
+	defer fileSourceCleanupMu.Unlock()
 	if source.IsRegistered() {
 		return
 	}
@@ -154,14 +173,14 @@ func CleanupFileSources(c *gin.Context) {
 }
 
 // loadFromURL 从 URL 加载文件
-func loadFromURL(c *gin.Context, url string, reason ...string) (*types.CachedFileData, error) {
+func loadFromURL(ctx context.Context, c *gin.Context, url string, maxBytes int64, reason ...string) (*types.CachedFileData, error) {
 	// 下载文件
 	var maxFileSize = constant.MaxFileDownloadMB * 1024 * 1024
 
 	if common.DebugEnabled {
 		logger.LogDebug(c, "loadFromURL: initiating download")
 	}
-	resp, err := DoDownloadRequest(url, reason...)
+	resp, err := DoDownloadRequestContext(ctx, url, reason...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to download file from %s: %w", url, err)
 	}
@@ -170,6 +189,10 @@ func loadFromURL(c *gin.Context, url string, reason ...string) (*types.CachedFil
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("failed to download file, status code: %d", resp.StatusCode)
 	}
+	// 按声明的 Content-Length 提前拒绝，避免读取注定超限的响应体
+	if maxBytes > 0 && resp.ContentLength > maxBytes {
+		return nil, fmt.Errorf("%w: file declares %d bytes, at most %d bytes allowed", common.ErrRequestBodyTooLarge, resp.ContentLength, maxBytes)
+	}
 
 	// 读取文件内容（限制大小）
 	if common.DebugEnabled {
@@ -182,6 +205,9 @@ func loadFromURL(c *gin.Context, url string, reason ...string) (*types.CachedFil
 	if len(fileBytes) > maxFileSize {
 		return nil, fmt.Errorf("file size exceeds maximum allowed size: %dMB", constant.MaxFileDownloadMB)
 	}
+	if maxBytes > 0 && int64(len(fileBytes)) > maxBytes {
+		return nil, fmt.Errorf("%w: file has %d bytes, at most %d bytes allowed", common.ErrRequestBodyTooLarge, len(fileBytes), maxBytes)
+	}
 
 	// 转换为 base64
 	base64Data := base64.StdEncoding.EncodeToString(fileBytes)
@@ -427,6 +453,20 @@ func GetBase64Data(c *gin.Context, source types.FileSource, reason ...string) (s
 	return base64Str, cachedData.MimeType, nil
 }
 
+// GetBase64DataWithLimit 与 GetBase64Data 相同，但远程下载随 ctx 取消，
+// 文件超过 maxBytes（大于 0 时生效）时返回 common.ErrRequestBodyTooLarge
+func GetBase64DataWithLimit(ctx context.Context, c *gin.Context, source types.FileSource, maxBytes int64, reason ...string) (string, string, error) {
+	cachedData, err := loadFileSource(ctx, c, source, maxBytes, reason...)
+	if err != nil {
+		return "", "", err
+	}
+	base64Str, err := cachedData.GetBase64Data()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get base64 data: %w", err)
+	}
+	return base64Str, cachedData.MimeType, nil
+}
+
 // GetMimeType 获取文件的 MIME 类型
 func GetMimeType(c *gin.Context, source types.FileSource) (string, error) {
 	if source.HasCache() {
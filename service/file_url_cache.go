@@ -0,0 +1,102 @@
+package service
+
+import (
+	"image"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/types"
+	"github.com/samber/hot"
+)
+
+// fileUrlCacheEntry 保存远程文件的副本而不是 *types.CachedFileData，
+// 后者在请求结束时会被 CleanupFileSources 关闭，不能跨请求共享
+type fileUrlCacheEntry struct {
+	base64Data  string
+	mimeType    string
+	size        int64
+	imageConfig *image.Config
+	imageFormat string
+}
+
+type FileUrlCacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+var (
+	fileUrlCacheOnce   sync.Once
+	fileUrlCache       *hot.HotCache[string, fileUrlCacheEntry]
+	fileUrlCacheHits   atomic.Int64
+	fileUrlCacheMisses atomic.Int64
+)
+
+// getFileUrlCache 返回进程级的远程文件 LRU 缓存，未启用时返回 nil
+func getFileUrlCache() *hot.HotCache[string, fileUrlCacheEntry] {
+	fileUrlCacheOnce.Do(func() {
+		if constant.FileUrlCacheMaxEntries <= 0 {
+			return
+		}
+		ttlSeconds := constant.FileUrlCacheTTLSeconds
+		if ttlSeconds <= 0 {
+			ttlSeconds = 600
+		}
+		fileUrlCache = hot.NewHotCache[string, fileUrlCacheEntry](hot.LRU, constant.FileUrlCacheMaxEntries).
+			WithTTL(time.Duration(ttlSeconds) * time.Second).
+			WithJanitor().
+			Build()
+	})
+	return fileUrlCache
+}
+
+func loadFileFromUrlCache(url string) (*types.CachedFileData, bool) {
+	cache := getFileUrlCache()
+	if cache == nil {
+		return nil, false
+	}
+	entry, found, err := cache.Get(url)
+	if err != nil || !found {
+		fileUrlCacheMisses.Add(1)
+		return nil, false
+	}
+	fileUrlCacheHits.Add(1)
+	data := types.NewMemoryCachedData(entry.base64Data, entry.mimeType, entry.size)
+	data.ImageConfig = entry.imageConfig
+	data.ImageFormat = entry.imageFormat
+	return data, true
+}
+
+// storeFileToUrlCache 只缓存内存模式的文件，落盘的大文件不进入进程缓存，以此限制缓存占用
+func storeFileToUrlCache(url string, data *types.CachedFileData) {
+	cache := getFileUrlCache()
+	if cache == nil || data == nil || data.IsDisk() {
+		return
+	}
+	base64Data, err := data.GetBase64Data()
+	if err != nil {
+		return
+	}
+	cache.Set(url, fileUrlCacheEntry{
+		base64Data:  base64Data,
+		mimeType:    data.MimeType,
+		size:        data.Size,
+		imageConfig: data.ImageConfig,
+		imageFormat: data.ImageFormat,
+	})
+}
+
+// GetFileUrlCacheStats 返回远程文件缓存的命中/未命中次数
+func GetFileUrlCacheStats() FileUrlCacheStats {
+	return FileUrlCacheStats{
+		Hits:   fileUrlCacheHits.Load(),
+		Misses: fileUrlCacheMisses.Load(),
+	}
+}
+
+// ResetFileUrlCacheStats 重置远程文件缓存的命中统计
+func ResetFileUrlCacheStats() {
+	fileUrlCacheHits.Store(0)
+	fileUrlCacheMisses.Store(0)
+}
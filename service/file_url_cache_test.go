@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/setting/system_setting"
+	"github.com/QuantumNous/new-api/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadFileSourceReusesProcessUrlCache(t *testing.T) {
+	InitHttpClient()
+	fetchSetting := system_setting.GetFetchSetting()
+	originalSSRF := fetchSetting.EnableSSRFProtection
+	fetchSetting.EnableSSRFProtection = false
+	originalMaxEntries := constant.FileUrlCacheMaxEntries
+	constant.FileUrlCacheMaxEntries = 16
+	originalMaxDownloadMB := constant.MaxFileDownloadMB
+	constant.MaxFileDownloadMB = 1
+	fileUrlCacheOnce = sync.Once{}
+	fileUrlCache = nil
+	ResetFileUrlCacheStats()
+	t.Cleanup(func() {
+		fetchSetting.EnableSSRFProtection = originalSSRF
+		constant.FileUrlCacheMaxEntries = originalMaxEntries
+		constant.MaxFileDownloadMB = originalMaxDownloadMB
+		fileUrlCacheOnce = sync.Once{}
+		fileUrlCache = nil
+		ResetFileUrlCacheStats()
+	})
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("fake-png"))
+	}))
+	defer server.Close()
+
+	first, err := LoadFileSource(nil, types.NewURLFileSource(server.URL+"/a.png"))
+	require.NoError(t, err)
+	firstData, err := first.GetBase64Data()
+	require.NoError(t, err)
+	// 模拟请求结束时的清理，缓存中的副本不受影响
+	require.NoError(t, first.Close())
+
+	second, err := LoadFileSource(nil, types.NewURLFileSource(server.URL+"/a.png"))
+	require.NoError(t, err)
+	secondData, err := second.GetBase64Data()
+	require.NoError(t, err)
+
+	assert.Equal(t, int32(1), requests.Load())
+	assert.Equal(t, firstData, secondData)
+	assert.Equal(t, "image/png", second.MimeType)
+	assert.Equal(t, FileUrlCacheStats{Hits: 1, Misses: 1}, GetFileUrlCacheStats())
+}
+
+func TestGetBase64DataWithLimitRejectsByContentLength(t *testing.T) {
+	InitHttpClient()
+	fetchSetting := system_setting.GetFetchSetting()
+	originalSSRF := fetchSetting.EnableSSRFProtection
+	fetchSetting.EnableSSRFProtection = false
+	t.Cleanup(func() { fetchSetting.EnableSSRFProtection = originalSSRF })
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", "4096")
+		_, _ = w.Write(make([]byte, 4096))
+	}))
+	defer server.Close()
+
+	_, _, err := GetBase64DataWithLimit(context.Background(), nil, types.NewURLFileSource(server.URL+"/big.png"), 1024)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, common.ErrRequestBodyTooLarge)
+}
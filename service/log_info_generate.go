@@ -86,6 +86,9 @@ func GenerateTextOtherInfo(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, m
 		other["is_model_mapped"] = true
 		other["upstream_model_name"] = relayInfo.UpstreamModelName
 	}
+	if resolvedModel := common.GetContextKeyString(ctx, constant.ContextKeyResolvedUpstreamModel); resolvedModel != "" && resolvedModel != relayInfo.OriginModelName {
+		other["resolved_upstream_model"] = resolvedModel
+	}
 
 	isSystemPromptOverwritten := common.GetContextKeyBool(ctx, constant.ContextKeySystemPromptOverride)
 	if isSystemPromptOverwritten {
@@ -94,6 +97,10 @@ func GenerateTextOtherInfo(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, m
 
 	adminInfo := make(map[string]interface{})
 	adminInfo["use_channel"] = ctx.GetStringSlice("use_channel")
+	// 多地址渠道排查问题时需要知道实际请求的上游地址，只对管理员可见
+	if relayInfo.ChannelMeta != nil && relayInfo.ChannelBaseUrl != "" {
+		adminInfo["channel_base_url"] = relayInfo.ChannelBaseUrl
+	}
 	isMultiKey := common.GetContextKeyBool(ctx, constant.ContextKeyChannelIsMultiKey)
 	if isMultiKey {
 		adminInfo["is_multi_key"] = true
@@ -2,16 +2,22 @@ package claudemessages
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/dto"
 	"github.com/QuantumNous/new-api/relay/reasonmap"
 	sharedclaude "github.com/QuantumNous/new-api/service/relayconvert/internal/shared/claude"
+	"github.com/QuantumNous/new-api/setting/model_setting"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 )
 
+// redacted_thinking 的内容是加密的，转换为 OpenAI 格式时用占位符表示
+const redactedThinkingPlaceholder = "[redacted]"
+
 type ClaudeResponseInfo struct {
 	ResponseId   string
 	Created      int64
@@ -19,6 +25,51 @@ type ClaudeResponseInfo struct {
 	ResponseText strings.Builder
 	Usage        *dto.Usage
 	Done         bool
+	// 上游响应头中的 request-id，出错时写入错误的 Metadata，便于向 Anthropic 反馈
+	UpstreamRequestId string
+	// 流式增量用量的估算进度：已估算的 ResponseText 字节数、对应的输出 token 数，以及上次下发用量时的 token 数
+	PartialUsageTextBytes int
+	PartialUsageTokens    int
+	PartialUsageReported  int
+	// Claude 的 index 是 content block 序号，这里记录 block 序号到 OpenAI tool_calls 序号的映射
+	toolCallIndexes map[int]int
+	// 已输出正文的字符数及各 text block 在正文中的字符区间，用于计算引用的 start/end_index
+	contentLength    int
+	textBlockRanges  map[int][2]int
+	pendingCitations []pendingClaudeCitation
+	// 各 tool_use block 已下发的 arguments 与尚未凑成完整 UTF-8 字符的尾部字节，结束时据此校验并补全 JSON
+	toolArguments map[int]*claudeToolArguments
+	// response_format json_schema 合成工具所在的 block 序号，其参数作为正文下发
+	responseFormatBlocks map[int]bool
+	// 尚未结束的 thinking block 序号，inline_tags 模式下在 content_block_stop 时输出闭合标签
+	thinkingBlocks map[int]bool
+}
+
+type claudeToolArguments struct {
+	emitted strings.Builder
+	pending string
+}
+
+type pendingClaudeCitation struct {
+	blockIndex int
+	citation   dto.ClaudeCitation
+}
+
+// claudeCitationToAnnotation 把 Claude 的联网搜索引用转换为 OpenAI 的 url_citation，
+// 没有 url 的引用（如文档引用）不转换
+func claudeCitationToAnnotation(citation dto.ClaudeCitation, startIndex int, endIndex int) (dto.ChatCompletionAnnotation, bool) {
+	if citation.Url == "" {
+		return dto.ChatCompletionAnnotation{}, false
+	}
+	return dto.ChatCompletionAnnotation{
+		Type: "url_citation",
+		UrlCitation: &dto.ChatCompletionUrlCitation{
+			StartIndex: startIndex,
+			EndIndex:   endIndex,
+			Title:      citation.Title,
+			Url:        citation.Url,
+		},
+	}, true
 }
 
 func StopReasonClaudeToOpenAI(reason string) string {
@@ -48,6 +99,9 @@ func StreamResponseClaude2OpenAI(claudeResponse *dto.ClaudeResponse) *dto.ChatCo
 			if claudeResponse.ContentBlock.Type == "text" && claudeResponse.ContentBlock.Text != nil {
 				choice.Delta.SetContentString(*claudeResponse.ContentBlock.Text)
 			}
+			if claudeResponse.ContentBlock.Type == "redacted_thinking" {
+				choice.Delta.ReasoningContent = common.GetPointer(redactedThinkingPlaceholder)
+			}
 			if claudeResponse.ContentBlock.Type == "tool_use" {
 				tools = append(tools, dto.ToolCallResponse{
 					Index: common.GetPointer(fcIdx),
@@ -75,8 +129,11 @@ func StreamResponseClaude2OpenAI(claudeResponse *dto.ClaudeResponse) *dto.ChatCo
 					},
 				})
 			case "signature_delta":
-				signatureContent := "\n"
-				choice.Delta.ReasoningContent = &signatureContent
+				choice.Delta.ReasoningContentSignature = common.GetPointer(claudeResponse.Delta.Signature)
+				if model_setting.GetClaudeSettings().ThinkingSignatureNewlineEnabled {
+					signatureContent := "\n"
+					choice.Delta.ReasoningContent = &signatureContent
+				}
 			case "thinking_delta":
 				choice.Delta.ReasoningContent = claudeResponse.Delta.Thinking
 			}
@@ -87,21 +144,64 @@ func StreamResponseClaude2OpenAI(claudeResponse *dto.ClaudeResponse) *dto.ChatCo
 			if finishReason != "null" {
 				choice.FinishReason = &finishReason
 			}
+			if claudeResponse.Delta.StopSequence != nil && *claudeResponse.Delta.StopSequence != "" {
+				choice.StopSequence = claudeResponse.Delta.StopSequence
+			}
 		}
+	} else if claudeResponse.Type == "content_block_stop" {
+		// inline_tags 模式下 thinking block 在此输出闭合标签，是否为 thinking block 由 FormatClaudeResponseInfo 判断
+		if model_setting.GetClaudeSettings().GetThinkingOutputMode() != model_setting.ThinkingOutputModeInlineTags {
+			return nil
+		}
+		response.Choices = append(response.Choices, choice)
+		return &response
 	} else if claudeResponse.Type == "message_stop" {
 		return nil
 	} else {
 		return nil
 	}
 	if len(tools) > 0 {
-		choice.Delta.Content = nil
+		// 只清掉本 chunk 的空正文，同一 chunk 里真正带出的文本要和 tool_calls 一起下发
+		if choice.Delta.Content != nil && *choice.Delta.Content == "" {
+			choice.Delta.Content = nil
+		}
 		choice.Delta.ToolCalls = tools
 	}
+	if !applyStreamThinkingOutputMode(claudeResponse, &choice) {
+		return nil
+	}
 	response.Choices = append(response.Choices, choice)
 
 	return &response
 }
 
+// applyStreamThinkingOutputMode 按 ThinkingOutputMode 调整流式 chunk 中的思考内容，返回 false 表示调整后没有需要下发的内容
+func applyStreamThinkingOutputMode(claudeResponse *dto.ClaudeResponse, choice *dto.ChatCompletionsStreamResponseChoice) bool {
+	mode := model_setting.GetClaudeSettings().GetThinkingOutputMode()
+	if mode == model_setting.ThinkingOutputModeReasoningField {
+		return true
+	}
+	delta := &choice.Delta
+	if mode == model_setting.ThinkingOutputModeInlineTags {
+		// thinking block 的闭合标签在 content_block_stop 时由 FormatClaudeResponseInfo 输出
+		switch {
+		case claudeResponse.Type == "content_block_start" && claudeResponse.ContentBlock.Type == "thinking":
+			delta.SetContentString("<thinking>")
+		case claudeResponse.Type == "content_block_start" && claudeResponse.ContentBlock.Type == "redacted_thinking":
+			delta.SetContentString("<thinking>" + redactedThinkingPlaceholder + "</thinking>\n")
+		case claudeResponse.Type == "content_block_delta" && claudeResponse.Delta != nil && claudeResponse.Delta.Type == "signature_delta":
+		case claudeResponse.Type == "content_block_delta" && delta.ReasoningContent != nil:
+			delta.SetContentString(*delta.ReasoningContent)
+		}
+	}
+	delta.ReasoningContent = nil
+	delta.Reasoning = nil
+	delta.ReasoningContentSignature = nil
+	// message_delta 总是下发，FormatClaudeResponseInfo 会在其上补发引用与 tool_calls 参数修正
+	return delta.Content != nil || delta.Role != "" || len(delta.ToolCalls) > 0 || len(delta.Annotations) > 0 ||
+		choice.FinishReason != nil || claudeResponse.Type == "message_delta"
+}
+
 func ResponseClaude2OpenAI(claudeResponse *dto.ClaudeResponse) *dto.OpenAITextResponse {
 	choices := make([]dto.OpenAITextResponseChoice, 0)
 	fullTextResponse := dto.OpenAITextResponse{
@@ -119,12 +219,22 @@ func ResponseClaude2OpenAI(claudeResponse *dto.ClaudeResponse) *dto.OpenAITextRe
 	}
 	tools := make([]dto.ToolCallResponse, 0)
 	thinkingContent := ""
+	// 联网搜索时正文会被拆成多个 text block，需要拼接后才能计算引用区间
+	var textContent strings.Builder
+	hasTextBlock := false
+	var annotations []dto.ChatCompletionAnnotation
 
 	fullTextResponse.Id = claudeResponse.Id
 	for _, message := range claudeResponse.Content {
 		switch message.Type {
 		case "tool_use":
 			args, _ := common.Marshal(message.Input)
+			if message.Name == sharedclaude.ResponseFormatToolName {
+				// response_format json_schema 的合成工具，参数即结构化输出
+				hasTextBlock = true
+				textContent.Write(args)
+				continue
+			}
 			tools = append(tools, dto.ToolCallResponse{
 				ID:   message.Id,
 				Type: "function",
@@ -135,12 +245,49 @@ func ResponseClaude2OpenAI(claudeResponse *dto.ClaudeResponse) *dto.OpenAITextRe
 			})
 		case "thinking":
 			if message.Thinking != nil {
-				thinkingContent = *message.Thinking
+				thinkingContent += *message.Thinking
 			}
+		case "redacted_thinking":
+			thinkingContent += redactedThinkingPlaceholder
 		case "text":
-			responseText = message.GetText()
+			hasTextBlock = true
+			startIndex := utf8.RuneCountInString(textContent.String())
+			textContent.WriteString(message.GetText())
+			if len(message.Citations) == 0 {
+				continue
+			}
+			var citations []dto.ClaudeCitation
+			if err := common.Unmarshal(message.Citations, &citations); err != nil {
+				common.SysError(fmt.Sprintf("failed to parse claude citations: %v", err))
+				continue
+			}
+			endIndex := utf8.RuneCountInString(textContent.String())
+			for _, citation := range citations {
+				if annotation, ok := claudeCitationToAnnotation(citation, startIndex, endIndex); ok {
+					annotations = append(annotations, annotation)
+				}
+			}
+		case "code_execution_tool_result", "bash_code_execution_tool_result":
+			// 代码执行结果没有对应的 OpenAI 结构，把输出拼进正文，避免客户端开启该工具后结果被丢弃
+			if output := claudeCodeExecutionResultText(message.Content); output != "" {
+				hasTextBlock = true
+				textContent.WriteString(output)
+			}
+		case "server_tool_use", "web_search_tool_result":
+			// 服务端工具调用过程不需要透出，用量在 usage.server_tool_use 中统计
+		default:
+			if common.DebugEnabled {
+				common.SysLog(fmt.Sprintf("unsupported claude content block type: %s", message.Type))
+			}
+			if text := message.GetText(); text != "" {
+				hasTextBlock = true
+				textContent.WriteString(text)
+			}
 		}
 	}
+	if hasTextBlock {
+		responseText = textContent.String()
+	}
 	choice := dto.OpenAITextResponseChoice{
 		Index: 0,
 		Message: dto.Message{
@@ -148,6 +295,13 @@ func ResponseClaude2OpenAI(claudeResponse *dto.ClaudeResponse) *dto.OpenAITextRe
 		},
 		FinishReason: StopReasonClaudeToOpenAI(claudeResponse.StopReason),
 	}
+	if len(tools) == 0 && claudeResponse.StopReason == "tool_use" {
+		// 只调用了 response_format 合成工具时，对客户端而言是正常结束
+		choice.FinishReason = "stop"
+	}
+	if claudeResponse.StopSequence != nil && *claudeResponse.StopSequence != "" {
+		choice.StopSequence = claudeResponse.StopSequence
+	}
 	choice.SetStringContent(responseText)
 	if len(responseThinking) > 0 {
 		choice.ReasoningContent = &responseThinking
@@ -155,15 +309,74 @@ func ResponseClaude2OpenAI(claudeResponse *dto.ClaudeResponse) *dto.OpenAITextRe
 	if len(tools) > 0 {
 		choice.Message.SetToolCalls(tools)
 	}
+	if len(annotations) > 0 {
+		choice.Message.Annotations = annotations
+	}
 	if thinkingContent != "" {
 		choice.Message.ReasoningContent = &thinkingContent
 	}
+	switch model_setting.GetClaudeSettings().GetThinkingOutputMode() {
+	case model_setting.ThinkingOutputModeInlineTags:
+		if choice.Message.ReasoningContent != nil {
+			choice.SetStringContent("<thinking>" + *choice.Message.ReasoningContent + "</thinking>\n" + responseText)
+		}
+		choice.Message.ReasoningContent = nil
+	case model_setting.ThinkingOutputModeOmit:
+		choice.Message.ReasoningContent = nil
+	}
 	fullTextResponse.Model = claudeResponse.Model
 	choices = append(choices, choice)
 	fullTextResponse.Choices = choices
 	return &fullTextResponse
 }
 
+type claudeCodeExecutionResult struct {
+	Type       string `json:"type"`
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr"`
+	ReturnCode *int   `json:"return_code"`
+	ErrorCode  string `json:"error_code"`
+}
+
+// claudeCodeExecutionResultText 把 code_execution_tool_result 的内容整理成纯文本
+func claudeCodeExecutionResultText(content any) string {
+	if content == nil {
+		return ""
+	}
+	raw, err := common.Marshal(content)
+	if err != nil {
+		return ""
+	}
+	var result claudeCodeExecutionResult
+	if err := common.Unmarshal(raw, &result); err != nil {
+		return ""
+	}
+	if result.ErrorCode != "" {
+		return fmt.Sprintf("\n[code execution error: %s]\n", result.ErrorCode)
+	}
+	var builder strings.Builder
+	if result.Stdout != "" {
+		builder.WriteString("\n```\n")
+		builder.WriteString(result.Stdout)
+		if !strings.HasSuffix(result.Stdout, "\n") {
+			builder.WriteString("\n")
+		}
+		builder.WriteString("```\n")
+	}
+	if result.Stderr != "" {
+		builder.WriteString("\nstderr:\n```\n")
+		builder.WriteString(result.Stderr)
+		if !strings.HasSuffix(result.Stderr, "\n") {
+			builder.WriteString("\n")
+		}
+		builder.WriteString("```\n")
+	}
+	if result.ReturnCode != nil && *result.ReturnCode != 0 {
+		builder.WriteString(fmt.Sprintf("\n[return code: %d]\n", *result.ReturnCode))
+	}
+	return builder.String()
+}
+
 func UsageFromClaudeAPIUsage(usage *dto.ClaudeUsage) *dto.Usage {
 	if usage == nil {
 		return &dto.Usage{}
@@ -215,6 +428,12 @@ func buildOpenAIStyleUsageFromClaudeUsage(usage *dto.Usage) dto.Usage {
 		usage.ClaudeCacheCreation5mTokens,
 		usage.ClaudeCacheCreation1hTokens,
 	)
+	if clone.ClaudeCacheCreation5mTokens > 0 || clone.ClaudeCacheCreation1hTokens > 0 {
+		clone.CacheCreation = &dto.ClaudeCacheCreationUsage{
+			Ephemeral5mInputTokens: clone.ClaudeCacheCreation5mTokens,
+			Ephemeral1hInputTokens: clone.ClaudeCacheCreation1hTokens,
+		}
+	}
 	cacheCreationTokens := cacheCreationTokensForOpenAIUsage(usage)
 	// Expose the standard OpenAI cache-write field alongside the legacy
 	// cached_creation_tokens so OpenAI-format clients can bill cache writes.
@@ -271,6 +490,15 @@ func BuildMessageDeltaPatchUsage(claudeResponse *dto.ClaudeResponse, claudeInfo
 	return usage
 }
 
+// accumulateClaudeWebSearchRequests 记录流中出现的 web_search_requests。
+// message_delta 中的 usage 是累计值，取最大值而不是相加，避免重复计费
+func accumulateClaudeWebSearchRequests(usage *dto.Usage, claudeUsage *dto.ClaudeUsage) {
+	if claudeUsage.ServerToolUse == nil {
+		return
+	}
+	usage.WebSearchRequests = max(usage.WebSearchRequests, claudeUsage.ServerToolUse.WebSearchRequests)
+}
+
 func claudeBillingUsageFromSemanticUsage(usage *dto.Usage) *dto.BillingUsage {
 	if usage == nil {
 		return nil
@@ -337,8 +565,11 @@ func FormatClaudeResponseInfo(claudeResponse *dto.ClaudeResponse, oaiResponse *d
 		claudeInfo.Usage = &dto.Usage{}
 	}
 	if claudeResponse.Type == "message_start" {
-		if claudeResponse.Message != nil {
+		// 部分代理会下发空的 message 字段，此时保留调用方预置的 id 与模型名，保证各 chunk 一致
+		if claudeResponse.Message != nil && claudeResponse.Message.Id != "" {
 			claudeInfo.ResponseId = claudeResponse.Message.Id
+		}
+		if claudeResponse.Message != nil && claudeResponse.Message.Model != "" {
 			claudeInfo.Model = claudeResponse.Message.Model
 		}
 
@@ -351,11 +582,21 @@ func FormatClaudeResponseInfo(claudeResponse *dto.ClaudeResponse, oaiResponse *d
 			claudeInfo.Usage.ClaudeCacheCreation1hTokens = claudeResponse.Message.Usage.GetCacheCreation1hTokens()
 			claudeInfo.Usage.CompletionTokens = claudeResponse.Message.Usage.OutputTokens
 			claudeInfo.Usage.BillingUsage = claudeBillingUsageFromSemanticUsage(claudeInfo.Usage)
+			accumulateClaudeWebSearchRequests(claudeInfo.Usage, claudeResponse.Message.Usage)
 		}
 	} else if claudeResponse.Type == "content_block_delta" {
 		if claudeResponse.Delta != nil {
 			if claudeResponse.Delta.Text != nil {
-				claudeInfo.ResponseText.WriteString(*claudeResponse.Delta.Text)
+				claudeInfo.writeContent(claudeResponse.GetIndex(), *claudeResponse.Delta.Text)
+			}
+			if claudeInfo.isResponseFormatDelta(claudeResponse) {
+				claudeInfo.writeContent(claudeResponse.GetIndex(), *claudeResponse.Delta.PartialJson)
+			}
+			if claudeResponse.Delta.Type == "citations_delta" && claudeResponse.Delta.Citation != nil {
+				claudeInfo.pendingCitations = append(claudeInfo.pendingCitations, pendingClaudeCitation{
+					blockIndex: claudeResponse.GetIndex(),
+					citation:   *claudeResponse.Delta.Citation,
+				})
 			}
 			if claudeResponse.Delta.Thinking != nil {
 				claudeInfo.ResponseText.WriteString(*claudeResponse.Delta.Thinking)
@@ -384,17 +625,222 @@ func FormatClaudeResponseInfo(claudeResponse *dto.ClaudeResponse, oaiResponse *d
 			}
 			claudeInfo.Usage.TotalTokens = claudeInfo.Usage.PromptTokens + claudeInfo.Usage.CompletionTokens
 			claudeInfo.Usage.BillingUsage = claudeBillingUsageFromSemanticUsage(claudeInfo.Usage)
+			accumulateClaudeWebSearchRequests(claudeInfo.Usage, claudeResponse.Usage)
 		}
 
 		claudeInfo.Done = true
 	} else if claudeResponse.Type == "content_block_start" {
+		if claudeResponse.ContentBlock != nil && claudeResponse.ContentBlock.Type == "tool_use" &&
+			claudeResponse.ContentBlock.Name == sharedclaude.ResponseFormatToolName {
+			// response_format json_schema 的合成工具不作为 tool_calls 下发，也不占用 tool_calls 序号
+			if claudeInfo.responseFormatBlocks == nil {
+				claudeInfo.responseFormatBlocks = make(map[int]bool)
+			}
+			claudeInfo.responseFormatBlocks[claudeResponse.GetIndex()] = true
+			return false
+		}
+		if claudeResponse.ContentBlock != nil && claudeResponse.ContentBlock.Type == "tool_use" {
+			if claudeInfo.toolCallIndexes == nil {
+				claudeInfo.toolCallIndexes = make(map[int]int)
+			}
+			claudeInfo.toolCallIndexes[claudeResponse.GetIndex()] = len(claudeInfo.toolCallIndexes)
+			if claudeInfo.toolArguments == nil {
+				claudeInfo.toolArguments = make(map[int]*claudeToolArguments)
+			}
+			claudeInfo.toolArguments[claudeResponse.GetIndex()] = &claudeToolArguments{}
+		}
+		if claudeResponse.ContentBlock != nil && claudeResponse.ContentBlock.Type == "thinking" {
+			if claudeInfo.thinkingBlocks == nil {
+				claudeInfo.thinkingBlocks = make(map[int]bool)
+			}
+			claudeInfo.thinkingBlocks[claudeResponse.GetIndex()] = true
+		}
+	} else if claudeResponse.Type == "content_block_stop" {
+		thinking := claudeInfo.thinkingBlocks[claudeResponse.GetIndex()]
+		delete(claudeInfo.thinkingBlocks, claudeResponse.GetIndex())
+		if !thinking || oaiResponse == nil || len(oaiResponse.Choices) == 0 {
+			return false
+		}
+		oaiResponse.Choices[0].Delta.SetContentString("</thinking>\n")
 	} else {
 		return false
 	}
 	if oaiResponse != nil {
+		if claudeInfo.ResponseId == "" {
+			// 既没有预置 id 也没收到 message_start 时生成一次，后续 chunk 沿用
+			claudeInfo.ResponseId = fmt.Sprintf("chatcmpl-%s", common.GetUUID())
+		}
 		oaiResponse.Id = claudeInfo.ResponseId
 		oaiResponse.Created = claudeInfo.Created
 		oaiResponse.Model = claudeInfo.Model
+		// 引用先于被引用的文本到达，等到 message_delta 时正文区间已确定，再一次性下发
+		if claudeResponse.Type == "message_delta" && len(claudeInfo.pendingCitations) > 0 && len(oaiResponse.Choices) > 0 {
+			for _, pending := range claudeInfo.pendingCitations {
+				blockRange := claudeInfo.textBlockRanges[pending.blockIndex]
+				if annotation, ok := claudeCitationToAnnotation(pending.citation, blockRange[0], blockRange[1]); ok {
+					oaiResponse.Choices[0].Delta.Annotations = append(oaiResponse.Choices[0].Delta.Annotations, annotation)
+				}
+			}
+			claudeInfo.pendingCitations = nil
+		}
+		if claudeInfo.isResponseFormatDelta(claudeResponse) {
+			// 合成工具的参数即结构化输出，作为正文增量下发
+			for i := range oaiResponse.Choices {
+				oaiResponse.Choices[i].Delta.ToolCalls = nil
+				oaiResponse.Choices[i].Delta.SetContentString(*claudeResponse.Delta.PartialJson)
+			}
+		} else if claudeResponse.Type == "content_block_delta" && claudeResponse.Delta != nil && claudeResponse.Delta.Type == "input_json_delta" {
+			claudeInfo.trackToolArguments(claudeResponse.GetIndex(), oaiResponse)
+		}
+		if claudeResponse.Type == "message_delta" && len(oaiResponse.Choices) > 0 {
+			oaiResponse.Choices[0].Delta.ToolCalls = append(oaiResponse.Choices[0].Delta.ToolCalls, claudeInfo.finishToolArguments()...)
+			// 只调用了 response_format 合成工具时，对客户端而言是正常结束
+			finishReason := oaiResponse.Choices[0].FinishReason
+			if len(claudeInfo.responseFormatBlocks) > 0 && len(claudeInfo.toolCallIndexes) == 0 &&
+				finishReason != nil && *finishReason == StopReasonClaudeToOpenAI("tool_use") {
+				oaiResponse.Choices[0].FinishReason = common.GetPointer("stop")
+			}
+		}
+		if toolCallIndex, ok := claudeInfo.toolCallIndexes[claudeResponse.GetIndex()]; ok && claudeResponse.Type != "message_delta" {
+			for i := range oaiResponse.Choices {
+				for j := range oaiResponse.Choices[i].Delta.ToolCalls {
+					oaiResponse.Choices[i].Delta.ToolCalls[j].Index = common.GetPointer(toolCallIndex)
+				}
+			}
+		}
 	}
 	return true
 }
+
+// writeContent 累积下发的正文，并记录各 block 在正文中的字符区间
+func (claudeInfo *ClaudeResponseInfo) writeContent(blockIndex int, text string) {
+	claudeInfo.ResponseText.WriteString(text)
+	if claudeInfo.textBlockRanges == nil {
+		claudeInfo.textBlockRanges = make(map[int][2]int)
+	}
+	blockRange, ok := claudeInfo.textBlockRanges[blockIndex]
+	if !ok {
+		blockRange[0] = claudeInfo.contentLength
+	}
+	claudeInfo.contentLength += utf8.RuneCountInString(text)
+	blockRange[1] = claudeInfo.contentLength
+	claudeInfo.textBlockRanges[blockIndex] = blockRange
+}
+
+// isResponseFormatDelta 判断是否为 response_format json_schema 合成工具的参数增量
+func (claudeInfo *ClaudeResponseInfo) isResponseFormatDelta(claudeResponse *dto.ClaudeResponse) bool {
+	return claudeResponse.Type == "content_block_delta" && claudeResponse.Delta != nil &&
+		claudeResponse.Delta.Type == "input_json_delta" && claudeResponse.Delta.PartialJson != nil &&
+		claudeInfo.responseFormatBlocks[claudeResponse.GetIndex()]
+}
+
+// trackToolArguments 累积 tool_use block 的 arguments 片段，只下发完整的 UTF-8 字符，
+// 被上游从多字节字符中间切开的尾部字节留到下一个片段一起下发
+func (claudeInfo *ClaudeResponseInfo) trackToolArguments(blockIndex int, oaiResponse *dto.ChatCompletionsStreamResponse) {
+	arguments, ok := claudeInfo.toolArguments[blockIndex]
+	if !ok {
+		return
+	}
+	for i := range oaiResponse.Choices {
+		for j := range oaiResponse.Choices[i].Delta.ToolCalls {
+			function := &oaiResponse.Choices[i].Delta.ToolCalls[j].Function
+			fragment := arguments.pending + function.Arguments
+			complete := len(fragment)
+			// 最多回看 utf8.UTFMax-1 个字节，找到被截断的多字节字符起点
+			for k := len(fragment) - 1; k >= 0 && k >= len(fragment)-utf8.UTFMax+1; k-- {
+				if utf8.RuneStart(fragment[k]) {
+					if !utf8.FullRuneInString(fragment[k:]) {
+						complete = k
+					}
+					break
+				}
+			}
+			function.Arguments = fragment[:complete]
+			arguments.pending = fragment[complete:]
+			arguments.emitted.WriteString(function.Arguments)
+		}
+	}
+}
+
+// finishToolArguments 在消息结束时下发各 tool_use 残留的字节，并在 arguments 不是合法 JSON 时补发修正片段：
+// 空参数补为 {}，被截断的 JSON 补齐未闭合的字符串与括号
+func (claudeInfo *ClaudeResponseInfo) finishToolArguments() []dto.ToolCallResponse {
+	blockIndexes := make([]int, 0, len(claudeInfo.toolArguments))
+	for blockIndex := range claudeInfo.toolArguments {
+		blockIndexes = append(blockIndexes, blockIndex)
+	}
+	sort.Ints(blockIndexes)
+
+	corrections := make([]dto.ToolCallResponse, 0)
+	for _, blockIndex := range blockIndexes {
+		arguments := claudeInfo.toolArguments[blockIndex]
+		correction := arguments.pending
+		accumulated := arguments.emitted.String() + correction
+		if strings.TrimSpace(accumulated) == "" {
+			correction += "{}"
+		} else if !gjson.Valid(accumulated) {
+			suffix := closeTruncatedJSON(accumulated)
+			if gjson.Valid(accumulated + suffix) {
+				correction += suffix
+			} else if common.DebugEnabled {
+				// arguments 是模型输出的用户数据，只记录 block 序号与长度
+				common.SysLog(fmt.Sprintf("claude tool_use arguments are not valid JSON (block index: %d, length: %d)", blockIndex, len(accumulated)))
+			}
+		}
+		if correction == "" {
+			continue
+		}
+		corrections = append(corrections, dto.ToolCallResponse{
+			Index: common.GetPointer(claudeInfo.toolCallIndexes[blockIndex]),
+			Type:  "function",
+			Function: dto.FunctionResponse{
+				Arguments: correction,
+			},
+		})
+	}
+	claudeInfo.toolArguments = nil
+	return corrections
+}
+
+// closeTruncatedJSON 返回补齐被截断 JSON 所需的后缀：闭合未结束的字符串以及未闭合的对象和数组
+func closeTruncatedJSON(text string) string {
+	var closers []byte
+	inString, escaped := false, false
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case ch == '\\':
+				escaped = true
+			case ch == '"':
+				inString = false
+			}
+			continue
+		}
+		switch ch {
+		case '"':
+			inString = true
+		case '{':
+			closers = append(closers, '}')
+		case '[':
+			closers = append(closers, ']')
+		case '}', ']':
+			if len(closers) > 0 {
+				closers = closers[:len(closers)-1]
+			}
+		}
+	}
+	var suffix strings.Builder
+	if escaped {
+		suffix.WriteByte('\\')
+	}
+	if inString {
+		suffix.WriteByte('"')
+	}
+	for i := len(closers) - 1; i >= 0; i-- {
+		suffix.WriteByte(closers[i])
+	}
+	return suffix.String()
+}
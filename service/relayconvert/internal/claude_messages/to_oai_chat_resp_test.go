@@ -0,0 +1,537 @@
+package claudemessages
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseClaude2OpenAIMapsRedactedThinkingToReasoningContent(t *testing.T) {
+	var claudeResponse dto.ClaudeResponse
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"id": "msg_1",
+		"type": "message",
+		"role": "assistant",
+		"model": "claude-sonnet-4-5-20250929",
+		"content": [
+			{"type": "thinking", "thinking": "let me think", "signature": "sig_1"},
+			{"type": "redacted_thinking", "data": "EmwKAhgBEgy3va3pzix/LafPsn4aDFIT"},
+			{"type": "text", "text": "answer"}
+		],
+		"stop_reason": "end_turn"
+	}`, &claudeResponse))
+
+	response := ResponseClaude2OpenAI(&claudeResponse)
+
+	require.Len(t, response.Choices, 1)
+	choice := response.Choices[0]
+	assert.Equal(t, "answer", choice.Message.StringContent())
+	require.NotNil(t, choice.Message.ReasoningContent)
+	assert.Equal(t, "let me think"+redactedThinkingPlaceholder, *choice.Message.ReasoningContent)
+}
+
+func TestStreamResponseClaude2OpenAIMapsRedactedThinkingToReasoningContent(t *testing.T) {
+	// redacted_thinking 只会以 content_block_start 的形式出现，没有对应的 delta 类型
+	var claudeResponse dto.ClaudeResponse
+	require.NoError(t, common.UnmarshalJsonStr(`{"type":"content_block_start","index":0,"content_block":{"type":"redacted_thinking","data":"EmwKAhgBEgy3va3pzix/LafPsn4aDFIT"}}`, &claudeResponse))
+
+	response := StreamResponseClaude2OpenAI(&claudeResponse)
+
+	require.NotNil(t, response)
+	require.Len(t, response.Choices, 1)
+	delta := response.Choices[0].Delta
+	require.NotNil(t, delta.ReasoningContent)
+	assert.Equal(t, redactedThinkingPlaceholder, *delta.ReasoningContent)
+	assert.Empty(t, delta.GetContentString())
+}
+
+func TestFormatClaudeResponseInfoAssignsSequentialToolCallIndexes(t *testing.T) {
+	events := []string{
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"checking both cities"}}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\":\"Paris\"}"}}`,
+		`{"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"toolu_2","name":"get_weather","input":{}}}`,
+		`{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"{\"city\":\"Tokyo\"}"}}`,
+	}
+	claudeInfo := &ClaudeResponseInfo{Usage: &dto.Usage{}}
+
+	toolCallIndexes := make(map[string][]int)
+	arguments := make(map[int]string)
+	for _, event := range events {
+		var claudeResponse dto.ClaudeResponse
+		require.NoError(t, common.UnmarshalJsonStr(event, &claudeResponse))
+		response := StreamResponseClaude2OpenAI(&claudeResponse)
+		require.True(t, FormatClaudeResponseInfo(&claudeResponse, response, claudeInfo))
+		require.NotNil(t, response)
+		for _, toolCall := range response.Choices[0].Delta.ToolCalls {
+			require.NotNil(t, toolCall.Index)
+			if toolCall.ID != "" {
+				toolCallIndexes[toolCall.ID] = append(toolCallIndexes[toolCall.ID], *toolCall.Index)
+			}
+			arguments[*toolCall.Index] += toolCall.Function.Arguments
+		}
+	}
+
+	assert.Equal(t, []int{0}, toolCallIndexes["toolu_1"])
+	assert.Equal(t, []int{1}, toolCallIndexes["toolu_2"])
+	assert.Equal(t, map[int]string{
+		0: `{"city":"Paris"}`,
+		1: `{"city":"Tokyo"}`,
+	}, arguments)
+}
+
+func TestFormatClaudeResponseInfoUnwrapsResponseFormatToolInStream(t *testing.T) {
+	events := []string{
+		`{"type":"message_start","message":{"id":"msg_1","model":"claude-sonnet-4-5-20250929","usage":{"input_tokens":10}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"toolu_1","name":"json_schema_response","input":{}}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"\"Paris\"}"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":8}}`,
+	}
+	claudeInfo := &ClaudeResponseInfo{Usage: &dto.Usage{}}
+
+	var content string
+	var finishReason string
+	for _, event := range events {
+		var claudeResponse dto.ClaudeResponse
+		require.NoError(t, common.UnmarshalJsonStr(event, &claudeResponse))
+		response := StreamResponseClaude2OpenAI(&claudeResponse)
+		if !FormatClaudeResponseInfo(&claudeResponse, response, claudeInfo) || response == nil {
+			continue
+		}
+		for _, choice := range response.Choices {
+			assert.Empty(t, choice.Delta.ToolCalls)
+			content += choice.Delta.GetContentString()
+			if choice.FinishReason != nil {
+				finishReason = *choice.FinishReason
+			}
+		}
+	}
+
+	assert.Equal(t, `{"city":"Paris"}`, content)
+	assert.Equal(t, "stop", finishReason)
+	assert.Equal(t, `{"city":"Paris"}`, claudeInfo.ResponseText.String())
+}
+
+func TestResponseClaude2OpenAIExposesMatchedStopSequence(t *testing.T) {
+	var claudeResponse dto.ClaudeResponse
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"id": "msg_1",
+		"type": "message",
+		"role": "assistant",
+		"model": "claude-sonnet-4-5-20250929",
+		"content": [{"type": "text", "text": "one, two"}],
+		"stop_reason": "stop_sequence",
+		"stop_sequence": "three"
+	}`, &claudeResponse))
+
+	response := ResponseClaude2OpenAI(&claudeResponse)
+
+	require.Len(t, response.Choices, 1)
+	assert.Equal(t, "stop", response.Choices[0].FinishReason)
+	require.NotNil(t, response.Choices[0].StopSequence)
+	assert.Equal(t, "three", *response.Choices[0].StopSequence)
+
+	data, err := common.Marshal(response)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"stop_sequence":"three"`)
+}
+
+func TestStreamResponseClaude2OpenAIExposesMatchedStopSequenceOnFinalChunk(t *testing.T) {
+	var claudeResponse dto.ClaudeResponse
+	require.NoError(t, common.UnmarshalJsonStr(`{"type":"message_delta","delta":{"stop_reason":"stop_sequence","stop_sequence":"three"},"usage":{"output_tokens":4}}`, &claudeResponse))
+
+	response := StreamResponseClaude2OpenAI(&claudeResponse)
+
+	require.NotNil(t, response)
+	require.Len(t, response.Choices, 1)
+	require.NotNil(t, response.Choices[0].FinishReason)
+	assert.Equal(t, "stop", *response.Choices[0].FinishReason)
+	require.NotNil(t, response.Choices[0].StopSequence)
+	assert.Equal(t, "three", *response.Choices[0].StopSequence)
+}
+
+func TestStreamResponseClaude2OpenAIOmitsFinishReasonWhenStopReasonIsNull(t *testing.T) {
+	for _, event := range []string{
+		`{"type":"message_delta","delta":{"stop_reason":null},"usage":{"output_tokens":4}}`,
+		`{"type":"message_delta","usage":{"output_tokens":4}}`,
+	} {
+		var claudeResponse dto.ClaudeResponse
+		require.NoError(t, common.UnmarshalJsonStr(event, &claudeResponse))
+
+		var response *dto.ChatCompletionsStreamResponse
+		require.NotPanics(t, func() {
+			response = StreamResponseClaude2OpenAI(&claudeResponse)
+		})
+		require.NotNil(t, response)
+		require.Len(t, response.Choices, 1)
+		assert.Nil(t, response.Choices[0].FinishReason)
+		assert.Nil(t, response.Choices[0].StopSequence)
+	}
+}
+
+func TestResponseClaude2OpenAIOmitsStopSequenceWhenNotMatched(t *testing.T) {
+	var claudeResponse dto.ClaudeResponse
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"id": "msg_1",
+		"type": "message",
+		"content": [{"type": "text", "text": "done"}],
+		"stop_reason": "end_turn",
+		"stop_sequence": null
+	}`, &claudeResponse))
+
+	data, err := common.Marshal(ResponseClaude2OpenAI(&claudeResponse))
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "stop_sequence")
+}
+
+func TestResponseClaude2OpenAIMapsWebSearchCitationsToAnnotations(t *testing.T) {
+	var claudeResponse dto.ClaudeResponse
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"id": "msg_1",
+		"type": "message",
+		"role": "assistant",
+		"model": "claude-sonnet-4-5-20250929",
+		"content": [
+			{"type": "server_tool_use", "id": "srvtoolu_1", "name": "web_search", "input": {"query": "go release"}},
+			{"type": "web_search_tool_result", "tool_use_id": "srvtoolu_1", "content": []},
+			{"type": "text", "text": "According to the blog, "},
+			{"type": "text", "text": "Go 1.25 was released in August.", "citations": [
+				{"type": "web_search_result_location", "url": "https://go.dev/blog/go1.25", "title": "Go 1.25 is released", "encrypted_index": "Eo8BCioIAhgBIiQ", "cited_text": "Go 1.25 is released today"}
+			]},
+			{"type": "text", "text": " Enjoy!"}
+		],
+		"stop_reason": "end_turn"
+	}`, &claudeResponse))
+
+	response := ResponseClaude2OpenAI(&claudeResponse)
+
+	require.Len(t, response.Choices, 1)
+	message := response.Choices[0].Message
+	assert.Equal(t, "According to the blog, Go 1.25 was released in August. Enjoy!", message.StringContent())
+	require.Len(t, message.Annotations, 1)
+	annotation := message.Annotations[0]
+	assert.Equal(t, "url_citation", annotation.Type)
+	require.NotNil(t, annotation.UrlCitation)
+	assert.Equal(t, "https://go.dev/blog/go1.25", annotation.UrlCitation.Url)
+	assert.Equal(t, "Go 1.25 is released", annotation.UrlCitation.Title)
+	assert.Equal(t, 23, annotation.UrlCitation.StartIndex)
+	assert.Equal(t, 54, annotation.UrlCitation.EndIndex)
+	assert.Equal(t, "Go 1.25 was released in August.",
+		string([]rune(message.StringContent())[annotation.UrlCitation.StartIndex:annotation.UrlCitation.EndIndex]))
+}
+
+func TestStreamResponseClaude2OpenAIEmitsCitationAnnotationsOnMessageDelta(t *testing.T) {
+	events := []string{
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Per the blog, "}}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"text","text":"","citations":[]}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"citations_delta","citation":{"type":"web_search_result_location","url":"https://go.dev/blog/go1.25","title":"Go 1.25 is released","encrypted_index":"Eo8B","cited_text":"Go 1.25 is released today"}}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"Go 1.25 "}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"shipped."}}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":12}}`,
+	}
+	claudeInfo := &ClaudeResponseInfo{Usage: &dto.Usage{}}
+
+	var content string
+	var annotations []dto.ChatCompletionAnnotation
+	for _, event := range events {
+		var claudeResponse dto.ClaudeResponse
+		require.NoError(t, common.UnmarshalJsonStr(event, &claudeResponse))
+		response := StreamResponseClaude2OpenAI(&claudeResponse)
+		require.True(t, FormatClaudeResponseInfo(&claudeResponse, response, claudeInfo))
+		require.NotNil(t, response)
+		delta := response.Choices[0].Delta
+		content += delta.GetContentString()
+		if claudeResponse.Type != "message_delta" {
+			assert.Empty(t, delta.Annotations)
+		}
+		annotations = append(annotations, delta.Annotations...)
+	}
+
+	assert.Equal(t, "Per the blog, Go 1.25 shipped.", content)
+	require.Len(t, annotations, 1)
+	require.NotNil(t, annotations[0].UrlCitation)
+	assert.Equal(t, "https://go.dev/blog/go1.25", annotations[0].UrlCitation.Url)
+	assert.Equal(t, "Go 1.25 shipped.",
+		string([]rune(content)[annotations[0].UrlCitation.StartIndex:annotations[0].UrlCitation.EndIndex]))
+}
+
+func TestFormatClaudeResponseInfoTracksWebSearchRequestsAcrossChunks(t *testing.T) {
+	events := []string{
+		`{"type":"message_start","message":{"id":"msg_1","model":"claude-sonnet-4-5-20250929","usage":{"input_tokens":20,"output_tokens":1}}}`,
+		`{"type":"message_delta","delta":{},"usage":{"output_tokens":30,"server_tool_use":{"web_search_requests":1}}}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":60,"server_tool_use":{"web_search_requests":3}}}`,
+	}
+	claudeInfo := &ClaudeResponseInfo{Usage: &dto.Usage{}}
+	for _, event := range events {
+		var claudeResponse dto.ClaudeResponse
+		require.NoError(t, common.UnmarshalJsonStr(event, &claudeResponse))
+		FormatClaudeResponseInfo(&claudeResponse, nil, claudeInfo)
+	}
+
+	assert.Equal(t, 3, claudeInfo.Usage.WebSearchRequests)
+	assert.Equal(t, 60, claudeInfo.Usage.CompletionTokens)
+
+	data, err := common.Marshal(claudeInfo.Usage)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "web_search_requests", "web search count is for billing only")
+}
+
+func TestStreamResponseClaude2OpenAICarriesThinkingSignature(t *testing.T) {
+	var claudeResponse dto.ClaudeResponse
+	require.NoError(t, common.UnmarshalJsonStr(`{"type":"content_block_delta","index":0,"delta":{"type":"signature_delta","signature":"EqQBCgIYAhIM1gbcDa9GJwZA2b3hGgxBdjrkzLoky3dl1pk"}}`, &claudeResponse))
+
+	settings := model_setting.GetClaudeSettings()
+	original := settings.ThinkingSignatureNewlineEnabled
+	t.Cleanup(func() { settings.ThinkingSignatureNewlineEnabled = original })
+
+	settings.ThinkingSignatureNewlineEnabled = true
+	response := StreamResponseClaude2OpenAI(&claudeResponse)
+	require.NotNil(t, response)
+	require.Len(t, response.Choices, 1)
+	delta := response.Choices[0].Delta
+	require.NotNil(t, delta.ReasoningContentSignature)
+	assert.Equal(t, "EqQBCgIYAhIM1gbcDa9GJwZA2b3hGgxBdjrkzLoky3dl1pk", *delta.ReasoningContentSignature)
+	require.NotNil(t, delta.ReasoningContent)
+	assert.Equal(t, "\n", *delta.ReasoningContent)
+
+	settings.ThinkingSignatureNewlineEnabled = false
+	response = StreamResponseClaude2OpenAI(&claudeResponse)
+	require.NotNil(t, response)
+	delta = response.Choices[0].Delta
+	require.NotNil(t, delta.ReasoningContentSignature)
+	assert.Equal(t, "EqQBCgIYAhIM1gbcDa9GJwZA2b3hGgxBdjrkzLoky3dl1pk", *delta.ReasoningContentSignature)
+	assert.Nil(t, delta.ReasoningContent)
+}
+
+func TestStreamResponseClaude2OpenAIKeepsTextAndToolDeltasSeparate(t *testing.T) {
+	var textChunk dto.ClaudeResponse
+	require.NoError(t, common.UnmarshalJsonStr(`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Let me check."}}`, &textChunk))
+	var toolChunk dto.ClaudeResponse
+	require.NoError(t, common.UnmarshalJsonStr(`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}`, &toolChunk))
+
+	textResponse := StreamResponseClaude2OpenAI(&textChunk)
+	require.NotNil(t, textResponse)
+	require.Len(t, textResponse.Choices, 1)
+	assert.Equal(t, "Let me check.", textResponse.Choices[0].Delta.GetContentString())
+	assert.Empty(t, textResponse.Choices[0].Delta.ToolCalls)
+
+	toolResponse := StreamResponseClaude2OpenAI(&toolChunk)
+	require.NotNil(t, toolResponse)
+	require.Len(t, toolResponse.Choices, 1)
+	assert.Nil(t, toolResponse.Choices[0].Delta.Content)
+	require.Len(t, toolResponse.Choices[0].Delta.ToolCalls, 1)
+	assert.Equal(t, `{"city":`, toolResponse.Choices[0].Delta.ToolCalls[0].Function.Arguments)
+}
+
+func TestStreamResponseClaude2OpenAIEmitsTextAlongsideToolCallsInSameChunk(t *testing.T) {
+	var claudeResponse dto.ClaudeResponse
+	require.NoError(t, common.UnmarshalJsonStr(`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","text":"partial","partial_json":"{}"}}`, &claudeResponse))
+
+	response := StreamResponseClaude2OpenAI(&claudeResponse)
+
+	require.NotNil(t, response)
+	require.Len(t, response.Choices, 1)
+	assert.Equal(t, "partial", response.Choices[0].Delta.GetContentString())
+	require.Len(t, response.Choices[0].Delta.ToolCalls, 1)
+}
+
+func TestResponseClaude2OpenAIKeepsCodeExecutionOutput(t *testing.T) {
+	var claudeResponse dto.ClaudeResponse
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-5","stop_reason":"end_turn",
+		"content":[
+			{"type":"text","text":"Running it now."},
+			{"type":"server_tool_use","id":"srvtoolu_1","name":"code_execution","input":{"code":"print(1+1)"}},
+			{"type":"code_execution_tool_result","tool_use_id":"srvtoolu_1","content":{"type":"code_execution_result","stdout":"2\n","stderr":"","return_code":0,"content":[]}},
+			{"type":"text","text":"The answer is 2."}
+		]
+	}`, &claudeResponse))
+
+	response := ResponseClaude2OpenAI(&claudeResponse)
+
+	require.Len(t, response.Choices, 1)
+	assert.Equal(t, "Running it now.\n```\n2\n```\nThe answer is 2.", response.Choices[0].Message.StringContent())
+	assert.Empty(t, response.Choices[0].Message.ToolCalls)
+}
+
+func TestResponseClaude2OpenAIPreservesTextOfUnknownBlocks(t *testing.T) {
+	var claudeResponse dto.ClaudeResponse
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"id":"msg_2","type":"message","role":"assistant","stop_reason":"end_turn",
+		"content":[{"type":"future_block","text":"kept"}]
+	}`, &claudeResponse))
+
+	response := ResponseClaude2OpenAI(&claudeResponse)
+
+	require.Len(t, response.Choices, 1)
+	assert.Equal(t, "kept", response.Choices[0].Message.StringContent())
+}
+
+func TestFormatClaudeResponseInfoRepairsStreamedToolArguments(t *testing.T) {
+	city := "北京"
+	splitAt := 1 // 从「北」的 UTF-8 编码中间切开
+	newEvent := func(event string) *dto.ClaudeResponse {
+		var claudeResponse dto.ClaudeResponse
+		require.NoError(t, common.UnmarshalJsonStr(event, &claudeResponse))
+		return &claudeResponse
+	}
+	inputDelta := func(index int, partialJson string) *dto.ClaudeResponse {
+		return &dto.ClaudeResponse{
+			Type:  "content_block_delta",
+			Index: common.GetPointer(index),
+			Delta: &dto.ClaudeMediaMessage{Type: "input_json_delta", PartialJson: common.GetPointer(partialJson)},
+		}
+	}
+	events := []*dto.ClaudeResponse{
+		newEvent(`{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}}`),
+		inputDelta(0, `{"city":"`+city[:splitAt]),
+		inputDelta(0, city[splitAt:]+`"}`),
+		newEvent(`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_2","name":"get_time","input":{}}}`),
+		inputDelta(1, ""),
+		newEvent(`{"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"toolu_3","name":"search","input":{}}}`),
+		inputDelta(2, `{"query":"weather in`),
+		newEvent(`{"type":"message_delta","delta":{"stop_reason":"max_tokens"},"usage":{"output_tokens":10}}`),
+	}
+	claudeInfo := &ClaudeResponseInfo{Usage: &dto.Usage{}}
+
+	arguments := make(map[int]string)
+	for _, claudeResponse := range events {
+		response := StreamResponseClaude2OpenAI(claudeResponse)
+		require.True(t, FormatClaudeResponseInfo(claudeResponse, response, claudeInfo))
+		require.NotNil(t, response)
+		for _, toolCall := range response.Choices[0].Delta.ToolCalls {
+			require.NotNil(t, toolCall.Index)
+			assert.True(t, utf8.ValidString(toolCall.Function.Arguments))
+			arguments[*toolCall.Index] += toolCall.Function.Arguments
+		}
+	}
+
+	assert.Equal(t, map[int]string{
+		0: `{"city":"北京"}`,
+		1: `{}`,
+		2: `{"query":"weather in"}`,
+	}, arguments)
+}
+
+func TestResponseClaude2OpenAIAppliesThinkingOutputMode(t *testing.T) {
+	var claudeResponse dto.ClaudeResponse
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"id": "msg_1",
+		"type": "message",
+		"role": "assistant",
+		"model": "claude-sonnet-4-5-20250929",
+		"content": [
+			{"type": "thinking", "thinking": "let me think", "signature": "sig_1"},
+			{"type": "text", "text": "answer"}
+		],
+		"stop_reason": "end_turn"
+	}`, &claudeResponse))
+
+	settings := model_setting.GetClaudeSettings()
+	original := settings.ThinkingOutputMode
+	t.Cleanup(func() { settings.ThinkingOutputMode = original })
+
+	testCases := []struct {
+		mode          string
+		wantContent   string
+		wantReasoning *string
+	}{
+		{mode: model_setting.ThinkingOutputModeReasoningField, wantContent: "answer", wantReasoning: common.GetPointer("let me think")},
+		{mode: model_setting.ThinkingOutputModeInlineTags, wantContent: "<thinking>let me think</thinking>\nanswer"},
+		{mode: model_setting.ThinkingOutputModeOmit, wantContent: "answer"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.mode, func(t *testing.T) {
+			settings.ThinkingOutputMode = tc.mode
+			response := ResponseClaude2OpenAI(&claudeResponse)
+			require.Len(t, response.Choices, 1)
+			assert.Equal(t, tc.wantContent, response.Choices[0].Message.StringContent())
+			assert.Equal(t, tc.wantReasoning, response.Choices[0].Message.ReasoningContent)
+		})
+	}
+}
+
+func TestStreamResponseClaude2OpenAIAppliesThinkingOutputMode(t *testing.T) {
+	events := []string{
+		`{"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"let me think"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"signature_delta","signature":"sig_1"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"answer"}}`,
+		`{"type":"content_block_stop","index":1}`,
+	}
+
+	settings := model_setting.GetClaudeSettings()
+	original := settings.ThinkingOutputMode
+	t.Cleanup(func() { settings.ThinkingOutputMode = original })
+
+	testCases := []struct {
+		mode          string
+		wantContent   string
+		wantReasoning string
+	}{
+		{mode: model_setting.ThinkingOutputModeReasoningField, wantContent: "answer", wantReasoning: "let me think"},
+		{mode: model_setting.ThinkingOutputModeInlineTags, wantContent: "<thinking>let me think</thinking>\nanswer"},
+		{mode: model_setting.ThinkingOutputModeOmit, wantContent: "answer"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.mode, func(t *testing.T) {
+			settings.ThinkingOutputMode = tc.mode
+			claudeInfo := &ClaudeResponseInfo{Usage: &dto.Usage{}}
+			var content, reasoning string
+			for _, event := range events {
+				var claudeResponse dto.ClaudeResponse
+				require.NoError(t, common.UnmarshalJsonStr(event, &claudeResponse))
+				response := StreamResponseClaude2OpenAI(&claudeResponse)
+				if !FormatClaudeResponseInfo(&claudeResponse, response, claudeInfo) || response == nil {
+					continue
+				}
+				for _, choice := range response.Choices {
+					content += choice.Delta.GetContentString()
+					reasoning += choice.Delta.GetReasoningContent()
+				}
+			}
+			assert.Equal(t, tc.wantContent, content)
+			assert.Equal(t, tc.wantReasoning, strings.TrimSpace(reasoning))
+		})
+	}
+}
+
+func TestStreamResponseClaude2OpenAIKeepsToolRepairsOnMessageDeltaWhenOmittingThinking(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	original := settings.ThinkingOutputMode
+	settings.ThinkingOutputMode = model_setting.ThinkingOutputModeOmit
+	t.Cleanup(func() { settings.ThinkingOutputMode = original })
+
+	events := []string{
+		`{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"toolu_1","name":"search","input":{}}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"query\":\"weather"}}`,
+		`{"type":"message_delta","delta":{"stop_reason":null},"usage":{"output_tokens":10}}`,
+	}
+	claudeInfo := &ClaudeResponseInfo{Usage: &dto.Usage{}}
+
+	var arguments string
+	for _, event := range events {
+		var claudeResponse dto.ClaudeResponse
+		require.NoError(t, common.UnmarshalJsonStr(event, &claudeResponse))
+		response := StreamResponseClaude2OpenAI(&claudeResponse)
+		require.True(t, FormatClaudeResponseInfo(&claudeResponse, response, claudeInfo))
+		require.NotNil(t, response)
+		for _, toolCall := range response.Choices[0].Delta.ToolCalls {
+			arguments += toolCall.Function.Arguments
+		}
+	}
+
+	assert.Equal(t, `{"query":"weather"}`, arguments)
+}
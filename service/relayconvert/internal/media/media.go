@@ -1,6 +1,7 @@
 package media
 
 import (
+	"context"
 	"errors"
 	"sync"
 
@@ -9,8 +10,10 @@ import (
 )
 
 type MediaResolver struct {
-	GetBase64Data        func(c *gin.Context, source types.FileSource, reason ...string) (string, string, error)
-	DecodeBase64FileData func(base64String string) (string, string, error)
+	GetBase64Data func(c *gin.Context, source types.FileSource, reason ...string) (string, string, error)
+	// GetBase64DataWithLimit 下载随 ctx 取消，文件超过 maxBytes 时返回 common.ErrRequestBodyTooLarge；未配置时回退到 GetBase64Data
+	GetBase64DataWithLimit func(ctx context.Context, c *gin.Context, source types.FileSource, maxBytes int64, reason ...string) (string, string, error)
+	DecodeBase64FileData   func(base64String string) (string, string, error)
 }
 
 var (
@@ -35,6 +38,20 @@ func ResolveBase64Data(c *gin.Context, source types.FileSource, reason ...string
 	return resolver(c, source, reason...)
 }
 
+// ResolveBase64DataWithLimit 按 maxBytes 限制解析文件数据，远程下载随 ctx 取消
+func ResolveBase64DataWithLimit(ctx context.Context, c *gin.Context, source types.FileSource, maxBytes int64, reason ...string) (string, string, error) {
+	mediaResolverMu.RLock()
+	limitedResolver := mediaResolver.GetBase64DataWithLimit
+	mediaResolverMu.RUnlock()
+	if limitedResolver == nil {
+		if err := ctx.Err(); err != nil {
+			return "", "", err
+		}
+		return ResolveBase64Data(c, source, reason...)
+	}
+	return limitedResolver(ctx, c, source, maxBytes, reason...)
+}
+
 func DecodeBase64FileData(base64String string) (string, string, error) {
 	mediaResolverMu.RLock()
 	resolver := mediaResolver.DecodeBase64FileData
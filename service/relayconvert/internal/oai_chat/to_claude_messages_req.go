@@ -1,17 +1,27 @@
 package oaichat
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"slices"
 	"strings"
+	"sync/atomic"
+	"unicode/utf8"
 
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
 	relaymedia "github.com/QuantumNous/new-api/service/relayconvert/internal/media"
 	sharedclaude "github.com/QuantumNous/new-api/service/relayconvert/internal/shared/claude"
 	"github.com/QuantumNous/new-api/setting/model_setting"
 	"github.com/QuantumNous/new-api/setting/reasoning"
+	"github.com/QuantumNous/new-api/types"
 	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
@@ -20,6 +30,15 @@ const (
 	webSearchMaxUsesHigh   = 10
 )
 
+// claudeFilePrefetchConcurrency 是并发下载远程图片/文件的上限
+const claudeFilePrefetchConcurrency = 4
+
+// seedIgnoredWarningHeader 是请求参数被忽略时返回给客户端的提示响应头
+const seedIgnoredWarningHeader = "X-New-Api-Warning"
+
+// claudeMaxCacheBreakpoints 是 Anthropic 单个请求允许的 cache_control 断点上限
+const claudeMaxCacheBreakpoints = 4
+
 type openRouterRequestReasoning struct {
 	Enabled   bool   `json:"enabled"`
 	Effort    string `json:"effort,omitempty"`
@@ -28,18 +47,50 @@ type openRouterRequestReasoning struct {
 }
 
 func OpenAIChatRequestToClaudeMessages(c *gin.Context, textRequest dto.GeneralOpenAIRequest) (*dto.ClaudeRequest, error) {
+	// Claude 没有 seed，忽略时通过响应头提示客户端，避免误以为结果可复现
+	if textRequest.Seed != nil {
+		if model_setting.GetClaudeSettings().RejectSeed {
+			return nil, types.NewErrorWithStatusCode(errors.New("claude does not support seed"), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		}
+		if c != nil {
+			c.Header(seedIgnoredWarningHeader, "seed is not supported by claude and was ignored")
+			logger.LogWarn(c, "seed is not supported by claude and was ignored")
+		}
+	}
+	// Claude 每次只生成一个回复，n > 1 时直接报错，避免客户端只拿到一个 choice
+	if textRequest.N != nil && *textRequest.N > 1 {
+		return nil, types.NewErrorWithStatusCode(fmt.Errorf("claude does not support n > 1, got n = %d", *textRequest.N), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	// Claude 不返回 logprobs，显式请求时直接报错，避免客户端拿到缺少 logprobs 的响应
+	if (textRequest.LogProbs != nil && *textRequest.LogProbs) || (textRequest.TopLogProbs != nil && *textRequest.TopLogProbs > 0) {
+		return nil, types.NewErrorWithStatusCode(errors.New("claude does not support logprobs"), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	// 透传客户端设置的 cache_control，超过上限的断点丢弃，避免上游返回 400；
+	// 客户端断点（含工具上的）先计数，自动添加的断点只使用剩余的名额
+	cacheBreakpoints := 0
+	clientCacheControl := func(cacheControl json.RawMessage) json.RawMessage {
+		if len(cacheControl) == 0 || cacheBreakpoints >= claudeMaxCacheBreakpoints {
+			return nil
+		}
+		cacheBreakpoints++
+		return cacheControl
+	}
+
 	claudeTools := make([]any, 0, len(textRequest.Tools))
 
 	for _, tool := range textRequest.Tools {
 		if params, ok := tool.Function.Parameters.(map[string]any); ok {
+			schemaType, err := sharedclaude.ValidateToolInputSchema(tool.Function.Name, params)
+			if err != nil {
+				return nil, err
+			}
 			claudeTool := dto.Tool{
-				Name:        tool.Function.Name,
-				Description: tool.Function.Description,
+				Name:         tool.Function.Name,
+				Description:  tool.Function.Description,
+				CacheControl: clientCacheControl(tool.CacheControl),
 			}
 			claudeTool.InputSchema = make(map[string]interface{})
-			if params["type"] != nil {
-				claudeTool.InputSchema["type"] = params["type"].(string)
-			}
+			claudeTool.InputSchema["type"] = schemaType
 			claudeTool.InputSchema["properties"] = params["properties"]
 			claudeTool.InputSchema["required"] = params["required"]
 			for key, value := range params {
@@ -114,6 +165,12 @@ func OpenAIChatRequestToClaudeMessages(c *gin.Context, textRequest dto.GeneralOp
 	if textRequest.IsStream(nil) {
 		claudeRequest.Stream = common.GetPointer(true)
 	}
+	if len(textRequest.ServiceTier) > 0 {
+		var serviceTier string
+		if err := common.Unmarshal(textRequest.ServiceTier, &serviceTier); err == nil {
+			claudeRequest.ServiceTier = claudeServiceTier(serviceTier)
+		}
+	}
 
 	if textRequest.ToolChoice != nil || textRequest.ParallelTooCalls != nil {
 		claudeToolChoice := sharedclaude.MapOpenAIToolChoice(textRequest.ToolChoice, textRequest.ParallelTooCalls)
@@ -164,7 +221,7 @@ func OpenAIChatRequestToClaudeMessages(c *gin.Context, textRequest dto.GeneralOp
 
 			claudeRequest.Thinking = &dto.Thinking{
 				Type:         "enabled",
-				BudgetTokens: common.GetPointer[int](int(float64(*claudeRequest.MaxTokens) * model_setting.GetClaudeSettings().ThinkingAdapterBudgetTokensPercentage)),
+				BudgetTokens: common.GetPointer[int](int(float64(*claudeRequest.MaxTokens) * model_setting.GetClaudeSettings().GetThinkingBudgetTokensPercentage(trimmedModel))),
 			}
 			claudeRequest.TopP = nil
 			claudeRequest.Temperature = common.GetPointer[float64](1.0)
@@ -174,26 +231,29 @@ func OpenAIChatRequestToClaudeMessages(c *gin.Context, textRequest dto.GeneralOp
 		}
 	}
 
-	if textRequest.ReasoningEffort != "" {
-		switch textRequest.ReasoningEffort {
-		case "low":
-			claudeRequest.Thinking = &dto.Thinking{
-				Type:         "enabled",
-				BudgetTokens: common.GetPointer[int](1280),
-			}
-		case "medium":
-			claudeRequest.Thinking = &dto.Thinking{
-				Type:         "enabled",
-				BudgetTokens: common.GetPointer[int](2048),
-			}
-		case "high":
-			claudeRequest.Thinking = &dto.Thinking{
-				Type:         "enabled",
-				BudgetTokens: common.GetPointer[int](4096),
-			}
+	// reasoning_effort 不区分大小写；minimal、xhigh/max 归入最接近的 low、high，none 表示不开启 thinking，其余未知取值直接拒绝
+	switch reasoningEffort := strings.ToLower(strings.TrimSpace(textRequest.ReasoningEffort)); reasoningEffort {
+	case "", "none":
+	case "minimal", "low":
+		claudeRequest.Thinking = &dto.Thinking{
+			Type:         "enabled",
+			BudgetTokens: common.GetPointer[int](1280),
+		}
+	case "medium":
+		claudeRequest.Thinking = &dto.Thinking{
+			Type:         "enabled",
+			BudgetTokens: common.GetPointer[int](2048),
 		}
+	case "high", "xhigh", "max":
+		claudeRequest.Thinking = &dto.Thinking{
+			Type:         "enabled",
+			BudgetTokens: common.GetPointer[int](4096),
+		}
+	default:
+		return nil, types.NewErrorWithStatusCode(fmt.Errorf("unsupported reasoning_effort %q, supported values: none, minimal, low, medium, high, xhigh, max", textRequest.ReasoningEffort), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
 	}
 
+	// reasoning.max_tokens 比 reasoning_effort 更精确，两者同时出现时以 reasoning 为准
 	if textRequest.Reasoning != nil {
 		var reasoningConfig openRouterRequestReasoning
 		if err := common.Unmarshal(textRequest.Reasoning, &reasoningConfig); err != nil {
@@ -209,6 +269,23 @@ func OpenAIChatRequestToClaudeMessages(c *gin.Context, textRequest dto.GeneralOp
 		}
 	}
 
+	// Claude 没有 response_format，用一个合成工具承载 json_schema，响应时再把工具参数还原为正文
+	responseFormatTool, err := sharedclaude.ResponseFormatTool(textRequest.ResponseFormat)
+	if err != nil {
+		return nil, types.NewErrorWithStatusCode(err, types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	if responseFormatTool != nil {
+		claudeRequest.Tools = append(claudeTools, responseFormatTool)
+		// 开启 thinking 时 Anthropic 不允许强制指定工具；客户端自带工具或 tool_choice 时也不覆盖
+		thinkingEnabled := claudeRequest.Thinking != nil && claudeRequest.Thinking.Type != "disabled"
+		if !thinkingEnabled && len(claudeTools) == 0 && claudeRequest.ToolChoice == nil {
+			claudeRequest.ToolChoice = &dto.ClaudeToolChoice{
+				Type: "tool",
+				Name: sharedclaude.ResponseFormatToolName,
+			}
+		}
+	}
+
 	if textRequest.Stop != nil {
 		switch stop := textRequest.Stop.(type) {
 		case string:
@@ -216,11 +293,22 @@ func OpenAIChatRequestToClaudeMessages(c *gin.Context, textRequest dto.GeneralOp
 		case []interface{}:
 			stopSequences := make([]string, 0)
 			for _, item := range stop {
-				stopSequences = append(stopSequences, item.(string))
+				// 兼容客户端传入数字、布尔等非字符串元素：标量转为字符串，null 与对象、数组直接跳过
+				switch item.(type) {
+				case string, float64, bool:
+					stopSequences = append(stopSequences, common.Interface2String(item))
+				}
 			}
 			claudeRequest.StopSequences = stopSequences
 		}
 	}
+	if maxStops := model_setting.GetClaudeSettings().MaxStopSequences; maxStops > 0 && len(claudeRequest.StopSequences) > maxStops {
+		if !model_setting.GetClaudeSettings().StopSequencesTruncate {
+			return nil, types.NewErrorWithStatusCode(fmt.Errorf("too many stop sequences: got %d, at most %d allowed", len(claudeRequest.StopSequences), maxStops), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		}
+		common.SysLog(fmt.Sprintf("truncate stop sequences from %d to %d", len(claudeRequest.StopSequences), maxStops))
+		claudeRequest.StopSequences = claudeRequest.StopSequences[:maxStops]
+	}
 
 	formatMessages := make([]dto.Message, 0)
 	lastMessage := dto.Message{
@@ -230,19 +318,25 @@ func OpenAIChatRequestToClaudeMessages(c *gin.Context, textRequest dto.GeneralOp
 		if message.Role == "" {
 			textRequest.Messages[i].Role = "user"
 		}
+		// developer 是 OpenAI 新版的 system 角色，Claude 没有对应角色，按 system 处理
+		if message.Role == "developer" {
+			message.Role = "system"
+		}
 		fmtMessage := dto.Message{
 			Role:    message.Role,
 			Content: message.Content,
 		}
 		if message.Role == "tool" {
 			fmtMessage.ToolCallId = message.ToolCallId
+			fmtMessage.IsError = message.IsError
 		}
 		if message.Role == "assistant" && message.ToolCalls != nil {
 			fmtMessage.ToolCalls = message.ToolCalls
 		}
-		if lastMessage.Role == message.Role && lastMessage.Role != "tool" {
+		// system 消息各自保留为独立的 system block，不与相邻 system 消息合并
+		if lastMessage.Role == message.Role && lastMessage.Role != "tool" && lastMessage.Role != "system" {
 			if lastMessage.IsStringContent() && message.IsStringContent() {
-				fmtMessage.SetStringContent(strings.Trim(fmt.Sprintf("%s %s", lastMessage.StringContent(), message.StringContent()), "\""))
+				fmtMessage.SetStringContent(fmt.Sprintf("%s %s", lastMessage.StringContent(), message.StringContent()))
 				formatMessages = formatMessages[:len(formatMessages)-1]
 			}
 		}
@@ -256,22 +350,33 @@ func OpenAIChatRequestToClaudeMessages(c *gin.Context, textRequest dto.GeneralOp
 	claudeMessages := make([]dto.ClaudeMessage, 0)
 	isFirstMessage := true
 	var systemMessages []dto.ClaudeMediaMessage
+	fileResolver := &claudeFileResolver{c: c}
+	if err := fileResolver.prefetchRemoteFiles(formatMessages); err != nil {
+		return nil, err
+	}
+	// 字符串 system 无法携带 cache_control，较长的静态 system prompt 在客户端断点计数后自动加断点
+	autoCacheSystemIndex := -1
 
 	for _, message := range formatMessages {
 		if message.Role == "system" {
 			if message.IsStringContent() {
 				if text := message.StringContent(); text != "" {
-					systemMessages = append(systemMessages, dto.ClaudeMediaMessage{
+					systemBlock := dto.ClaudeMediaMessage{
 						Type: "text",
 						Text: common.GetPointer[string](text),
-					})
+					}
+					if minChars := model_setting.GetClaudeSettings().SystemCacheControlMinChars; minChars > 0 && autoCacheSystemIndex < 0 && utf8.RuneCountInString(text) >= minChars {
+						autoCacheSystemIndex = len(systemMessages)
+					}
+					systemMessages = append(systemMessages, systemBlock)
 				}
 			} else {
 				for _, ctx := range message.ParseContent() {
 					if ctx.Type == "text" && ctx.Text != "" {
 						systemMessages = append(systemMessages, dto.ClaudeMediaMessage{
-							Type: "text",
-							Text: common.GetPointer[string](ctx.Text),
+							Type:         "text",
+							Text:         common.GetPointer[string](ctx.Text),
+							CacheControl: clientCacheControl(ctx.CacheControl),
 						})
 					}
 				}
@@ -299,6 +404,30 @@ func OpenAIChatRequestToClaudeMessages(c *gin.Context, textRequest dto.GeneralOp
 			Role: message.Role,
 		}
 		if message.Role == "tool" {
+			// tool_result 的 content 只接受字符串或 text/image 等 block 数组
+			toolResultContent := message.Content
+			if !message.IsStringContent() {
+				toolResultBlocks := make([]dto.ClaudeMediaMessage, 0)
+				for _, mediaMessage := range message.ParseContent() {
+					if mediaMessage.Type == "text" {
+						if mediaMessage.Text != "" {
+							toolResultBlocks = append(toolResultBlocks, dto.ClaudeMediaMessage{
+								Type: "text",
+								Text: common.GetPointer[string](mediaMessage.Text),
+							})
+						}
+						continue
+					}
+					fileBlock, err := fileResolver.fileBlock(mediaMessage)
+					if err != nil {
+						return nil, err
+					}
+					if fileBlock != nil {
+						toolResultBlocks = append(toolResultBlocks, *fileBlock)
+					}
+				}
+				toolResultContent = toolResultBlocks
+			}
 			if len(claudeMessages) > 0 && claudeMessages[len(claudeMessages)-1].Role == "user" {
 				lastClaudeMessage := claudeMessages[len(claudeMessages)-1]
 				if content, ok := lastClaudeMessage.Content.(string); ok {
@@ -312,7 +441,8 @@ func OpenAIChatRequestToClaudeMessages(c *gin.Context, textRequest dto.GeneralOp
 				lastClaudeMessage.Content = append(lastClaudeMessage.Content.([]dto.ClaudeMediaMessage), dto.ClaudeMediaMessage{
 					Type:      "tool_result",
 					ToolUseId: message.ToolCallId,
-					Content:   message.Content,
+					Content:   toolResultContent,
+					IsError:   toolResultIsError(message),
 				})
 				claudeMessages[len(claudeMessages)-1] = lastClaudeMessage
 				continue
@@ -323,7 +453,8 @@ func OpenAIChatRequestToClaudeMessages(c *gin.Context, textRequest dto.GeneralOp
 				{
 					Type:      "tool_result",
 					ToolUseId: message.ToolCallId,
-					Content:   message.Content,
+					Content:   toolResultContent,
+					IsError:   toolResultIsError(message),
 				},
 			}
 		} else if message.IsStringContent() && message.ToolCalls == nil {
@@ -339,34 +470,21 @@ func OpenAIChatRequestToClaudeMessages(c *gin.Context, textRequest dto.GeneralOp
 				case "text":
 					if mediaMessage.Text != "" {
 						claudeMediaMessages = append(claudeMediaMessages, dto.ClaudeMediaMessage{
-							Type: "text",
-							Text: common.GetPointer[string](mediaMessage.Text),
+							Type:         "text",
+							Text:         common.GetPointer[string](mediaMessage.Text),
+							CacheControl: clientCacheControl(mediaMessage.CacheControl),
 						})
 					}
 				default:
-					source := mediaMessage.ToFileSource()
-					if source == nil {
-						continue
-					}
-					base64Data, mimeType, err := relaymedia.ResolveBase64Data(c, source, "formatting image for Claude")
+					fileBlock, err := fileResolver.fileBlock(mediaMessage)
 					if err != nil {
-						return nil, fmt.Errorf("get file data failed: %s", err.Error())
+						return nil, err
 					}
-					claudeMediaMessage := dto.ClaudeMediaMessage{
-						Source: &dto.ClaudeMessageSource{
-							Type: "base64",
-						},
-					}
-					if strings.HasPrefix(mimeType, "application/pdf") {
-						claudeMediaMessage.Type = "document"
-					} else {
-						claudeMediaMessage.Type = "image"
+					if fileBlock == nil {
+						continue
 					}
-
-					claudeMediaMessage.Source.MediaType = mimeType
-					claudeMediaMessage.Source.Data = base64Data
-					claudeMediaMessages = append(claudeMediaMessages, claudeMediaMessage)
-					continue
+					fileBlock.CacheControl = clientCacheControl(mediaMessage.CacheControl)
+					claudeMediaMessages = append(claudeMediaMessages, *fileBlock)
 				}
 			}
 
@@ -376,6 +494,12 @@ func OpenAIChatRequestToClaudeMessages(c *gin.Context, textRequest dto.GeneralOp
 					if args := toolCall.Function.Arguments; args != "" {
 						if err := common.Unmarshal([]byte(args), &inputObj); err != nil {
 							common.SysLog("tool call function arguments is not a map[string]any: " + fmt.Sprintf("%v", toolCall.Function.Arguments))
+							// Claude 要求 tool_use.input 为对象，非对象参数包装为 {"value": ...}，保证 tool_use 与 tool_result 仍能配对
+							var value any
+							if err := common.UnmarshalJsonStr(args, &value); err != nil {
+								value = args
+							}
+							inputObj = map[string]any{"value": value}
 						}
 					}
 					claudeMediaMessages = append(claudeMediaMessages, dto.ClaudeMediaMessage{
@@ -391,6 +515,52 @@ func OpenAIChatRequestToClaudeMessages(c *gin.Context, textRequest dto.GeneralOp
 		claudeMessages = append(claudeMessages, claudeMessage)
 	}
 
+	claudeMessages = groupClaudeToolResults(claudeMessages)
+
+	// Anthropic 要求每条消息内容非空，过滤掉空文本后仍为空的消息补占位文本
+	for i := range claudeMessages {
+		switch content := claudeMessages[i].Content.(type) {
+		case string:
+			if strings.TrimSpace(content) == "" {
+				claudeMessages[i].Content = "..."
+			}
+		case []dto.ClaudeMediaMessage:
+			if len(content) == 0 {
+				claudeMessages[i].Content = []dto.ClaudeMediaMessage{
+					{
+						Type: "text",
+						Text: common.GetPointer[string]("..."),
+					},
+				}
+			}
+		}
+	}
+
+	if autoCacheSystemIndex >= 0 {
+		systemMessages[autoCacheSystemIndex].CacheControl = clientCacheControl(json.RawMessage(`{"type":"ephemeral"}`))
+	}
+
+	// 长对话中 assistant 多轮 tool_use 的前缀基本不变，在最后一条 assistant 消息上加断点以提高缓存命中
+	if minMessages := model_setting.GetClaudeSettings().AssistantCacheControlMinMessages; minMessages > 0 && len(claudeMessages) >= minMessages {
+		for i := len(claudeMessages) - 1; i >= 0; i-- {
+			if claudeMessages[i].Role != "assistant" {
+				continue
+			}
+			blocks, ok := claudeMessages[i].Content.([]dto.ClaudeMediaMessage)
+			if !ok {
+				text, _ := claudeMessages[i].Content.(string)
+				blocks = []dto.ClaudeMediaMessage{{Type: "text", Text: common.GetPointer[string](text)}}
+			}
+			if len(blocks) > 0 && len(blocks[len(blocks)-1].CacheControl) == 0 {
+				if cacheControl := clientCacheControl(json.RawMessage(`{"type":"ephemeral"}`)); cacheControl != nil {
+					blocks[len(blocks)-1].CacheControl = cacheControl
+					claudeMessages[i].Content = blocks
+				}
+			}
+			break
+		}
+	}
+
 	if len(systemMessages) > 0 {
 		claudeRequest.System = systemMessages
 	}
@@ -399,3 +569,416 @@ func OpenAIChatRequestToClaudeMessages(c *gin.Context, textRequest dto.GeneralOp
 	claudeRequest.Messages = claudeMessages
 	return &claudeRequest, nil
 }
+
+// groupClaudeToolResults 把每轮 assistant tool_use 对应的 tool_result 集中到紧随其后的 user 消息开头，并按 tool_use 顺序排列。
+// 客户端在多个 tool 消息之间插入其他消息时，Anthropic 会因 tool_use 与 tool_result 无法配对而拒绝请求
+func groupClaudeToolResults(messages []dto.ClaudeMessage) []dto.ClaudeMessage {
+	emptied := make(map[int]bool)
+	for i := 0; i < len(messages); i++ {
+		toolUseIds := claudeToolUseIds(messages[i])
+		if len(toolUseIds) == 0 {
+			continue
+		}
+		pending := make(map[string]bool, len(toolUseIds))
+		for _, id := range toolUseIds {
+			pending[id] = true
+		}
+		results := make(map[string]dto.ClaudeMediaMessage, len(toolUseIds))
+		for j := i + 1; j < len(messages); j++ {
+			if len(claudeToolUseIds(messages[j])) > 0 {
+				break
+			}
+			blocks, ok := messages[j].Content.([]dto.ClaudeMediaMessage)
+			if messages[j].Role != "user" || !ok {
+				continue
+			}
+			remaining := make([]dto.ClaudeMediaMessage, 0, len(blocks))
+			for _, block := range blocks {
+				if block.Type == "tool_result" && pending[block.ToolUseId] {
+					delete(pending, block.ToolUseId)
+					results[block.ToolUseId] = block
+					continue
+				}
+				remaining = append(remaining, block)
+			}
+			if len(remaining) == 0 && len(blocks) > 0 {
+				emptied[j] = true
+			}
+			messages[j].Content = remaining
+		}
+		if len(results) == 0 {
+			continue
+		}
+		grouped := make([]dto.ClaudeMediaMessage, 0, len(results))
+		for _, id := range toolUseIds {
+			if result, ok := results[id]; ok {
+				grouped = append(grouped, result)
+			}
+		}
+		if i+1 < len(messages) && messages[i+1].Role == "user" {
+			switch content := messages[i+1].Content.(type) {
+			case []dto.ClaudeMediaMessage:
+				messages[i+1].Content = append(grouped, content...)
+			case string:
+				messages[i+1].Content = append(grouped, dto.ClaudeMediaMessage{Type: "text", Text: common.GetPointer[string](content)})
+			}
+			delete(emptied, i+1)
+			continue
+		}
+		messages = slices.Insert(messages, i+1, dto.ClaudeMessage{Role: "user", Content: grouped})
+		shifted := make(map[int]bool, len(emptied))
+		for index := range emptied {
+			if index > i {
+				index++
+			}
+			shifted[index] = true
+		}
+		emptied = shifted
+	}
+	if len(emptied) == 0 {
+		return messages
+	}
+	result := make([]dto.ClaudeMessage, 0, len(messages)-len(emptied))
+	for i, message := range messages {
+		if !emptied[i] {
+			result = append(result, message)
+		}
+	}
+	return result
+}
+
+// claudeToolUseIds 返回 assistant 消息中 tool_use block 的 id，保持原有顺序
+func claudeToolUseIds(message dto.ClaudeMessage) []string {
+	if message.Role != "assistant" {
+		return nil
+	}
+	blocks, ok := message.Content.([]dto.ClaudeMediaMessage)
+	if !ok {
+		return nil
+	}
+	var ids []string
+	for _, block := range blocks {
+		if block.Type == "tool_use" && block.Id != "" {
+			ids = append(ids, block.Id)
+		}
+	}
+	return ids
+}
+
+// claudeServiceTier 把 OpenAI 的 service_tier 映射为 Anthropic 的取值：priority 对应可使用优先容量的 auto，
+// default/flex 对应 standard_only；Anthropic 原生取值及未知取值原样透传
+func claudeServiceTier(serviceTier string) string {
+	switch serviceTier {
+	case "priority":
+		return "auto"
+	case "default", "flex":
+		return "standard_only"
+	default:
+		return serviceTier
+	}
+}
+
+// toolResultIsError 判断 tool 消息是否为失败结果：优先使用显式的 is_error，
+// 否则按惯例把顶层 error 字段为非零、非 false、非空值的 JSON 对象视为失败
+func toolResultIsError(message dto.Message) *bool {
+	if message.IsError != nil {
+		if *message.IsError {
+			return message.IsError
+		}
+		return nil
+	}
+	if !message.IsStringContent() {
+		return nil
+	}
+	var payload map[string]any
+	if err := common.UnmarshalJsonStr(message.StringContent(), &payload); err != nil {
+		return nil
+	}
+	if isErrorValueSet(payload["error"]) {
+		return common.GetPointer(true)
+	}
+	return nil
+}
+
+// isErrorValueSet 判断 error 字段是否表示失败：null、false、0、空字符串、空对象/数组都不算
+func isErrorValueSet(value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case map[string]any:
+		return len(v) > 0
+	case []any:
+		return len(v) > 0
+	default:
+		return true
+	}
+}
+
+// claudeFileResolver 负责把一次请求中的图片/文件解析为 base64，并累计已内联的总字节数
+type claudeFileResolver struct {
+	c            *gin.Context
+	prefetched   map[string]claudeResolvedFile
+	inlinedBytes atomic.Int64
+	// 开启 SkipUnfetchableImages 时记录下载失败的 URL，转换时跳过
+	unfetchable map[string]struct{}
+}
+
+type claudeResolvedFile struct {
+	base64Data string
+	mimeType   string
+}
+
+// addInlinedBytes 累加内联字节数，超出 MaxRequestBytes 时返回 413 错误
+func addInlinedBytes(counter *atomic.Int64, size int) error {
+	total := counter.Add(int64(size))
+	if maxBytes := model_setting.GetClaudeSettings().GetMaxRequestBytes(); maxBytes > 0 && total > maxBytes {
+		return inlinedFilesTooLargeError(maxBytes)
+	}
+	return nil
+}
+
+func inlinedFilesTooLargeError(maxBytes int64) error {
+	return types.NewErrorWithStatusCode(fmt.Errorf("%w: inlined files exceed %d bytes", common.ErrRequestBodyTooLarge, maxBytes), types.ErrorCodeRequestBodyTooLarge, http.StatusRequestEntityTooLarge, types.ErrOptionWithSkipRetry())
+}
+
+// resolveWithinLimit 下载并解析文件，只允许使用 counter 剩余的内联额度：
+// 远程文件声明的 Content-Length 超出剩余额度时不读取响应体，直接返回 413 错误
+func (r *claudeFileResolver) resolveWithinLimit(ctx context.Context, counter *atomic.Int64, source types.FileSource) (string, string, error) {
+	var rawLimit int64
+	maxBytes := model_setting.GetClaudeSettings().GetMaxRequestBytes()
+	if maxBytes > 0 {
+		remaining := maxBytes - counter.Load()
+		if remaining <= 0 {
+			return "", "", inlinedFilesTooLargeError(maxBytes)
+		}
+		// 额度按 base64 长度计算，远程文件大小按原始字节比较
+		rawLimit = int64(base64.StdEncoding.DecodedLen(int(remaining)))
+	}
+	base64Data, mimeType, err := relaymedia.ResolveBase64DataWithLimit(ctx, r.c, source, rawLimit, "formatting image for Claude")
+	if err != nil && errors.Is(err, common.ErrRequestBodyTooLarge) {
+		return "", "", inlinedFilesTooLargeError(maxBytes)
+	}
+	return base64Data, mimeType, err
+}
+
+// logSkippedFile 记录按设置跳过的下载失败文件，URL 的查询参数中可能带有签名，日志中做脱敏处理
+func logSkippedFile(url string, err error) {
+	common.SysLog(common.MaskSensitiveInfo(fmt.Sprintf("skip unfetchable file %s: %s", url, err.Error())))
+}
+
+// requestContext 返回客户端请求的 context，客户端断开时下载随之取消
+func (r *claudeFileResolver) requestContext() context.Context {
+	if r.c != nil && r.c.Request != nil {
+		return r.c.Request.Context()
+	}
+	return context.Background()
+}
+
+// prefetchRemoteFiles 并发下载所有远程 URL 文件，避免消息循环中逐个串行下载导致超时；
+// 任一下载失败或总大小超限时，尚未开始的下载不再进行
+func (r *claudeFileResolver) prefetchRemoteFiles(messages []dto.Message) error {
+	var urls []string
+	seen := make(map[string]struct{})
+	for _, message := range messages {
+		if message.IsStringContent() {
+			continue
+		}
+		for _, mediaMessage := range message.ParseContent() {
+			urlSource, ok := mediaMessage.ToFileSource().(*types.URLSource)
+			if !ok {
+				continue
+			}
+			if _, exists := seen[urlSource.URL]; exists {
+				continue
+			}
+			seen[urlSource.URL] = struct{}{}
+			urls = append(urls, urlSource.URL)
+		}
+	}
+	if len(urls) < 2 {
+		return nil
+	}
+
+	// 预取阶段单独计数，仅用于提前终止；正式计数在 fileBlock 中按实际使用次数进行
+	var prefetchedBytes atomic.Int64
+	skipUnfetchable := model_setting.GetClaudeSettings().SkipUnfetchableImages
+	results := make([]claudeResolvedFile, len(urls))
+	failed := make([]bool, len(urls))
+	g, gCtx := errgroup.WithContext(r.requestContext())
+	g.SetLimit(claudeFilePrefetchConcurrency)
+	for i, url := range urls {
+		if gCtx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			if gCtx.Err() != nil {
+				return gCtx.Err()
+			}
+			base64Data, mimeType, err := r.resolveWithinLimit(gCtx, &prefetchedBytes, types.NewURLFileSource(url))
+			if err != nil {
+				// 超出内联额度不属于下载失败，不受 SkipUnfetchableImages 影响
+				if errors.Is(err, common.ErrRequestBodyTooLarge) {
+					return err
+				}
+				if skipUnfetchable {
+					logSkippedFile(url, err)
+					failed[i] = true
+					return nil
+				}
+				return fmt.Errorf("get file data failed: %s", err.Error())
+			}
+			if err := addInlinedBytes(&prefetchedBytes, len(base64Data)); err != nil {
+				return err
+			}
+			results[i] = claudeResolvedFile{base64Data: base64Data, mimeType: mimeType}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	r.prefetched = make(map[string]claudeResolvedFile, len(urls))
+	for i, url := range urls {
+		if failed[i] {
+			if r.unfetchable == nil {
+				r.unfetchable = make(map[string]struct{})
+			}
+			r.unfetchable[url] = struct{}{}
+			continue
+		}
+		r.prefetched[url] = results[i]
+	}
+	return nil
+}
+
+// fileBlock 把 OpenAI 的图片/文件内容转换为 Claude 的 image 或 document block，
+// 内容不是文件类型或按设置跳过下载失败的 URL 时返回 nil；内联总大小超出上限时立即返回错误，不再继续下载
+func (r *claudeFileResolver) fileBlock(mediaMessage dto.MediaContent) (*dto.ClaudeMediaMessage, error) {
+	if mediaMessage.Type == dto.ContentTypeInputAudio {
+		return r.audioBlock(mediaMessage)
+	}
+	source := mediaMessage.ToFileSource()
+	if source == nil {
+		return nil, nil
+	}
+	if base64Source, ok := source.(*types.Base64Source); ok && isDataURL(base64Source.Base64Data) {
+		mediaType, data, err := parseBase64DataURL(base64Source.Base64Data)
+		if err != nil {
+			return nil, types.NewErrorWithStatusCode(err, types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		}
+		// 统一为不带参数的 data:<media type>;base64, 形式，避免参数被误当作 media type
+		source = types.NewBase64FileSource("data:"+mediaType+";base64,"+data, base64Source.MimeType)
+	}
+	var resolved claudeResolvedFile
+	prefetched := false
+	urlSource, isURL := source.(*types.URLSource)
+	if isURL {
+		if _, skipped := r.unfetchable[urlSource.URL]; skipped {
+			return nil, nil
+		}
+		resolved, prefetched = r.prefetched[urlSource.URL]
+	}
+	if !prefetched {
+		base64Data, mimeType, err := r.resolveWithinLimit(r.requestContext(), &r.inlinedBytes, source)
+		if err != nil {
+			// 超出内联额度不属于下载失败，不受 SkipUnfetchableImages 影响
+			if errors.Is(err, common.ErrRequestBodyTooLarge) {
+				return nil, err
+			}
+			if isURL && model_setting.GetClaudeSettings().SkipUnfetchableImages {
+				logSkippedFile(urlSource.URL, err)
+				return nil, nil
+			}
+			return nil, fmt.Errorf("get file data failed: %s", err.Error())
+		}
+		resolved = claudeResolvedFile{base64Data: base64Data, mimeType: mimeType}
+	}
+	if err := addInlinedBytes(&r.inlinedBytes, len(resolved.base64Data)); err != nil {
+		return nil, err
+	}
+	base64Data, mimeType := resolved.base64Data, resolved.mimeType
+	fileBlock := &dto.ClaudeMediaMessage{
+		Type: "image",
+		Source: &dto.ClaudeMessageSource{
+			Type:      "base64",
+			MediaType: mimeType,
+			Data:      base64Data,
+		},
+	}
+	if strings.HasPrefix(mimeType, "application/pdf") {
+		fileBlock.Type = "document"
+		// 引用只对 document 生效，按客户端在 file 内容上的扩展参数开启
+		fileBlock.Citations = mediaMessage.Citations
+		return fileBlock, nil
+	}
+	mediaType, err := claudeImageMediaType(mimeType)
+	if err != nil {
+		return nil, err
+	}
+	fileBlock.Source.MediaType = mediaType
+	return fileBlock, nil
+}
+
+// isDataURL 判断字符串是否为 data URL，scheme 不区分大小写
+func isDataURL(value string) bool {
+	return len(value) >= len("data:") && strings.EqualFold(value[:len("data:")], "data:")
+}
+
+// parseBase64DataURL 解析 data URL 头部，返回去掉参数并转为小写的 media type 与 base64 数据，
+// 兼容 data:image/png;charset=utf-8;base64,... 这类携带参数的写法；未声明 media type 时返回空串，由后续按内容识别
+func parseBase64DataURL(dataURL string) (string, string, error) {
+	header, data, found := strings.Cut(dataURL[len("data:"):], ",")
+	if !found {
+		return "", "", errors.New("invalid data url: missing ',' separator")
+	}
+	params := strings.Split(header, ";")
+	mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+	isBase64 := false
+	for _, param := range params[1:] {
+		if strings.EqualFold(strings.TrimSpace(param), "base64") {
+			isBase64 = true
+		}
+	}
+	if !isBase64 {
+		return "", "", errors.New("invalid data url: only base64 encoded data is supported")
+	}
+	return mediaType, strings.TrimSpace(data), nil
+}
+
+// audioBlock 拒绝 Claude 不支持的 input_audio，避免音频被当作图片发往上游
+func (r *claudeFileResolver) audioBlock(mediaMessage dto.MediaContent) (*dto.ClaudeMediaMessage, error) {
+	audio := mediaMessage.GetInputAudio()
+	if audio == nil || audio.Data == "" {
+		return nil, nil
+	}
+	return nil, types.NewErrorWithStatusCode(errors.New("claude does not support input_audio content"), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+}
+
+// claudeImageMediaTypes 是 Claude image block 支持的 media_type
+var claudeImageMediaTypes = map[string]struct{}{
+	"image/jpeg": {},
+	"image/png":  {},
+	"image/gif":  {},
+	"image/webp": {},
+}
+
+// claudeImageMediaType 把识别出的图片类型规范为 Claude 接受的 media_type，不支持的格式（如 bmp）直接报错，避免转发后被上游拒绝
+func claudeImageMediaType(mimeType string) (string, error) {
+	mediaType := strings.ToLower(strings.TrimSpace(mimeType))
+	if idx := strings.Index(mediaType, ";"); idx >= 0 {
+		mediaType = strings.TrimSpace(mediaType[:idx])
+	}
+	if mediaType == "image/jpg" {
+		mediaType = "image/jpeg"
+	}
+	if _, ok := claudeImageMediaTypes[mediaType]; !ok {
+		return "", fmt.Errorf("claude does not support image media type %q, supported types are image/jpeg, image/png, image/gif and image/webp", mimeType)
+	}
+	return mediaType, nil
+}
@@ -0,0 +1,1283 @@
+package oaichat
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	relaymedia "github.com/QuantumNous/new-api/service/relayconvert/internal/media"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/types"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAIChatRequestToClaudeMessagesKeepsEverySystemMessage(t *testing.T) {
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, dto.GeneralOpenAIRequest{
+		Model: "claude-sonnet-4-5-20250929",
+		Messages: []dto.Message{
+			{Role: "system", Content: "You are a helpful persona."},
+			{Role: "system", Content: "Tool instructions: call lookup first."},
+			{Role: "user", Content: "hello"},
+			{Role: "assistant", Content: "hi"},
+			{Role: "user", Content: "bye"},
+		},
+	})
+	require.NoError(t, err)
+
+	systemBlocks, ok := claudeRequest.System.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.Len(t, systemBlocks, 2)
+	assert.Equal(t, "You are a helpful persona.", systemBlocks[0].GetText())
+	assert.Equal(t, "Tool instructions: call lookup first.", systemBlocks[1].GetText())
+
+	require.Len(t, claudeRequest.Messages, 3)
+	assert.Equal(t, []string{"user", "assistant", "user"}, []string{
+		claudeRequest.Messages[0].Role,
+		claudeRequest.Messages[1].Role,
+		claudeRequest.Messages[2].Role,
+	})
+	assert.Equal(t, "hello", claudeRequest.Messages[0].Content)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesCapsClientCacheBreakpoints(t *testing.T) {
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [
+			{"role": "system", "content": [
+				{"type": "text", "text": "rules", "cache_control": {"type": "ephemeral"}},
+				{"type": "text", "text": "tools", "cache_control": {"type": "ephemeral"}}
+			]},
+			{"role": "user", "content": [
+				{"type": "text", "text": "doc one", "cache_control": {"type": "ephemeral"}},
+				{"type": "text", "text": "doc two", "cache_control": {"type": "ephemeral"}}
+			]},
+			{"role": "assistant", "content": "ok"},
+			{"role": "user", "content": [
+				{"type": "text", "text": "question", "cache_control": {"type": "ephemeral"}}
+			]}
+		]
+	}`, &request))
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+
+	breakpoints := 0
+	systemBlocks, ok := claudeRequest.System.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	for _, block := range systemBlocks {
+		if len(block.CacheControl) > 0 {
+			breakpoints++
+		}
+	}
+	for _, message := range claudeRequest.Messages {
+		blocks, ok := message.Content.([]dto.ClaudeMediaMessage)
+		if !ok {
+			continue
+		}
+		for _, block := range blocks {
+			if len(block.CacheControl) > 0 {
+				breakpoints++
+			}
+		}
+	}
+	assert.Equal(t, claudeMaxCacheBreakpoints, breakpoints)
+	assert.JSONEq(t, `{"type":"ephemeral"}`, string(systemBlocks[0].CacheControl))
+
+	lastBlocks, ok := claudeRequest.Messages[2].Content.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.Len(t, lastBlocks, 1)
+	assert.Empty(t, lastBlocks[0].CacheControl)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesConvertsImageToolResult(t *testing.T) {
+	relaymedia.SetMediaResolver(relaymedia.MediaResolver{
+		GetBase64Data: func(_ *gin.Context, source types.FileSource, _ ...string) (string, string, error) {
+			return "iVBORw0KGgo=", "image/png", nil
+		},
+	})
+	t.Cleanup(func() { relaymedia.SetMediaResolver(relaymedia.MediaResolver{}) })
+
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [
+			{"role": "user", "content": "take a screenshot"},
+			{"role": "assistant", "content": null, "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "screenshot", "arguments": "{}"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": [
+				{"type": "text", "text": "captured"},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0KGgo="}}
+			]}
+		]
+	}`, &request))
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+	require.Len(t, claudeRequest.Messages, 3)
+
+	toolMessage := claudeRequest.Messages[2]
+	assert.Equal(t, "user", toolMessage.Role)
+	blocks, ok := toolMessage.Content.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.Len(t, blocks, 1)
+	assert.Equal(t, "tool_result", blocks[0].Type)
+	assert.Equal(t, "call_1", blocks[0].ToolUseId)
+
+	resultBlocks, ok := blocks[0].Content.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.Len(t, resultBlocks, 2)
+	assert.Equal(t, "text", resultBlocks[0].Type)
+	assert.Equal(t, "captured", resultBlocks[0].GetText())
+	assert.Equal(t, "image", resultBlocks[1].Type)
+	require.NotNil(t, resultBlocks[1].Source)
+	assert.Equal(t, "base64", resultBlocks[1].Source.Type)
+	assert.Equal(t, "image/png", resultBlocks[1].Source.MediaType)
+	assert.Equal(t, "iVBORw0KGgo=", resultBlocks[1].Source.Data)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesTreatsDeveloperAsSystem(t *testing.T) {
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [
+			{"role": "developer", "content": "answer in French"},
+			{"role": "user", "content": "hello"}
+		]
+	}`, &request))
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+
+	systemBlocks, ok := claudeRequest.System.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.Len(t, systemBlocks, 1)
+	assert.Equal(t, "answer in French", systemBlocks[0].GetText())
+
+	require.Len(t, claudeRequest.Messages, 1)
+	assert.Equal(t, "user", claudeRequest.Messages[0].Role)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesKeepsQuotesWhenMergingSameRoleMessages(t *testing.T) {
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [
+			{"role": "user", "content": "\"hello\""},
+			{"role": "user", "content": "say \"bye\""}
+		]
+	}`, &request))
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+	require.Len(t, claudeRequest.Messages, 1)
+
+	assert.Equal(t, `"hello" say "bye"`, claudeRequest.Messages[0].Content)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesKeepsAssistantTextWithToolCalls(t *testing.T) {
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [
+			{"role": "user", "content": "weather in Paris?"},
+			{"role": "assistant", "content": "Let me check.", "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Paris\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "sunny"}
+		]
+	}`, &request))
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+	require.Len(t, claudeRequest.Messages, 3)
+
+	assistantMessage := claudeRequest.Messages[1]
+	assert.Equal(t, "assistant", assistantMessage.Role)
+	blocks, ok := assistantMessage.Content.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.Len(t, blocks, 2)
+	assert.Equal(t, "text", blocks[0].Type)
+	assert.Equal(t, "Let me check.", blocks[0].GetText())
+	assert.Equal(t, "tool_use", blocks[1].Type)
+	assert.Equal(t, "call_1", blocks[1].Id)
+	assert.Equal(t, "get_weather", blocks[1].Name)
+	assert.Equal(t, map[string]any{"city": "Paris"}, blocks[1].Input)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesMapsPDFToDocumentBlock(t *testing.T) {
+	relaymedia.SetMediaResolver(relaymedia.MediaResolver{
+		GetBase64Data: func(_ *gin.Context, source types.FileSource, _ ...string) (string, string, error) {
+			if source.IsURL() {
+				// 模拟下载远程 PDF
+				return "JVBERi0xLjQ=", "application/pdf", nil
+			}
+			mimeType, data, _ := strings.Cut(strings.TrimPrefix(source.GetRawData(), "data:"), ";base64,")
+			return data, mimeType, nil
+		},
+	})
+	t.Cleanup(func() { relaymedia.SetMediaResolver(relaymedia.MediaResolver{}) })
+
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [
+			{"role": "user", "content": [
+				{"type": "text", "text": "summarize these"},
+				{"type": "file", "file": {"filename": "report.pdf", "file_data": "data:application/pdf;base64,JVBERi0xLjQ="}},
+				{"type": "image_url", "image_url": {"url": "https://example.com/report.pdf"}},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0KGgo="}}
+			]}
+		]
+	}`, &request))
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+	require.Len(t, claudeRequest.Messages, 1)
+
+	blocks, ok := claudeRequest.Messages[0].Content.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.Len(t, blocks, 4)
+	for _, block := range blocks[1:3] {
+		assert.Equal(t, "document", block.Type)
+		require.NotNil(t, block.Source)
+		assert.Equal(t, "base64", block.Source.Type)
+		assert.Equal(t, "application/pdf", block.Source.MediaType)
+		assert.Equal(t, "JVBERi0xLjQ=", block.Source.Data)
+	}
+	assert.Equal(t, "image", blocks[3].Type)
+	assert.Equal(t, "image/png", blocks[3].Source.MediaType)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesWrapsNonObjectToolArguments(t *testing.T) {
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [
+			{"role": "user", "content": "run both"},
+			{"role": "assistant", "content": null, "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "count", "arguments": "123"}},
+				{"id": "call_2", "type": "function", "function": {"name": "lookup", "arguments": "{\"q\": broken"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "ok"},
+			{"role": "tool", "tool_call_id": "call_2", "content": "ok"}
+		]
+	}`, &request))
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+	require.Len(t, claudeRequest.Messages, 3)
+
+	blocks, ok := claudeRequest.Messages[1].Content.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.GreaterOrEqual(t, len(blocks), 2)
+	blocks = blocks[len(blocks)-2:]
+	assert.Equal(t, "tool_use", blocks[0].Type)
+	assert.Equal(t, "call_1", blocks[0].Id)
+	assert.Equal(t, map[string]any{"value": float64(123)}, blocks[0].Input)
+	assert.Equal(t, "tool_use", blocks[1].Type)
+	assert.Equal(t, "call_2", blocks[1].Id)
+	assert.Equal(t, map[string]any{"value": `{"q": broken`}, blocks[1].Input)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesRejectsInvalidToolInputSchema(t *testing.T) {
+	testCases := []struct {
+		name       string
+		parameters string
+		message    string
+	}{
+		{
+			name:       "missing type",
+			parameters: `{"properties": {"city": {"type": "string"}}}`,
+			message:    `type must be "object"`,
+		},
+		{
+			name:       "required references undefined property",
+			parameters: `{"type": "object", "properties": {"city": {"type": "string"}}, "required": ["country"]}`,
+			message:    "required property country is not defined",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var request dto.GeneralOpenAIRequest
+			require.NoError(t, common.UnmarshalJsonStr(`{
+				"model": "claude-sonnet-4-5-20250929",
+				"messages": [{"role": "user", "content": "weather?"}],
+				"tools": [{"type": "function", "function": {"name": "get_weather", "parameters": `+tc.parameters+`}}]
+			}`, &request))
+
+			_, err := OpenAIChatRequestToClaudeMessages(nil, request)
+			require.Error(t, err)
+			var apiErr *types.NewAPIError
+			require.ErrorAs(t, err, &apiErr)
+			assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+			assert.Equal(t, types.ErrorCodeInvalidRequest, apiErr.GetErrorCode())
+			assert.Contains(t, err.Error(), `tool "get_weather"`)
+			assert.Contains(t, err.Error(), tc.message)
+		})
+	}
+}
+
+func TestOpenAIChatRequestToClaudeMessagesAcceptsEmptyToolParameters(t *testing.T) {
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [{"role": "user", "content": "time?"}],
+		"tools": [{"type": "function", "function": {"name": "get_time", "parameters": {}}}]
+	}`, &request))
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+	require.Len(t, claudeRequest.Tools, 1)
+	tool, ok := claudeRequest.Tools.([]any)[0].(*dto.Tool)
+	require.True(t, ok)
+	assert.Equal(t, "object", tool.InputSchema["type"])
+}
+
+func TestOpenAIChatRequestToClaudeMessagesRejectsOversizedInlinedFiles(t *testing.T) {
+	resolved := 0
+	relaymedia.SetMediaResolver(relaymedia.MediaResolver{
+		GetBase64Data: func(_ *gin.Context, source types.FileSource, _ ...string) (string, string, error) {
+			resolved++
+			return strings.Repeat("A", 600), "image/png", nil
+		},
+	})
+	t.Cleanup(func() { relaymedia.SetMediaResolver(relaymedia.MediaResolver{}) })
+
+	settings := model_setting.GetClaudeSettings()
+	original := settings.MaxRequestBytes
+	settings.MaxRequestBytes = 1000
+	t.Cleanup(func() { settings.MaxRequestBytes = original })
+
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [
+			{"role": "user", "content": [
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0KGgo1"}},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0KGgo2"}},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0KGgo3"}}
+			]}
+		]
+	}`, &request))
+
+	_, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.Error(t, err)
+	var apiErr *types.NewAPIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, apiErr.StatusCode)
+	assert.Equal(t, types.ErrorCodeRequestBodyTooLarge, apiErr.GetErrorCode())
+	assert.ErrorIs(t, err, common.ErrRequestBodyTooLarge)
+	// 超限后不再下载剩余的图片
+	assert.Equal(t, 2, resolved)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesRejectsRemoteFileByContentLength(t *testing.T) {
+	var slowCancelled atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow.png" {
+			select {
+			case <-r.Context().Done():
+				slowCancelled.Store(true)
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Header().Set("Content-Length", "4096")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(make([]byte, 4096))
+	}))
+	defer server.Close()
+
+	var limits sync.Map
+	relaymedia.SetMediaResolver(relaymedia.MediaResolver{
+		GetBase64DataWithLimit: func(ctx context.Context, _ *gin.Context, source types.FileSource, maxBytes int64, _ ...string) (string, string, error) {
+			url := source.(*types.URLSource).URL
+			limits.Store(url, maxBytes)
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+			if err != nil {
+				return "", "", err
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return "", "", err
+			}
+			defer resp.Body.Close()
+			if maxBytes > 0 && resp.ContentLength > maxBytes {
+				return "", "", fmt.Errorf("%w: declared %d bytes", common.ErrRequestBodyTooLarge, resp.ContentLength)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return "", "", err
+			}
+			return base64.StdEncoding.EncodeToString(body), "image/png", nil
+		},
+	})
+	t.Cleanup(func() { relaymedia.SetMediaResolver(relaymedia.MediaResolver{}) })
+
+	settings := model_setting.GetClaudeSettings()
+	original := settings.MaxRequestBytes
+	settings.MaxRequestBytes = 1000
+	t.Cleanup(func() { settings.MaxRequestBytes = original })
+
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [{"role": "user", "content": [
+			{"type": "image_url", "image_url": {"url": "`+server.URL+`/slow.png"}},
+			{"type": "image_url", "image_url": {"url": "`+server.URL+`/big.png"}}
+		]}]
+	}`, &request))
+
+	start := time.Now()
+	_, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.Error(t, err)
+	var apiErr *types.NewAPIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, apiErr.StatusCode)
+	assert.Equal(t, types.ErrorCodeRequestBodyTooLarge, apiErr.GetErrorCode())
+	// 超限后正在进行的下载随之取消，无需等待慢速下载完成
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.Eventually(t, slowCancelled.Load, time.Second, 10*time.Millisecond)
+	limit, ok := limits.Load(server.URL + "/big.png")
+	require.True(t, ok)
+	assert.Equal(t, int64(base64.StdEncoding.DecodedLen(1000)), limit)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesFetchesRemoteImagesConcurrently(t *testing.T) {
+	var inFlight, maxInFlight, requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			peak := maxInFlight.Load()
+			if current <= peak || maxInFlight.CompareAndSwap(peak, current) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	relaymedia.SetMediaResolver(relaymedia.MediaResolver{
+		GetBase64Data: func(_ *gin.Context, source types.FileSource, _ ...string) (string, string, error) {
+			resp, err := http.Get(source.(*types.URLSource).URL)
+			if err != nil {
+				return "", "", err
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return "", "", err
+			}
+			return base64.StdEncoding.EncodeToString(body), "image/png", nil
+		},
+	})
+	t.Cleanup(func() { relaymedia.SetMediaResolver(relaymedia.MediaResolver{}) })
+
+	parts := make([]string, 0, 10)
+	for i := 0; i < 10; i++ {
+		parts = append(parts, fmt.Sprintf(`{"type": "image_url", "image_url": {"url": "%s/%d.png"}}`, server.URL, i))
+	}
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [{"role": "user", "content": [`+strings.Join(parts, ",")+`]}]
+	}`, &request))
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+	require.Len(t, claudeRequest.Messages, 1)
+	blocks, ok := claudeRequest.Messages[0].Content.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.Len(t, blocks, 10)
+	for i, block := range blocks {
+		assert.Equal(t, base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("/%d.png", i))), block.Source.Data)
+	}
+	assert.Equal(t, int32(10), requests.Load())
+	assert.Greater(t, maxInFlight.Load(), int32(1))
+	assert.LessOrEqual(t, maxInFlight.Load(), int32(claudeFilePrefetchConcurrency))
+}
+
+func TestOpenAIChatRequestToClaudeMessagesAbortsWhenRemoteImageFetchFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken.png" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	relaymedia.SetMediaResolver(relaymedia.MediaResolver{
+		GetBase64Data: func(_ *gin.Context, source types.FileSource, _ ...string) (string, string, error) {
+			resp, err := http.Get(source.(*types.URLSource).URL)
+			if err != nil {
+				return "", "", err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return "", "", fmt.Errorf("failed to download file, status code: %d", resp.StatusCode)
+			}
+			return "b2s=", "image/png", nil
+		},
+	})
+	t.Cleanup(func() { relaymedia.SetMediaResolver(relaymedia.MediaResolver{}) })
+
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [{"role": "user", "content": [
+			{"type": "image_url", "image_url": {"url": "`+server.URL+`/ok.png"}},
+			{"type": "image_url", "image_url": {"url": "`+server.URL+`/broken.png"}}
+		]}]
+	}`, &request))
+
+	_, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.EqualError(t, err, "get file data failed: failed to download file, status code: 404")
+}
+
+func TestOpenAIChatRequestToClaudeMessagesNormalizesReasoningEffort(t *testing.T) {
+	testCases := []struct {
+		effort string
+		budget int
+	}{
+		{effort: "minimal", budget: 1280},
+		{effort: "LOW", budget: 1280},
+		{effort: " Medium ", budget: 2048},
+		{effort: "high", budget: 4096},
+		{effort: "xhigh", budget: 4096},
+		{effort: "none"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.effort, func(t *testing.T) {
+			claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, dto.GeneralOpenAIRequest{
+				Model:           "claude-sonnet-4-5-20250929",
+				Messages:        []dto.Message{{Role: "user", Content: "hello"}},
+				ReasoningEffort: tc.effort,
+			})
+			require.NoError(t, err)
+			if tc.budget == 0 {
+				assert.Nil(t, claudeRequest.Thinking)
+				return
+			}
+			require.NotNil(t, claudeRequest.Thinking)
+			require.NotNil(t, claudeRequest.Thinking.BudgetTokens)
+			assert.Equal(t, tc.budget, *claudeRequest.Thinking.BudgetTokens)
+		})
+	}
+}
+
+func TestOpenAIChatRequestToClaudeMessagesRejectsUnknownReasoningEffort(t *testing.T) {
+	_, err := OpenAIChatRequestToClaudeMessages(nil, dto.GeneralOpenAIRequest{
+		Model:           "claude-sonnet-4-5-20250929",
+		Messages:        []dto.Message{{Role: "user", Content: "hello"}},
+		ReasoningEffort: "extreme",
+	})
+	var apiErr *types.NewAPIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	assert.Contains(t, err.Error(), `unsupported reasoning_effort "extreme"`)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesPrefersReasoningOverReasoningEffort(t *testing.T) {
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, dto.GeneralOpenAIRequest{
+		Model:           "claude-sonnet-4-5-20250929",
+		Messages:        []dto.Message{{Role: "user", Content: "hello"}},
+		ReasoningEffort: "high",
+		Reasoning:       []byte(`{"max_tokens": 3000}`),
+	})
+	require.NoError(t, err)
+	require.NotNil(t, claudeRequest.Thinking)
+	require.NotNil(t, claudeRequest.Thinking.BudgetTokens)
+	assert.Equal(t, 3000, *claudeRequest.Thinking.BudgetTokens)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesAddsCacheControlToLongStringSystem(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	original := settings.SystemCacheControlMinChars
+	settings.SystemCacheControlMinChars = 100
+	t.Cleanup(func() { settings.SystemCacheControlMinChars = original })
+
+	newRequest := func(system string) dto.GeneralOpenAIRequest {
+		return dto.GeneralOpenAIRequest{
+			Model: "claude-sonnet-4-5-20250929",
+			Messages: []dto.Message{
+				{Role: "system", Content: system},
+				{Role: "user", Content: "hello"},
+			},
+		}
+	}
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, newRequest(strings.Repeat("static rules ", 20)))
+	require.NoError(t, err)
+	systemBlocks, ok := claudeRequest.System.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.Len(t, systemBlocks, 1)
+	assert.JSONEq(t, `{"type":"ephemeral"}`, string(systemBlocks[0].CacheControl))
+
+	claudeRequest, err = OpenAIChatRequestToClaudeMessages(nil, newRequest("short"))
+	require.NoError(t, err)
+	systemBlocks, ok = claudeRequest.System.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.Len(t, systemBlocks, 1)
+	assert.Empty(t, systemBlocks[0].CacheControl)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesAutoCacheControlYieldsToClientBreakpoints(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	originalSystem, originalAssistant := settings.SystemCacheControlMinChars, settings.AssistantCacheControlMinMessages
+	settings.SystemCacheControlMinChars = 10
+	settings.AssistantCacheControlMinMessages = 2
+	t.Cleanup(func() {
+		settings.SystemCacheControlMinChars = originalSystem
+		settings.AssistantCacheControlMinMessages = originalAssistant
+	})
+
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"tools": [
+			{"type": "function", "function": {"name": "lookup", "parameters": {"type": "object"}}, "cache_control": {"type": "ephemeral"}}
+		],
+		"messages": [
+			{"role": "system", "content": "a long static system prompt"},
+			{"role": "user", "content": [
+				{"type": "text", "text": "doc one", "cache_control": {"type": "ephemeral"}},
+				{"type": "text", "text": "doc two", "cache_control": {"type": "ephemeral"}}
+			]},
+			{"role": "assistant", "content": "ok"},
+			{"role": "user", "content": [
+				{"type": "text", "text": "question", "cache_control": {"type": "ephemeral"}}
+			]}
+		]
+	}`, &request))
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+
+	// 工具与消息上的 4 个客户端断点全部保留，自动断点没有剩余名额
+	require.Len(t, claudeRequest.Tools, 1)
+	assert.JSONEq(t, `{"type":"ephemeral"}`, string(claudeRequest.Tools.([]any)[0].(*dto.Tool).CacheControl))
+	systemBlocks, ok := claudeRequest.System.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	assert.Empty(t, systemBlocks[0].CacheControl)
+	breakpoints := 0
+	for _, message := range claudeRequest.Messages {
+		blocks, ok := message.Content.([]dto.ClaudeMediaMessage)
+		if !ok {
+			continue
+		}
+		for _, block := range blocks {
+			if len(block.CacheControl) > 0 {
+				assert.Equal(t, "user", message.Role)
+				breakpoints++
+			}
+		}
+	}
+	assert.Equal(t, 3, breakpoints)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesFillsEmptyAssistantContent(t *testing.T) {
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [
+			{"role": "user", "content": "first"},
+			{"role": "assistant", "content": [{"type": "text", "text": ""}]},
+			{"role": "user", "content": "second"},
+			{"role": "assistant", "content": "   "},
+			{"role": "user", "content": "third"}
+		]
+	}`, &request))
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+
+	require.Len(t, claudeRequest.Messages, 5)
+	assistantBlocks, ok := claudeRequest.Messages[1].Content.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.Len(t, assistantBlocks, 1)
+	assert.Equal(t, "text", assistantBlocks[0].Type)
+	assert.Equal(t, "...", assistantBlocks[0].GetText())
+	assert.Equal(t, "...", claudeRequest.Messages[3].Content)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesSkipsUnfetchableImagesWhenEnabled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken.png" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	relaymedia.SetMediaResolver(relaymedia.MediaResolver{
+		GetBase64Data: func(_ *gin.Context, source types.FileSource, _ ...string) (string, string, error) {
+			resp, err := http.Get(source.(*types.URLSource).URL)
+			if err != nil {
+				return "", "", err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return "", "", fmt.Errorf("failed to download file, status code: %d", resp.StatusCode)
+			}
+			return "b2s=", "image/png", nil
+		},
+	})
+	settings := model_setting.GetClaudeSettings()
+	original := settings.SkipUnfetchableImages
+	t.Cleanup(func() {
+		relaymedia.SetMediaResolver(relaymedia.MediaResolver{})
+		settings.SkipUnfetchableImages = original
+	})
+
+	newRequest := func(urls ...string) dto.GeneralOpenAIRequest {
+		content := []any{map[string]any{"type": "text", "text": "describe"}}
+		for _, url := range urls {
+			content = append(content, map[string]any{"type": "image_url", "image_url": map[string]any{"url": server.URL + url}})
+		}
+		return dto.GeneralOpenAIRequest{
+			Model:    "claude-sonnet-4-5-20250929",
+			Messages: []dto.Message{{Role: "user", Content: content}},
+		}
+	}
+	imageCount := func(claudeRequest *dto.ClaudeRequest) int {
+		blocks, ok := claudeRequest.Messages[0].Content.([]dto.ClaudeMediaMessage)
+		require.True(t, ok)
+		count := 0
+		for _, block := range blocks {
+			if block.Type == "image" {
+				count++
+			}
+		}
+		return count
+	}
+
+	settings.SkipUnfetchableImages = false
+	_, err := OpenAIChatRequestToClaudeMessages(nil, newRequest("/ok.png", "/broken.png"))
+	require.EqualError(t, err, "get file data failed: failed to download file, status code: 404")
+
+	settings.SkipUnfetchableImages = true
+	// 多个 URL 走并发预取
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, newRequest("/ok.png", "/broken.png"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, imageCount(claudeRequest))
+	// 单个 URL 在转换时直接下载
+	claudeRequest, err = OpenAIChatRequestToClaudeMessages(nil, newRequest("/broken.png"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, imageCount(claudeRequest))
+
+	// 日志中不输出 URL 的查询参数
+	var logs bytes.Buffer
+	originalWriter := gin.DefaultWriter
+	gin.DefaultWriter = &logs
+	t.Cleanup(func() { gin.DefaultWriter = originalWriter })
+	_, err = OpenAIChatRequestToClaudeMessages(nil, newRequest("/broken.png?signature=secret-token"))
+	require.NoError(t, err)
+	assert.Contains(t, logs.String(), "skip unfetchable file")
+	assert.NotContains(t, logs.String(), "secret-token")
+}
+
+func TestOpenAIChatRequestToClaudeMessagesMarksErrorToolResults(t *testing.T) {
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [
+			{"role": "user", "content": "check both cities"},
+			{"role": "assistant", "content": "", "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Paris\"}"}},
+				{"id": "call_2", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Atlantis\"}"}},
+				{"id": "call_3", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Rome\"}"}},
+				{"id": "call_4", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Oslo\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "{\"temp\":21,\"error\":null}"},
+			{"role": "tool", "tool_call_id": "call_2", "content": "{\"error\":\"unknown city\"}"},
+			{"role": "tool", "tool_call_id": "call_3", "content": "service unavailable", "is_error": true},
+			{"role": "tool", "tool_call_id": "call_4", "content": "{\"temp\":5,\"error\":0}"}
+		]
+	}`, &request))
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+
+	require.Len(t, claudeRequest.Messages, 3)
+	blocks, ok := claudeRequest.Messages[2].Content.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.Len(t, blocks, 4)
+	assert.Nil(t, blocks[0].IsError)
+	require.NotNil(t, blocks[1].IsError)
+	assert.True(t, *blocks[1].IsError)
+	require.NotNil(t, blocks[2].IsError)
+	assert.True(t, *blocks[2].IsError)
+	assert.Nil(t, blocks[3].IsError)
+
+	data, err := common.Marshal(blocks[1])
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"is_error":true`)
+
+	// 未设置 is_error 的 OpenAI 消息序列化时不带该字段
+	data, err = common.Marshal(request.Messages[2])
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "is_error")
+}
+
+func TestOpenAIChatRequestToClaudeMessagesAddsCacheControlToLastAssistantInLongConversation(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	original := settings.AssistantCacheControlMinMessages
+	settings.AssistantCacheControlMinMessages = 6
+	t.Cleanup(func() { settings.AssistantCacheControlMinMessages = original })
+
+	newRequest := func(turns int) dto.GeneralOpenAIRequest {
+		messages := []dto.Message{{Role: "user", Content: "start"}}
+		for i := 0; i < turns; i++ {
+			callId := fmt.Sprintf("call_%d", i)
+			var assistant dto.Message
+			require.NoError(t, common.UnmarshalJsonStr(fmt.Sprintf(`{"role":"assistant","content":"","tool_calls":[{"id":%q,"type":"function","function":{"name":"lookup","arguments":"{}"}}]}`, callId), &assistant))
+			messages = append(messages, assistant, dto.Message{Role: "tool", ToolCallId: callId, Content: "result"})
+		}
+		return dto.GeneralOpenAIRequest{Model: "claude-sonnet-4-5-20250929", Messages: messages}
+	}
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, newRequest(4))
+	require.NoError(t, err)
+	require.Len(t, claudeRequest.Messages, 9)
+	for i, message := range claudeRequest.Messages {
+		blocks, ok := message.Content.([]dto.ClaudeMediaMessage)
+		if !ok {
+			continue
+		}
+		for _, block := range blocks {
+			if i == 7 && block.Type == "tool_use" {
+				assert.JSONEq(t, `{"type":"ephemeral"}`, string(block.CacheControl))
+			} else {
+				assert.Empty(t, block.CacheControl)
+			}
+		}
+	}
+
+	claudeRequest, err = OpenAIChatRequestToClaudeMessages(nil, newRequest(2))
+	require.NoError(t, err)
+	require.Len(t, claudeRequest.Messages, 5)
+	for _, message := range claudeRequest.Messages {
+		blocks, ok := message.Content.([]dto.ClaudeMediaMessage)
+		if !ok {
+			continue
+		}
+		for _, block := range blocks {
+			assert.Empty(t, block.CacheControl)
+		}
+	}
+}
+
+func TestOpenAIChatRequestToClaudeMessagesRejectsLogprobs(t *testing.T) {
+	testCases := []struct {
+		name    string
+		request string
+	}{
+		{name: "logprobs", request: `{"model": "claude-sonnet-4-5-20250929", "logprobs": true, "messages": [{"role": "user", "content": "hello"}]}`},
+		{name: "top_logprobs", request: `{"model": "claude-sonnet-4-5-20250929", "top_logprobs": 5, "messages": [{"role": "user", "content": "hello"}]}`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var request dto.GeneralOpenAIRequest
+			require.NoError(t, common.UnmarshalJsonStr(tc.request, &request))
+
+			_, err := OpenAIChatRequestToClaudeMessages(nil, request)
+			require.Error(t, err)
+			var apiErr *types.NewAPIError
+			require.ErrorAs(t, err, &apiErr)
+			assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+			assert.Contains(t, err.Error(), "claude does not support logprobs")
+		})
+	}
+
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{"model": "claude-sonnet-4-5-20250929", "logprobs": false, "messages": [{"role": "user", "content": "hello"}]}`, &request))
+	_, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesConvertsTextPartsToolResult(t *testing.T) {
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [
+			{"role": "user", "content": "read the file"},
+			{"role": "assistant", "content": "", "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "read_file", "arguments": "{\"path\":\"a.txt\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": [
+				{"type": "text", "text": "line one"},
+				{"type": "text", "text": ""},
+				{"type": "text", "text": "line two"}
+			]}
+		]
+	}`, &request))
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+
+	require.Len(t, claudeRequest.Messages, 3)
+	blocks, ok := claudeRequest.Messages[2].Content.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.Len(t, blocks, 1)
+	assert.Equal(t, "tool_result", blocks[0].Type)
+	assert.Equal(t, "call_1", blocks[0].ToolUseId)
+
+	data, err := common.Marshal(blocks[0])
+	require.NoError(t, err)
+	var toolResult struct {
+		Content []map[string]any `json:"content"`
+	}
+	require.NoError(t, common.Unmarshal(data, &toolResult))
+	require.Len(t, toolResult.Content, 2)
+	assert.Equal(t, map[string]any{"type": "text", "text": "line one"}, toolResult.Content[0])
+	assert.Equal(t, map[string]any{"type": "text", "text": "line two"}, toolResult.Content[1])
+}
+
+func TestOpenAIChatRequestToClaudeMessagesEnforcesStopSequenceLimit(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	originalMax, originalTruncate := settings.MaxStopSequences, settings.StopSequencesTruncate
+	t.Cleanup(func() {
+		settings.MaxStopSequences = originalMax
+		settings.StopSequencesTruncate = originalTruncate
+	})
+	settings.MaxStopSequences = 2
+
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"stop": ["a", "b", "c"],
+		"messages": [{"role": "user", "content": "hello"}]
+	}`, &request))
+
+	settings.StopSequencesTruncate = false
+	_, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.Error(t, err)
+	var apiErr *types.NewAPIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	assert.Contains(t, err.Error(), "too many stop sequences")
+
+	settings.StopSequencesTruncate = true
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, claudeRequest.StopSequences)
+
+	// 默认不限制数量，与引入上限之前的行为一致
+	settings.MaxStopSequences = 0
+	settings.StopSequencesTruncate = false
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"stop": ["a", "b", "c", "d", "e", "f"],
+		"messages": [{"role": "user", "content": "hello"}]
+	}`, &request))
+	claudeRequest, err = OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+	assert.Len(t, claudeRequest.StopSequences, 6)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesHandlesSeed(t *testing.T) {
+	settings := model_setting.GetClaudeSettings()
+	original := settings.RejectSeed
+	t.Cleanup(func() { settings.RejectSeed = original })
+
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"seed": 42,
+		"messages": [{"role": "user", "content": "hello"}]
+	}`, &request))
+
+	settings.RejectSeed = false
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	_, err := OpenAIChatRequestToClaudeMessages(c, request)
+	require.NoError(t, err)
+	assert.Contains(t, recorder.Header().Get("X-New-Api-Warning"), "seed")
+
+	settings.RejectSeed = true
+	_, err = OpenAIChatRequestToClaudeMessages(nil, request)
+	require.Error(t, err)
+	var apiErr *types.NewAPIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	assert.Contains(t, err.Error(), "claude does not support seed")
+}
+
+func TestOpenAIChatRequestToClaudeMessagesRejectsMultipleChoices(t *testing.T) {
+	newRequest := func(n int) dto.GeneralOpenAIRequest {
+		var request dto.GeneralOpenAIRequest
+		require.NoError(t, common.UnmarshalJsonStr(fmt.Sprintf(`{
+			"model": "claude-sonnet-4-5-20250929",
+			"n": %d,
+			"messages": [{"role": "user", "content": "hello"}]
+		}`, n), &request))
+		return request
+	}
+
+	_, err := OpenAIChatRequestToClaudeMessages(nil, newRequest(2))
+	require.Error(t, err)
+	var apiErr *types.NewAPIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	assert.Contains(t, err.Error(), "claude does not support n > 1")
+
+	_, err = OpenAIChatRequestToClaudeMessages(nil, newRequest(1))
+	require.NoError(t, err)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesValidatesImageMediaType(t *testing.T) {
+	tests := []struct {
+		name      string
+		mimeType  string
+		wantType  string
+		wantError bool
+	}{
+		{name: "webp", mimeType: "image/webp", wantType: "image/webp"},
+		{name: "gif", mimeType: "image/gif", wantType: "image/gif"},
+		{name: "jpg alias", mimeType: "image/jpg", wantType: "image/jpeg"},
+		{name: "bmp", mimeType: "image/bmp", wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relaymedia.SetMediaResolver(relaymedia.MediaResolver{
+				GetBase64Data: func(_ *gin.Context, _ types.FileSource, _ ...string) (string, string, error) {
+					return "UklGRg==", tt.mimeType, nil
+				},
+			})
+			t.Cleanup(func() { relaymedia.SetMediaResolver(relaymedia.MediaResolver{}) })
+
+			var request dto.GeneralOpenAIRequest
+			require.NoError(t, common.UnmarshalJsonStr(`{
+				"model": "claude-sonnet-4-5-20250929",
+				"messages": [
+					{"role": "user", "content": [
+						{"type": "text", "text": "describe"},
+						{"type": "image_url", "image_url": {"url": "data:`+tt.mimeType+`;base64,UklGRg=="}}
+					]}
+				]
+			}`, &request))
+
+			claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+			if tt.wantError {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "image/bmp")
+				return
+			}
+			require.NoError(t, err)
+			blocks, ok := claudeRequest.Messages[0].Content.([]dto.ClaudeMediaMessage)
+			require.True(t, ok)
+			require.Len(t, blocks, 2)
+			assert.Equal(t, "image", blocks[1].Type)
+			assert.Equal(t, tt.wantType, blocks[1].Source.MediaType)
+		})
+	}
+}
+
+func TestOpenAIChatRequestToClaudeMessagesHandlesNonStringStopItems(t *testing.T) {
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"stop": ["END", 42, null, {"a": 1}, true],
+		"messages": [{"role": "user", "content": "hello"}]
+	}`, &request))
+
+	var claudeRequest *dto.ClaudeRequest
+	var err error
+	require.NotPanics(t, func() {
+		claudeRequest, err = OpenAIChatRequestToClaudeMessages(nil, request)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"END", "42", "true"}, claudeRequest.StopSequences)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesRejectsInputAudio(t *testing.T) {
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [
+			{"role": "user", "content": [
+				{"type": "text", "text": "what does this say?"},
+				{"type": "input_audio", "input_audio": {"data": "UklGRiQAAABXQVZF", "format": "wav"}}
+			]}
+		]
+	}`, &request))
+
+	_, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.Error(t, err)
+	var apiErr *types.NewAPIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	assert.Contains(t, err.Error(), "input_audio")
+}
+
+func TestOpenAIChatRequestToClaudeMessagesEnablesDocumentCitations(t *testing.T) {
+	relaymedia.SetMediaResolver(relaymedia.MediaResolver{
+		GetBase64Data: func(_ *gin.Context, _ types.FileSource, _ ...string) (string, string, error) {
+			return "JVBERi0xLjQ=", "application/pdf", nil
+		},
+	})
+	t.Cleanup(func() { relaymedia.SetMediaResolver(relaymedia.MediaResolver{}) })
+
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [
+			{"role": "user", "content": [
+				{"type": "file", "file": {"filename": "report.pdf", "file_data": "data:application/pdf;base64,JVBERi0xLjQ="}, "citations": {"enabled": true}},
+				{"type": "file", "file": {"filename": "appendix.pdf", "file_data": "data:application/pdf;base64,JVBERi0xLjQ="}},
+				{"type": "text", "text": "summarize with sources"}
+			]}
+		]
+	}`, &request))
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+	blocks, ok := claudeRequest.Messages[0].Content.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.Len(t, blocks, 3)
+	assert.Equal(t, "document", blocks[0].Type)
+	assert.JSONEq(t, `{"enabled": true}`, string(blocks[0].Citations))
+	assert.Empty(t, blocks[1].Citations)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesGroupsToolResults(t *testing.T) {
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [
+			{"role": "user", "content": "weather in Paris and Tokyo?"},
+			{"role": "assistant", "content": null, "tool_calls": [
+				{"id": "call_paris", "type": "function", "function": {"name": "weather", "arguments": "{\"city\":\"Paris\"}"}},
+				{"id": "call_tokyo", "type": "function", "function": {"name": "weather", "arguments": "{\"city\":\"Tokyo\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_tokyo", "content": "rainy"},
+			{"role": "assistant", "content": "still waiting for Paris"},
+			{"role": "tool", "tool_call_id": "call_paris", "content": "sunny"}
+		]
+	}`, &request))
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+	require.Len(t, claudeRequest.Messages, 4)
+
+	toolMessage := claudeRequest.Messages[2]
+	assert.Equal(t, "user", toolMessage.Role)
+	blocks, ok := toolMessage.Content.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.Len(t, blocks, 2)
+	// 按 tool_use 的顺序排列，而不是 tool 消息到达的顺序
+	assert.Equal(t, "tool_result", blocks[0].Type)
+	assert.Equal(t, "call_paris", blocks[0].ToolUseId)
+	assert.Equal(t, "call_tokyo", blocks[1].ToolUseId)
+	assert.Equal(t, "assistant", claudeRequest.Messages[3].Role)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesKeepsConsecutiveToolResultsTogether(t *testing.T) {
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [
+			{"role": "user", "content": "look both up"},
+			{"role": "assistant", "content": null, "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "lookup", "arguments": "{}"}},
+				{"id": "call_2", "type": "function", "function": {"name": "lookup", "arguments": "{}"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "one"},
+			{"role": "tool", "tool_call_id": "call_2", "content": "two"}
+		]
+	}`, &request))
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+	require.Len(t, claudeRequest.Messages, 3)
+	blocks, ok := claudeRequest.Messages[2].Content.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.Len(t, blocks, 2)
+	assert.Equal(t, "call_1", blocks[0].ToolUseId)
+	assert.Equal(t, "call_2", blocks[1].ToolUseId)
+}
+
+func TestOpenAIChatRequestToClaudeMessagesParsesParameterizedDataURL(t *testing.T) {
+	var resolvedSource *types.Base64Source
+	relaymedia.SetMediaResolver(relaymedia.MediaResolver{
+		GetBase64Data: func(_ *gin.Context, source types.FileSource, _ ...string) (string, string, error) {
+			resolvedSource = source.(*types.Base64Source)
+			mimeType, data, _ := strings.Cut(strings.TrimPrefix(source.GetRawData(), "data:"), ";base64,")
+			return data, mimeType, nil
+		},
+	})
+	t.Cleanup(func() { relaymedia.SetMediaResolver(relaymedia.MediaResolver{}) })
+
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [
+			{"role": "user", "content": [
+				{"type": "text", "text": "describe"},
+				{"type": "image_url", "image_url": {"url": "data:Image/PNG;charset=utf-8;name=shot.png;base64,iVBORw0KGgo="}}
+			]}
+		]
+	}`, &request))
+
+	claudeRequest, err := OpenAIChatRequestToClaudeMessages(nil, request)
+	require.NoError(t, err)
+	require.NotNil(t, resolvedSource)
+	assert.Equal(t, "data:image/png;base64,iVBORw0KGgo=", resolvedSource.Base64Data)
+
+	blocks, ok := claudeRequest.Messages[0].Content.([]dto.ClaudeMediaMessage)
+	require.True(t, ok)
+	require.Len(t, blocks, 2)
+	assert.Equal(t, "image", blocks[1].Type)
+	assert.Equal(t, "image/png", blocks[1].Source.MediaType)
+	assert.Equal(t, "iVBORw0KGgo=", blocks[1].Source.Data)
+}
+
+func TestParseBase64DataURL(t *testing.T) {
+	tests := []struct {
+		name          string
+		dataURL       string
+		wantMediaType string
+		wantData      string
+		wantErr       bool
+	}{
+		{name: "plain", dataURL: "data:image/png;base64,AAAA", wantMediaType: "image/png", wantData: "AAAA"},
+		{name: "parameters", dataURL: "data:image/jpeg;charset=utf-8;base64,AAAA", wantMediaType: "image/jpeg", wantData: "AAAA"},
+		{name: "no media type", dataURL: "data:;base64,AAAA", wantMediaType: "", wantData: "AAAA"},
+		{name: "not base64", dataURL: "data:image/svg+xml;charset=utf-8,%3Csvg%3E", wantErr: true},
+		{name: "missing separator", dataURL: "data:image/png;base64", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mediaType, data, err := parseBase64DataURL(tt.dataURL)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantMediaType, mediaType)
+			assert.Equal(t, tt.wantData, data)
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package claude
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+)
+
+// ResponseFormatToolName 是承载 response_format json_schema 的合成工具名，响应侧据此把 tool_use 参数还原为正文
+const ResponseFormatToolName = "json_schema_response"
+
+// ResponseFormatTool 把 OpenAI response_format 的 json_schema 转为一个 Claude 工具
+func ResponseFormatTool(responseFormat *dto.ResponseFormat) (*dto.Tool, error) {
+	if responseFormat == nil || responseFormat.Type != "json_schema" || len(responseFormat.JsonSchema) == 0 {
+		return nil, nil
+	}
+	var jsonSchema dto.FormatJsonSchema
+	if err := common.Unmarshal(responseFormat.JsonSchema, &jsonSchema); err != nil {
+		return nil, fmt.Errorf("invalid response_format json_schema: %w", err)
+	}
+	schema, ok := jsonSchema.Schema.(map[string]any)
+	if !ok {
+		return nil, errors.New("invalid response_format json_schema: schema must be an object")
+	}
+	if schemaType, _ := schema["type"].(string); schemaType != "object" {
+		return nil, fmt.Errorf("invalid response_format json_schema: root type must be \"object\", got %v", schema["type"])
+	}
+	description := jsonSchema.Description
+	if description == "" {
+		description = "Respond with a JSON object that matches this schema."
+	}
+	return &dto.Tool{
+		Name:        ResponseFormatToolName,
+		Description: description,
+		InputSchema: schema,
+	}, nil
+}
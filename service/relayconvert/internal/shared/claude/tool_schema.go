@@ -0,0 +1,41 @@
+package claude
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/QuantumNous/new-api/types"
+)
+
+// ValidateToolInputSchema 在发往上游前校验工具的 input_schema，避免 Anthropic 以不透明的 400 拒绝整个请求。
+// 返回规范化后的 schema type，无参数工具常以 {} 声明，按空对象处理
+func ValidateToolInputSchema(toolName string, schema map[string]any) (string, error) {
+	schemaType, _ := schema["type"].(string)
+	if len(schema) == 0 {
+		schemaType = "object"
+	}
+	if schemaType != "object" {
+		return "", invalidInputSchemaError(fmt.Errorf("invalid input_schema for tool %q: type must be \"object\", got %v", toolName, schema["type"]))
+	}
+	properties, ok := schema["properties"].(map[string]any)
+	if schema["properties"] != nil && !ok {
+		return "", invalidInputSchemaError(fmt.Errorf("invalid input_schema for tool %q: properties must be an object", toolName))
+	}
+	if schema["required"] != nil {
+		required, ok := schema["required"].([]any)
+		if !ok {
+			return "", invalidInputSchemaError(fmt.Errorf("invalid input_schema for tool %q: required must be an array", toolName))
+		}
+		for _, item := range required {
+			name, ok := item.(string)
+			if _, defined := properties[name]; !ok || !defined {
+				return "", invalidInputSchemaError(fmt.Errorf("invalid input_schema for tool %q: required property %v is not defined in properties", toolName, item))
+			}
+		}
+	}
+	return schemaType, nil
+}
+
+func invalidInputSchemaError(err error) error {
+	return types.NewErrorWithStatusCode(err, types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+}
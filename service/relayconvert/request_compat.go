@@ -7,6 +7,7 @@ import (
 	geminichat "github.com/QuantumNous/new-api/service/relayconvert/internal/gemini_chat"
 	oaichat "github.com/QuantumNous/new-api/service/relayconvert/internal/oai_chat"
 	oairesponses "github.com/QuantumNous/new-api/service/relayconvert/internal/oai_responses"
+	sharedclaude "github.com/QuantumNous/new-api/service/relayconvert/internal/shared/claude"
 	sharedgemini "github.com/QuantumNous/new-api/service/relayconvert/internal/shared/gemini"
 	"github.com/QuantumNous/new-api/setting/model_setting"
 	"github.com/gin-gonic/gin"
@@ -20,6 +21,11 @@ func OpenAIChatRequestToClaudeMessages(c *gin.Context, textRequest dto.GeneralOp
 	return oaichat.OpenAIChatRequestToClaudeMessages(c, textRequest)
 }
 
+func ValidateClaudeToolInputSchema(toolName string, schema map[string]any) error {
+	_, err := sharedclaude.ValidateToolInputSchema(toolName, schema)
+	return err
+}
+
 func GeminiGenerateContentRequestToOpenAIChat(geminiRequest *dto.GeminiChatRequest, info *relaycommon.RelayInfo) (*dto.GeneralOpenAIRequest, error) {
 	return geminichat.GeminiGenerateContentRequestToOpenAIChat(geminiRequest, info)
 }
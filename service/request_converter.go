@@ -12,8 +12,9 @@ import (
 
 func init() {
 	relayconvert.SetMediaResolver(relayconvert.MediaResolver{
-		GetBase64Data:        GetBase64Data,
-		DecodeBase64FileData: DecodeBase64FileData,
+		GetBase64Data:          GetBase64Data,
+		GetBase64DataWithLimit: GetBase64DataWithLimit,
+		DecodeBase64FileData:   DecodeBase64FileData,
 	})
 }
 
@@ -176,6 +176,41 @@ func getImageToken(c *gin.Context, fileMeta *types.FileMeta, model string, strea
 	return tiles*tileTokens + baseTokens, nil
 }
 
+// claudeImageDefaultTokens 是无法读取图片尺寸时 Claude 图片的兜底估算值
+const claudeImageDefaultTokens = 520
+
+// Anthropic 会把长边超过 1568px 的图片等比缩小，单张图片约 1600 token 封顶
+const (
+	claudeImageMaxLongEdge = 1568
+	claudeImageMaxTokens   = 1600
+)
+
+// getClaudeImageToken 按 Anthropic 公式 (width * height) / 750 估算图片 token
+func getClaudeImageToken(c *gin.Context, fileMeta *types.FileMeta, stream bool) int {
+	if fileMeta == nil || fileMeta.Source == nil {
+		return claudeImageDefaultTokens
+	}
+	if !constant.GetMediaToken || (!constant.GetMediaTokenNotStream && !stream) {
+		return claudeImageDefaultTokens
+	}
+	config, format, err := GetImageConfig(c, fileMeta.Source)
+	if err != nil || config.Width <= 0 || config.Height <= 0 {
+		logger.LogDebug(c, "claude image token fallback: identifier=%s, err=%v", fileMeta.GetIdentifier(), err)
+		return claudeImageDefaultTokens
+	}
+	width := float64(config.Width)
+	height := float64(config.Height)
+	// 尺寸来自图片头，可被伪造，先缩放到上游实际处理的尺寸再计算
+	if longEdge := math.Max(width, height); longEdge > claudeImageMaxLongEdge {
+		scale := claudeImageMaxLongEdge / longEdge
+		width *= scale
+		height *= scale
+	}
+	tokens := math.Min(math.Ceil(width*height/750), claudeImageMaxTokens)
+	logger.LogDebug(c, "claude image token: format=%s, width=%d, height=%d, tokens=%d", format, config.Width, config.Height, int(tokens))
+	return int(tokens)
+}
+
 func EstimateRequestToken(c *gin.Context, meta *types.TokenCountMeta, info *relaycommon.RelayInfo) (int, error) {
 	// 是否统计token
 	if !constant.CountToken {
@@ -282,6 +317,8 @@ func EstimateRequestToken(c *gin.Context, meta *types.TokenCountMeta, info *rela
 					return 0, fmt.Errorf("error counting image token, media index[%d], identifier[%s], err: %v", i, file.GetIdentifier(), err)
 				}
 				tkm += token
+			} else if strings.HasPrefix(strings.ToLower(model), "claude") {
+				tkm += getClaudeImageToken(c, file, info.IsStream)
 			} else {
 				tkm += 520
 			}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/types"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encodeTestPNG(t *testing.T, width, height int) string {
+	t.Helper()
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))))
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestEstimateRequestTokenCountsClaudeImageByDimensions(t *testing.T) {
+	originalCountToken := constant.CountToken
+	originalGetMediaToken := constant.GetMediaToken
+	originalGetMediaTokenNotStream := constant.GetMediaTokenNotStream
+	constant.CountToken = true
+	constant.GetMediaToken = true
+	constant.GetMediaTokenNotStream = true
+	t.Cleanup(func() {
+		constant.CountToken = originalCountToken
+		constant.GetMediaToken = originalGetMediaToken
+		constant.GetMediaTokenNotStream = originalGetMediaTokenNotStream
+	})
+
+	tests := []struct {
+		name   string
+		width  int
+		height int
+		want   int
+	}{
+		// 1500*750/750
+		{name: "within size limit", width: 1500, height: 750, want: 1500},
+		// 缩放到 1568x1568 后超过单图上限
+		{name: "oversized image is scaled and capped", width: 4000, height: 4000, want: 1600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+			common.SetContextKey(c, constant.ContextKeyOriginalModel, "claude-sonnet-4-5")
+
+			meta := &types.TokenCountMeta{
+				TokenType: types.TokenTypeTextNumber,
+				Files: []*types.FileMeta{
+					types.NewFileMeta(types.FileTypeImage, types.NewBase64FileSource(encodeTestPNG(t, tt.width, tt.height), "image/png")),
+				},
+			}
+			info := &relaycommon.RelayInfo{RelayFormat: types.RelayFormatClaude}
+
+			tokens, err := EstimateRequestToken(c, meta, info)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, tokens)
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/setting/config"
 )
 
@@ -19,8 +20,76 @@ type ClaudeSettings struct {
 	DefaultMaxTokens                      map[string]int                 `json:"default_max_tokens"`
 	ThinkingAdapterEnabled                bool                           `json:"thinking_adapter_enabled"`
 	ThinkingAdapterBudgetTokensPercentage float64                        `json:"thinking_adapter_budget_tokens_percentage"`
+	// 按模型覆盖 thinking 预算比例，key 为去掉 -thinking 后缀的模型名
+	ThinkingAdapterModelBudgetPercentages map[string]float64 `json:"thinking_adapter_model_budget_percentages"`
+	// 上游返回 429 时，retry-after 不超过该秒数则等待后重试一次（未携带 retry-after 时等待 1 秒），0 表示不重试；开启后请求体会先读入内存以便重放
+	RateLimitRetryMaxWaitSeconds int `json:"rate_limit_retry_max_wait_seconds"`
+	// 流式 signature_delta 转换为 OpenAI 格式时，是否同时在 reasoning_content 中输出换行
+	ThinkingSignatureNewlineEnabled bool `json:"thinking_signature_newline_enabled"`
+	// tool_choice 为 none 时直接去掉 tools 与 tool_choice，兼容不支持 none 的旧版 API
+	ToolChoiceNoneStripTools bool `json:"tool_choice_none_strip_tools"`
+	// 转换请求时内联的图片/文件总字节数上限，0 表示沿用 MAX_REQUEST_BODY_MB（两者都为 0 时不限制）
+	MaxRequestBytes int64 `json:"max_request_bytes"`
+	// 始终关闭并行工具调用，客户端未指定 tool_choice 时补一个 auto
+	ForceDisableParallelToolUse bool `json:"force_disable_parallel_tool_use"`
+	// OpenAI 格式的字符串 system 消息达到该字符数时自动加 cache_control 断点，0 表示不自动添加
+	SystemCacheControlMinChars int `json:"system_cache_control_min_chars"`
+	// 远程图片/文件下载失败时跳过该内容继续转换，关闭时任一下载失败即拒绝整个请求
+	SkipUnfetchableImages bool `json:"skip_unfetchable_images"`
+	// 转换为 OpenAI 流式格式时，下游空闲达到该秒数即发送 Ping，避免 thinking 阶段连接被代理断开，0 表示关闭
+	StreamIdlePingSeconds int `json:"stream_idle_ping_seconds"`
+	// OpenAI 格式的对话消息数达到该值时，在最后一条 assistant 消息上加 cache_control 断点，0 表示不添加
+	AssistantCacheControlMinMessages int `json:"assistant_cache_control_min_messages"`
+	// 开启后拒绝不在 Claude 渠道模型列表中的上游模型，避免拼写错误的模型名发往上游
+	StrictModelValidation bool `json:"strict_model_validation"`
+	// OpenAI 格式请求转换时 stop 序列的数量上限，默认 0 表示不限制，由上游自行校验
+	MaxStopSequences int `json:"max_stop_sequences"`
+	// stop 序列超出上限时截断并记录日志，关闭时直接拒绝请求
+	StopSequencesTruncate bool `json:"stop_sequences_truncate"`
+	// Claude 不支持 seed，开启后携带 seed 的 OpenAI 格式请求直接拒绝，关闭时仅在响应头中提示
+	RejectSeed bool `json:"reject_seed"`
+	// 开启 thinking 的请求按 基础秒数 + max_tokens/1000*每千 token 秒数 计算上游超时，只在超过 RELAY_TIMEOUT 时生效，基础秒数为 0 表示关闭
+	ThinkingTimeoutBaseSeconds        int     `json:"thinking_timeout_base_seconds"`
+	ThinkingTimeoutSecondsPer1KTokens float64 `json:"thinking_timeout_seconds_per_1k_tokens"`
+	// 开启后 Anthropic 渠道才接受 X-Claude-Batch 请求头，以 Message Batches API 提交请求；默认关闭，客户端无法自行开启
+	MessageBatchEnabled bool `json:"message_batch_enabled"`
+	// 转换为 OpenAI 格式时去掉 reasoning_content 等思考内容，兼容无法处理该字段的客户端；thinking token 仍计入用量。
+	// 等同于 ThinkingOutputMode=omit，仅在 ThinkingOutputMode 未配置时生效
+	StripReasoningContent bool `json:"strip_reasoning_content"`
+	// 转换为 OpenAI 格式时思考内容的输出方式：reasoning_field（默认）、inline_tags、omit；omit 时 thinking token 仍计入用量
+	ThinkingOutputMode string `json:"thinking_output_mode"`
+	// 转换为 OpenAI 流式格式且客户端开启 include_usage 时，每新增该数量的输出 token（按已输出文本估算）下发一次中间用量，0 表示关闭
+	StreamUsageIntervalTokens int `json:"stream_usage_interval_tokens"`
+	// Claude 格式请求中 system block 与 messages 的数量上限，超出直接拒绝，避免异常请求在转换中消耗大量 CPU；0 表示不限制
+	MaxSystemBlocks int `json:"max_system_blocks"`
+	MaxMessages     int `json:"max_messages"`
+	// 客户端未指定时使用的 service_tier（auto 或 standard_only），为空表示不设置；仍受渠道 allow_service_tier 控制
+	DefaultServiceTier string `json:"default_service_tier"`
+	// 模型别名，key 为对外暴露的别名，value 为实际发往上游的模型名；转换为 OpenAI 格式的响应中 model 仍返回别名
+	ModelAliases map[string]string `json:"model_aliases"`
+	// 按模型指定 anthropic-version，客户端显式传入时仍以客户端为准
+	ModelAnthropicVersions map[string]string `json:"model_anthropic_versions"`
 }
 
+// DefaultAnthropicVersion 未配置且客户端未传入时使用的 anthropic-version
+const DefaultAnthropicVersion = "2023-06-01"
+
+// ThinkingOutputMode 的取值
+const (
+	// ThinkingOutputModeReasoningField 思考内容放在 reasoning_content 字段
+	ThinkingOutputModeReasoningField = "reasoning_field"
+	// ThinkingOutputModeInlineTags 思考内容用 <thinking></thinking> 包裹后拼在正文前，兼容只读取 content 的旧客户端
+	ThinkingOutputModeInlineTags = "inline_tags"
+	// ThinkingOutputModeOmit 不输出思考内容
+	ThinkingOutputModeOmit = "omit"
+)
+
+// DefaultMaxSystemBlocks 默认的 system block 数量上限，正常客户端远用不到
+const DefaultMaxSystemBlocks = 256
+
+// DefaultMaxMessages 默认的 messages 数量上限，与 Anthropic 单次请求的上限一致
+const DefaultMaxMessages = 100000
+
 // 默认配置
 var defaultClaudeSettings = ClaudeSettings{
 	HeadersSettings:        map[string]map[string][]string{},
@@ -29,6 +98,12 @@ var defaultClaudeSettings = ClaudeSettings{
 		"default": 8192,
 	},
 	ThinkingAdapterBudgetTokensPercentage: 0.8,
+	ThinkingAdapterModelBudgetPercentages: map[string]float64{},
+	ThinkingSignatureNewlineEnabled:       true,
+	MaxSystemBlocks:                       DefaultMaxSystemBlocks,
+	MaxMessages:                           DefaultMaxMessages,
+	ModelAliases:                          map[string]string{},
+	ModelAnthropicVersions:                map[string]string{},
 }
 
 // 全局实例
@@ -81,9 +156,66 @@ func normalizeHeaderListValues(values []string) []string {
 	return normalizedValues
 }
 
+// GetDefaultMaxTokens 按模型名、去掉 -thinking 后缀的基础模型名、default 的顺序查找默认 max_tokens
 func (c *ClaudeSettings) GetDefaultMaxTokens(model string) int {
 	if maxTokens, ok := c.DefaultMaxTokens[model]; ok {
 		return maxTokens
 	}
+	if maxTokens, ok := c.DefaultMaxTokens[strings.TrimSuffix(model, "-thinking")]; ok {
+		return maxTokens
+	}
 	return c.DefaultMaxTokens["default"]
 }
+
+// GetAnthropicVersion 按模型名、去掉 -thinking 后缀的基础模型名查找 anthropic-version，未配置时返回默认版本
+func (c *ClaudeSettings) GetAnthropicVersion(model string) string {
+	if version, ok := c.ModelAnthropicVersions[model]; ok && version != "" {
+		return version
+	}
+	if version, ok := c.ModelAnthropicVersions[strings.TrimSuffix(model, "-thinking")]; ok && version != "" {
+		return version
+	}
+	return DefaultAnthropicVersion
+}
+
+// ResolveModelAlias 返回别名对应的实际模型名；带 -thinking 后缀时按基础模型名查找并保留后缀，未配置别名时返回 false
+func (c *ClaudeSettings) ResolveModelAlias(model string) (string, bool) {
+	if target, ok := c.ModelAliases[model]; ok && target != "" {
+		return target, true
+	}
+	if baseModel, found := strings.CutSuffix(model, "-thinking"); found {
+		if target, ok := c.ModelAliases[baseModel]; ok && target != "" {
+			return target + "-thinking", true
+		}
+	}
+	return model, false
+}
+
+// GetMaxRequestBytes 返回转换请求时允许内联的文件总字节数
+func (c *ClaudeSettings) GetMaxRequestBytes() int64 {
+	if c.MaxRequestBytes > 0 {
+		return c.MaxRequestBytes
+	}
+	return int64(constant.MaxRequestBodyMB) << 20
+}
+
+// GetThinkingBudgetTokensPercentage 返回模型的 thinking 预算比例，未单独配置或配置值不在 (0,1) 内时使用全局比例，
+// 否则 budget_tokens 会低于 1024 或不小于 max_tokens，被上游拒绝
+func (c *ClaudeSettings) GetThinkingBudgetTokensPercentage(model string) float64 {
+	if percentage, ok := c.ThinkingAdapterModelBudgetPercentages[strings.TrimSuffix(model, "-thinking")]; ok && percentage > 0 && percentage < 1 {
+		return percentage
+	}
+	return c.ThinkingAdapterBudgetTokensPercentage
+}
+
+// GetThinkingOutputMode 返回生效的思考内容输出方式；未配置或取值无效时，开启 StripReasoningContent 为 omit，否则为 reasoning_field
+func (c *ClaudeSettings) GetThinkingOutputMode() string {
+	switch c.ThinkingOutputMode {
+	case ThinkingOutputModeReasoningField, ThinkingOutputModeInlineTags, ThinkingOutputModeOmit:
+		return c.ThinkingOutputMode
+	}
+	if c.StripReasoningContent {
+		return ThinkingOutputModeOmit
+	}
+	return ThinkingOutputModeReasoningField
+}
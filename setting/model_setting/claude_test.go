@@ -58,3 +58,134 @@ func TestClaudeSettingsWriteHeadersDeduplicatesAcrossCommaSeparatedAndRepeatedVa
 		t.Fatalf("expected deduplicated merged header %q, got %q", expected, got[0])
 	}
 }
+
+func TestClaudeSettingsGetThinkingBudgetTokensPercentageUsesModelOverride(t *testing.T) {
+	settings := &ClaudeSettings{
+		ThinkingAdapterBudgetTokensPercentage: 0.8,
+		ThinkingAdapterModelBudgetPercentages: map[string]float64{
+			"claude-3-5-haiku-20241022": 0.5,
+		},
+	}
+
+	if got := settings.GetThinkingBudgetTokensPercentage("claude-3-5-haiku-20241022-thinking"); got != 0.5 {
+		t.Fatalf("expected model override 0.5, got %v", got)
+	}
+	if got := settings.GetThinkingBudgetTokensPercentage("claude-3-5-haiku-20241022"); got != 0.5 {
+		t.Fatalf("expected model override 0.5 for base model name, got %v", got)
+	}
+}
+
+func TestClaudeSettingsGetThinkingBudgetTokensPercentageFallsBackToGlobal(t *testing.T) {
+	settings := &ClaudeSettings{
+		ThinkingAdapterBudgetTokensPercentage: 0.8,
+		ThinkingAdapterModelBudgetPercentages: map[string]float64{
+			"claude-3-5-haiku-20241022": 0.5,
+		},
+	}
+
+	if got := settings.GetThinkingBudgetTokensPercentage("claude-opus-4-1-20250805-thinking"); got != 0.8 {
+		t.Fatalf("expected global percentage 0.8, got %v", got)
+	}
+}
+
+func TestClaudeSettingsGetThinkingBudgetTokensPercentageIgnoresOutOfRangeOverride(t *testing.T) {
+	settings := &ClaudeSettings{
+		ThinkingAdapterBudgetTokensPercentage: 0.8,
+		ThinkingAdapterModelBudgetPercentages: map[string]float64{
+			"claude-zero":     0,
+			"claude-negative": -0.5,
+			"claude-one":      1,
+			"claude-above":    1.5,
+		},
+	}
+
+	for model := range settings.ThinkingAdapterModelBudgetPercentages {
+		if got := settings.GetThinkingBudgetTokensPercentage(model); got != 0.8 {
+			t.Fatalf("expected global percentage 0.8 for %s, got %v", model, got)
+		}
+	}
+}
+
+func TestClaudeSettingsGetDefaultMaxTokensUsesBaseModelOverride(t *testing.T) {
+	settings := &ClaudeSettings{
+		DefaultMaxTokens: map[string]int{
+			"default":                    8192,
+			"claude-3-5-haiku-20241022":  4096,
+			"claude-sonnet-4-5-20250929": 16384,
+		},
+	}
+
+	if got := settings.GetDefaultMaxTokens("claude-sonnet-4-5-20250929"); got != 16384 {
+		t.Fatalf("expected mapped default 16384, got %d", got)
+	}
+	if got := settings.GetDefaultMaxTokens("claude-3-5-haiku-20241022-thinking"); got != 4096 {
+		t.Fatalf("expected base model default 4096 for thinking model, got %d", got)
+	}
+}
+
+func TestClaudeSettingsGetDefaultMaxTokensFallsBackToDefault(t *testing.T) {
+	settings := &ClaudeSettings{
+		DefaultMaxTokens: map[string]int{
+			"default":                   8192,
+			"claude-3-5-haiku-20241022": 4096,
+		},
+	}
+
+	if got := settings.GetDefaultMaxTokens("claude-opus-4-1-20250805-thinking"); got != 8192 {
+		t.Fatalf("expected fallback default 8192, got %d", got)
+	}
+}
+
+func TestClaudeSettingsGetAnthropicVersion(t *testing.T) {
+	settings := &ClaudeSettings{
+		ModelAnthropicVersions: map[string]string{
+			"claude-opus-4-1": "2025-01-01",
+		},
+	}
+
+	if got := settings.GetAnthropicVersion("claude-opus-4-1"); got != "2025-01-01" {
+		t.Fatalf("expected model version, got %q", got)
+	}
+	if got := settings.GetAnthropicVersion("claude-opus-4-1-thinking"); got != "2025-01-01" {
+		t.Fatalf("expected base model version for thinking variant, got %q", got)
+	}
+	if got := settings.GetAnthropicVersion("claude-sonnet-4-5"); got != DefaultAnthropicVersion {
+		t.Fatalf("expected default version, got %q", got)
+	}
+}
+
+func TestClaudeSettingsGetThinkingOutputModeStripReasoningContentAlias(t *testing.T) {
+	settings := &ClaudeSettings{StripReasoningContent: true}
+	if got := settings.GetThinkingOutputMode(); got != ThinkingOutputModeOmit {
+		t.Fatalf("expected strip_reasoning_content to act as omit, got %q", got)
+	}
+
+	settings.ThinkingOutputMode = ThinkingOutputModeInlineTags
+	if got := settings.GetThinkingOutputMode(); got != ThinkingOutputModeInlineTags {
+		t.Fatalf("expected explicit thinking_output_mode to win, got %q", got)
+	}
+
+	settings.StripReasoningContent = false
+	settings.ThinkingOutputMode = ""
+	if got := settings.GetThinkingOutputMode(); got != ThinkingOutputModeReasoningField {
+		t.Fatalf("expected default reasoning_field, got %q", got)
+	}
+}
+
+func TestClaudeSettingsResolveModelAlias(t *testing.T) {
+	settings := &ClaudeSettings{
+		ModelAliases: map[string]string{
+			"claude-smart": "claude-sonnet-4-5-20250929",
+		},
+	}
+
+	if got, ok := settings.ResolveModelAlias("claude-smart"); !ok || got != "claude-sonnet-4-5-20250929" {
+		t.Fatalf("expected aliased model, got %q, %v", got, ok)
+	}
+	if got, ok := settings.ResolveModelAlias("claude-smart-thinking"); !ok || got != "claude-sonnet-4-5-20250929-thinking" {
+		t.Fatalf("expected aliased thinking model, got %q, %v", got, ok)
+	}
+	if got, ok := settings.ResolveModelAlias("claude-opus-4-1"); ok || got != "claude-opus-4-1" {
+		t.Fatalf("expected unaliased model unchanged, got %q, %v", got, ok)
+	}
+}
@@ -42,6 +42,9 @@ const (
 	ErrorCodeSensitiveWordsDetected ErrorCode = "sensitive_words_detected"
 	ErrorCodeViolationFeeGrokCSAM   ErrorCode = "violation_fee.grok.csam"
 
+	// previous_response_id 对应的对话已不在本地存储中，客户端需要携带完整历史重发
+	ErrorCodePreviousResponseNotFound ErrorCode = "previous_response_not_found"
+
 	// new api error
 	ErrorCodeCountTokenFailed   ErrorCode = "count_token_failed"
 	ErrorCodeModelPriceError    ErrorCode = "model_price_error"
@@ -64,6 +67,7 @@ const (
 	ErrorCodeReadRequestBodyFailed ErrorCode = "read_request_body_failed"
 	ErrorCodeConvertRequestFailed  ErrorCode = "convert_request_failed"
 	ErrorCodeAccessDenied          ErrorCode = "access_denied"
+	ErrorCodeRequestBodyTooLarge   ErrorCode = "request_body_too_large"
 
 	// request error
 	ErrorCodeBadRequestBody ErrorCode = "bad_request_body"
@@ -76,6 +80,7 @@ const (
 	ErrorCodeEmptyResponse          ErrorCode = "empty_response"
 	ErrorCodeAwsInvokeError         ErrorCode = "aws_invoke_error"
 	ErrorCodeModelNotFound          ErrorCode = "model_not_found"
+	ErrorCodeModelNotSupported      ErrorCode = "model_not_supported"
 	ErrorCodePromptBlocked          ErrorCode = "prompt_blocked"
 
 	// sql error
@@ -405,6 +410,26 @@ func ErrOptionWithHideErrMsg(replaceStr string) NewAPIErrorOptions {
 	}
 }
 
+// ErrOptionWithUpstreamRequestId 记录上游返回的 request id，合并写入 Metadata，不改动返回给客户端的错误信息；
+// 已有的 Metadata 不是 JSON 对象时保持原样
+func ErrOptionWithUpstreamRequestId(requestId string) NewAPIErrorOptions {
+	return func(e *NewAPIError) {
+		if requestId == "" {
+			return
+		}
+		metadata := map[string]any{}
+		if len(e.Metadata) == 0 || common.Unmarshal(e.Metadata, &metadata) == nil {
+			if metadata == nil {
+				metadata = map[string]any{}
+			}
+			metadata["upstream_request_id"] = requestId
+			if merged, err := common.Marshal(metadata); err == nil {
+				e.Metadata = merged
+			}
+		}
+	}
+}
+
 func IsRecordErrorLog(e *NewAPIError) bool {
 	if e == nil {
 		return false